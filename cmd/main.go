@@ -1,13 +1,16 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"ha-tray/internal/cli"
 	"ha-tray/internal/service"
 )
 
@@ -17,7 +20,35 @@ var (
 	BuildDate = ""
 )
 
+// listFlag is a flag which may be repeated, collecting every value
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func main() {
+	var configFlags listFlag
+	configPath := flag.String("config", "", "path to the configuration file (default: $HATRAY_CONFIG, then $XDG_CONFIG_HOME/HATray/config.toml)")
+	flag.Var(&configFlags, "set", "override a configuration value, e.g. --set server[0].url=https://ha.example.com (may be repeated)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n\nFlags:\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+		fmt.Fprintln(flag.CommandLine.Output())
+		cli.Usage(flag.CommandLine.Output())
+	}
+	flag.Parse()
+
+	// Subcommands run instead of the service, without logging to file
+	if flag.NArg() > 0 {
+		os.Exit(cli.Run(flag.Args(), *configPath, configFlags))
+	}
+
 	rootLogger, logFile, err := setupLogging()
 	if err != nil {
 		log.Fatalf("failed to setup logging: %v", err)
@@ -37,7 +68,7 @@ func main() {
 	}()
 
 	// Create service layer
-	svc := service.NewService(rootLogger)
+	svc := service.NewService(rootLogger, *configPath, configFlags)
 
 	mainLogger.Info("service initialized")
 
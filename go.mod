@@ -8,9 +8,15 @@ require (
 	github.com/BurntSushi/toml v1.5.0
 	github.com/Xevion/go-ha v0.7.0
 	github.com/coreos/go-systemd v0.0.0-20191104093116-d3cd4ed1dbcf
+	github.com/fsnotify/fsnotify v1.9.0
 	github.com/getlantern/systray v1.2.2
+	github.com/gorilla/websocket v1.5.3
 	github.com/joho/godotenv v1.5.1
+	golang.org/x/crypto v0.40.0
+	golang.org/x/image v0.25.0
+	golang.org/x/net v0.41.0
 	golang.org/x/sys v0.34.0
+	golang.org/x/term v0.33.0
 )
 
 require (
@@ -28,7 +34,6 @@ require (
 	github.com/gobuffalo/packd v1.0.2 // indirect
 	github.com/gobuffalo/packr v1.30.1 // indirect
 	github.com/golang-module/carbon v1.7.3 // indirect
-	github.com/gorilla/websocket v1.5.3 // indirect
 	github.com/nathan-osman/go-sunrise v1.1.0 // indirect
 	github.com/oxtoacart/bpool v0.0.0-20190530202638-03653db5a59c // indirect
 	github.com/rogpeppe/go-internal v1.14.1 // indirect
@@ -39,6 +44,6 @@ require (
 	go.uber.org/multierr v1.6.0 // indirect
 	go.uber.org/zap v1.19.1 // indirect
 	golang.org/x/mod v0.26.0 // indirect
-	golang.org/x/net v0.33.0 // indirect
+	golang.org/x/text v0.27.0 // indirect
 	resty.dev/v3 v3.0.0-beta.3 // indirect
 )
@@ -0,0 +1,288 @@
+package app
+
+import (
+	"cmp"
+	"fmt"
+	"path"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	ga "github.com/Xevion/go-ha"
+)
+
+// AggregateMode decides when an aggregate is triggered by its active members
+type AggregateMode string
+
+const (
+	AggregateAny   AggregateMode = "any"   // at least one member is active
+	AggregateAll   AggregateMode = "all"   // every member is active
+	AggregateCount AggregateMode = "count" // at least threshold members are active
+)
+
+// Valid returns true if the mode is one of the known modes
+func (m AggregateMode) Valid() bool {
+	switch m {
+	case AggregateAny, AggregateAll, AggregateCount:
+		return true
+	default:
+		return false
+	}
+}
+
+// domainPattern matches Home Assistant entity domains, e.g. binary_sensor
+var domainPattern = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// maxListedMembers limits how many members an aggregate names in the tooltip, as tray tooltips are short
+const maxListedMembers = 5
+
+// AggregateConfig combines the state of many entities into a single status, e.g. "any door open" or "3 motion sensors
+// active". Members are listed explicitly, or matched by glob pattern or domain when the server is connected.
+type AggregateConfig struct {
+	Name      string        `toml:"name"`                // shown in the tooltip, e.g. "Doors"
+	Server    string        `toml:"server,omitempty"`    // name of the server providing the members, may be omitted when only one server is configured
+	Entities  []string      `toml:"entities,omitempty"`  // entity IDs or glob patterns, e.g. binary_sensor.*_door
+	Domain    string        `toml:"domain,omitempty"`    // every entity of this domain, e.g. binary_sensor
+	Mode      AggregateMode `toml:"mode,omitempty"`      // defaults to any
+	Threshold int           `toml:"threshold,omitempty"` // active members triggering count mode, defaults to 1
+	States    []string      `toml:"states,omitempty"`    // member states counted as active, defaults to on
+	Icon      IconReference `toml:"icon,omitempty"`      // shown while triggered, defaults to open
+	IdleIcon  IconReference `toml:"idle_icon,omitempty"` // shown while not triggered, defaults to closed
+}
+
+// key returns the key identifying the aggregate, aggregates on different servers may share a name
+func (c AggregateConfig) key() string {
+	return c.Server + "/" + c.Name
+}
+
+// mode returns the aggregate's mode, defaulting to any
+func (c AggregateConfig) mode() AggregateMode {
+	return cmp.Or(c.Mode, AggregateAny)
+}
+
+// threshold returns the number of active members required to trigger the aggregate
+func (c AggregateConfig) threshold() int {
+	return max(c.Threshold, 1)
+}
+
+// icon returns the icon shown while the aggregate is triggered
+func (c AggregateConfig) icon() IconReference {
+	return cmp.Or(c.Icon, IconOpen)
+}
+
+// idleIcon returns the icon shown while the aggregate is not triggered
+func (c AggregateConfig) idleIcon() IconReference {
+	return cmp.Or(c.IdleIcon, IconClosed)
+}
+
+// active returns true if a member's state counts as active
+func (c AggregateConfig) active(state string) bool {
+	if len(c.States) == 0 {
+		return state == "on"
+	}
+	return slices.Contains(c.States, state)
+}
+
+// explicit returns the members listed by entity ID rather than by pattern, which are members even if the server does
+// not have them
+func (c AggregateConfig) explicit() []string {
+	var ids []string
+	for _, entity := range c.Entities {
+		if !isGlob(entity) {
+			ids = append(ids, entity)
+		}
+	}
+	return ids
+}
+
+// includes returns true if the entity ID is listed, matches a pattern, or is within the domain
+func (c AggregateConfig) includes(id string) bool {
+	if c.Domain != "" && strings.HasPrefix(id, c.Domain+".") {
+		return true
+	}
+	for _, entity := range c.Entities {
+		if matched, _ := matchMember(entity, id); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// matchMember matches an entity ID against an aggregate's entity, an ID or glob pattern. Patterns use path.Match
+// rather than filepath.Match, so that they behave the same on every platform.
+func matchMember(pattern, id string) (bool, error) {
+	return path.Match(pattern, id)
+}
+
+// isGlob returns true if an aggregate's entity is a glob pattern rather than an entity ID
+func isGlob(entity string) bool {
+	return strings.ContainsAny(entity, `*?[\`)
+}
+
+// trackedAggregate pairs a configured aggregate with its members and their last known states
+type trackedAggregate struct {
+	config  AggregateConfig
+	order   int                        // position in the configuration, aggregates are listed after entities in this order
+	members map[string]*entitySnapshot // last known state by entity ID, nil until the first state is received
+}
+
+// display returns the icon and tooltip for the aggregate: its icon if triggered, unknown if members with an unknown
+// state could decide whether it is, and its idle icon otherwise. The tooltip lists the members that triggered it.
+func (g *trackedAggregate) display() (IconReference, string) {
+	if len(g.members) == 0 {
+		return IconUnknown, "no matching entities"
+	}
+
+	ids := make([]string, 0, len(g.members))
+	for id := range g.members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var active, inactive, unknown []string
+	for _, id := range ids {
+		snapshot := g.members[id]
+		switch {
+		case snapshot == nil || unavailableStates[snapshot.State]:
+			unknown = append(unknown, memberName(id, snapshot))
+		case g.config.active(snapshot.State):
+			active = append(active, memberName(id, snapshot))
+		default:
+			inactive = append(inactive, memberName(id, snapshot))
+		}
+	}
+
+	var triggered, undecided bool
+	switch g.config.mode() {
+	case AggregateAll:
+		triggered = len(inactive) == 0 && len(unknown) == 0
+		undecided = len(inactive) == 0 && len(unknown) > 0
+	case AggregateCount:
+		triggered = len(active) >= g.config.threshold()
+		undecided = !triggered && len(active)+len(unknown) >= g.config.threshold()
+	default:
+		triggered = len(active) > 0
+		undecided = !triggered && len(unknown) > 0
+	}
+
+	tooltip := fmt.Sprintf("%d of %d active", len(active), len(ids))
+	switch {
+	case g.config.mode() == AggregateAll && !triggered && len(inactive) > 0:
+		// Every member is expected to be active, so those that are not are the interesting ones
+		tooltip += ", except " + listMembers(inactive)
+	case len(active) > 0:
+		tooltip += " (" + listMembers(active) + ")"
+	}
+	if len(unknown) > 0 {
+		tooltip += fmt.Sprintf(", %d unknown", len(unknown))
+	}
+
+	switch {
+	case triggered:
+		return g.config.icon(), tooltip
+	case undecided:
+		return IconUnknown, tooltip
+	default:
+		return g.config.idleIcon(), tooltip
+	}
+}
+
+// memberName returns the friendly name of a member, falling back to its ID
+func memberName(id string, snapshot *entitySnapshot) string {
+	if snapshot != nil {
+		if name, ok := snapshot.Attributes["friendly_name"].(string); ok && name != "" {
+			return name
+		}
+	}
+	return id
+}
+
+// listMembers joins member names, naming at most maxListedMembers of them
+func listMembers(names []string) string {
+	if len(names) <= maxListedMembers {
+		return strings.Join(names, ", ")
+	}
+	return fmt.Sprintf("%s, +%d more", strings.Join(names[:maxListedMembers], ", "), len(names)-maxListedMembers)
+}
+
+// trackAggregates replaces the set of aggregates, keeping the members of aggregates that remain unchanged. Members of
+// new or changed aggregates are resolved by resolveAggregates.
+func (a *App) trackAggregates(aggregates []AggregateConfig) {
+	a.entitiesMu.Lock()
+	defer a.entitiesMu.Unlock()
+
+	tracked := make(map[string]*trackedAggregate, len(aggregates))
+	for i, aggregate := range aggregates {
+		tracked[aggregate.key()] = &trackedAggregate{config: aggregate, order: i, members: make(map[string]*entitySnapshot)}
+		if previous, ok := a.aggregates[aggregate.key()]; ok && reflect.DeepEqual(previous.config, aggregate) {
+			tracked[aggregate.key()].members = previous.members
+		}
+	}
+	a.aggregates = tracked
+}
+
+// resolveAggregates finds the members of an instance's aggregates among the server's entities and records their
+// current state, returning the members to listen to. Entities created after the server was connected join on the next
+// reload.
+func (a *App) resolveAggregates(inst *instance, st ga.State) ([]string, error) {
+	a.entitiesMu.Lock()
+	var aggregates []*trackedAggregate
+	for _, aggregate := range a.aggregates {
+		if aggregate.config.Server == inst.name {
+			aggregates = append(aggregates, aggregate)
+		}
+	}
+	a.entitiesMu.Unlock()
+
+	if len(aggregates) == 0 {
+		return nil, nil
+	}
+
+	states, err := st.ListEntities()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list entities for aggregates: %w", err)
+	}
+
+	members := make(map[*trackedAggregate]map[string]*entitySnapshot, len(aggregates))
+	found := make(map[string]bool, len(states))
+	var ids []string
+	for _, aggregate := range aggregates {
+		members[aggregate] = make(map[string]*entitySnapshot)
+	}
+	for _, state := range states {
+		found[state.EntityID] = true
+		for _, aggregate := range aggregates {
+			if !aggregate.config.includes(state.EntityID) {
+				continue
+			}
+			members[aggregate][state.EntityID] = &entitySnapshot{
+				State:       state.State,
+				Attributes:  state.Attributes,
+				LastChanged: state.LastChanged,
+			}
+			ids = append(ids, state.EntityID)
+		}
+	}
+	for _, aggregate := range aggregates {
+		for _, id := range aggregate.config.explicit() {
+			if !found[id] {
+				// Kept as a member, so that the aggregate shows unknown rather than ignoring a missing entity
+				inst.logger.Warn("aggregate member not found", "aggregate", aggregate.config.Name, "entity", id)
+				members[aggregate][id] = nil
+				ids = append(ids, id)
+			}
+		}
+		inst.logger.Info("aggregate resolved", "aggregate", aggregate.config.Name, "members", len(members[aggregate]))
+	}
+
+	// Members of entities no longer on the server are dropped, rather than left unknown forever
+	a.entitiesMu.Lock()
+	for aggregate, resolved := range members {
+		aggregate.members = resolved
+	}
+	a.entitiesMu.Unlock()
+
+	return ids, nil
+}
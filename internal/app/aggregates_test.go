@@ -0,0 +1,175 @@
+package app
+
+import "testing"
+
+// members builds the members of an aggregate from their states, an empty state being a member not seeded yet
+func members(states map[string]string) map[string]*entitySnapshot {
+	snapshots := make(map[string]*entitySnapshot, len(states))
+	for id, state := range states {
+		if state == "" {
+			snapshots[id] = nil
+			continue
+		}
+		snapshots[id] = &entitySnapshot{State: state}
+	}
+	return snapshots
+}
+
+func TestAggregateDisplay(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      AggregateConfig
+		members     map[string]*entitySnapshot
+		wantIcon    IconReference
+		wantTooltip string
+	}{
+		{
+			name:     "no members",
+			members:  members(nil),
+			wantIcon: IconUnknown, wantTooltip: "no matching entities",
+		},
+		{
+			name:     "any active",
+			members:  members(map[string]string{"binary_sensor.a": "on", "binary_sensor.b": "off"}),
+			wantIcon: IconOpen, wantTooltip: "1 of 2 active (binary_sensor.a)",
+		},
+		{
+			name:     "any inactive",
+			members:  members(map[string]string{"binary_sensor.a": "off", "binary_sensor.b": "off"}),
+			wantIcon: IconClosed, wantTooltip: "0 of 2 active",
+		},
+		{
+			name:     "any active with an unknown member",
+			members:  members(map[string]string{"binary_sensor.a": "on", "binary_sensor.b": "unavailable"}),
+			wantIcon: IconOpen, wantTooltip: "1 of 2 active (binary_sensor.a), 1 unknown",
+		},
+		{
+			name:     "any undecided by an unseeded member",
+			members:  members(map[string]string{"binary_sensor.a": "off", "binary_sensor.b": ""}),
+			wantIcon: IconUnknown, wantTooltip: "0 of 2 active, 1 unknown",
+		},
+		{
+			name:     "any undecided by an unknown member",
+			members:  members(map[string]string{"binary_sensor.a": "off", "binary_sensor.b": "unknown"}),
+			wantIcon: IconUnknown, wantTooltip: "0 of 2 active, 1 unknown",
+		},
+		{
+			name:     "all active",
+			config:   AggregateConfig{Mode: AggregateAll},
+			members:  members(map[string]string{"binary_sensor.a": "on", "binary_sensor.b": "on"}),
+			wantIcon: IconOpen, wantTooltip: "2 of 2 active (binary_sensor.a, binary_sensor.b)",
+		},
+		{
+			name:     "all with an inactive member",
+			config:   AggregateConfig{Mode: AggregateAll},
+			members:  members(map[string]string{"binary_sensor.a": "on", "binary_sensor.b": "off"}),
+			wantIcon: IconClosed, wantTooltip: "1 of 2 active, except binary_sensor.b",
+		},
+		{
+			name:     "all undecided by an unknown member",
+			config:   AggregateConfig{Mode: AggregateAll},
+			members:  members(map[string]string{"binary_sensor.a": "on", "binary_sensor.b": "unavailable"}),
+			wantIcon: IconUnknown, wantTooltip: "1 of 2 active (binary_sensor.a), 1 unknown",
+		},
+		{
+			name:     "all decided by an inactive member despite an unknown member",
+			config:   AggregateConfig{Mode: AggregateAll},
+			members:  members(map[string]string{"binary_sensor.a": "off", "binary_sensor.b": ""}),
+			wantIcon: IconClosed, wantTooltip: "0 of 2 active, except binary_sensor.a, 1 unknown",
+		},
+		{
+			name:     "count reaching the threshold",
+			config:   AggregateConfig{Mode: AggregateCount, Threshold: 2},
+			members:  members(map[string]string{"binary_sensor.a": "on", "binary_sensor.b": "on", "binary_sensor.c": "off"}),
+			wantIcon: IconOpen, wantTooltip: "2 of 3 active (binary_sensor.a, binary_sensor.b)",
+		},
+		{
+			name:     "count below the threshold",
+			config:   AggregateConfig{Mode: AggregateCount, Threshold: 2},
+			members:  members(map[string]string{"binary_sensor.a": "on", "binary_sensor.b": "off", "binary_sensor.c": "off"}),
+			wantIcon: IconClosed, wantTooltip: "1 of 3 active (binary_sensor.a)",
+		},
+		{
+			name:     "count undecided by an unknown member",
+			config:   AggregateConfig{Mode: AggregateCount, Threshold: 2},
+			members:  members(map[string]string{"binary_sensor.a": "on", "binary_sensor.b": "unknown", "binary_sensor.c": "off"}),
+			wantIcon: IconUnknown, wantTooltip: "1 of 3 active (binary_sensor.a), 1 unknown",
+		},
+		{
+			name:     "count decided despite an unknown member",
+			config:   AggregateConfig{Mode: AggregateCount, Threshold: 3},
+			members:  members(map[string]string{"binary_sensor.a": "on", "binary_sensor.b": "unknown", "binary_sensor.c": "off"}),
+			wantIcon: IconClosed, wantTooltip: "1 of 3 active (binary_sensor.a), 1 unknown",
+		},
+		{
+			name:     "count threshold defaults to 1",
+			config:   AggregateConfig{Mode: AggregateCount},
+			members:  members(map[string]string{"binary_sensor.a": "on", "binary_sensor.b": "off"}),
+			wantIcon: IconOpen, wantTooltip: "1 of 2 active (binary_sensor.a)",
+		},
+		{
+			name:     "active states and icons",
+			config:   AggregateConfig{States: []string{"open", "opening"}, Icon: IconWarning, IdleIcon: IconOpen},
+			members:  members(map[string]string{"cover.a": "opening", "cover.b": "on"}),
+			wantIcon: IconWarning, wantTooltip: "1 of 2 active (cover.a)",
+		},
+		{
+			name:     "idle icon",
+			config:   AggregateConfig{States: []string{"open", "opening"}, Icon: IconWarning, IdleIcon: IconOpen},
+			members:  members(map[string]string{"cover.a": "closed", "cover.b": "on"}),
+			wantIcon: IconOpen, wantTooltip: "0 of 2 active",
+		},
+		{
+			name: "friendly names",
+			members: map[string]*entitySnapshot{
+				"binary_sensor.a": {State: "on", Attributes: map[string]any{"friendly_name": "Front Door"}},
+				"binary_sensor.b": {State: "on", Attributes: map[string]any{"friendly_name": ""}},
+			},
+			wantIcon: IconOpen, wantTooltip: "2 of 2 active (Front Door, binary_sensor.b)",
+		},
+		{
+			name: "long member list",
+			members: members(map[string]string{
+				"light.a": "on", "light.b": "on", "light.c": "on", "light.d": "on", "light.e": "on", "light.f": "on", "light.g": "on",
+			}),
+			wantIcon: IconOpen, wantTooltip: "7 of 7 active (light.a, light.b, light.c, light.d, light.e, +2 more)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aggregate := &trackedAggregate{config: tt.config, members: tt.members}
+			icon, tooltip := aggregate.display()
+			if icon != tt.wantIcon || tooltip != tt.wantTooltip {
+				t.Errorf("expected %s (%q), got %s (%q)", tt.wantIcon, tt.wantTooltip, icon, tooltip)
+			}
+		})
+	}
+}
+
+func TestAggregateIncludes(t *testing.T) {
+	config := AggregateConfig{
+		Entities: []string{"binary_sensor.*_door", "lock.front", "cover.garage_?"},
+		Domain:   "light",
+	}
+
+	tests := map[string]bool{
+		"binary_sensor.front_door":   true,
+		"binary_sensor.front_window": false,
+		"lock.front":                 true,
+		"lock.back":                  false,
+		"cover.garage_1":             true,
+		"cover.garage_10":            false,
+		"light.kitchen":              true,
+		"light_sensor.kitchen":       false,
+	}
+	for id, want := range tests {
+		if got := config.includes(id); got != want {
+			t.Errorf("includes(%q) = %v, expected %v", id, got, want)
+		}
+	}
+
+	if explicit := config.explicit(); len(explicit) != 1 || explicit[0] != "lock.front" {
+		t.Errorf("expected only lock.front to be listed explicitly, got %v", explicit)
+	}
+}
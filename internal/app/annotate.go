@@ -0,0 +1,102 @@
+package app
+
+import (
+	"strings"
+)
+
+// configHeader is written at the top of every configuration file saved by SaveConfig
+const configHeader = `# HATray configuration
+# Run 'HATray config validate' after editing to check for problems.
+`
+
+// configComments describes configuration keys, by path without array indices.
+// SaveConfig writes each comment above the first occurrence of its key.
+var configComments = map[string]string{
+	"version":                         "Configuration format version, upgraded automatically when HATray is updated",
+	"server":                          "Home Assistant servers, each with its own connection",
+	"server.name":                     "Name of the server, entities must name their server when more than one is configured",
+	"server.url":                      "Address of the server, e.g. https://homeassistant.local:8123",
+	"server.api_key":                  "Long-lived access token, created from your Home Assistant profile (run 'HATray config encrypt-key' to encrypt it)",
+	"server.api_key_encrypted":        "Access token encrypted by 'HATray config encrypt-key'",
+	"server.api_key_file":             "File containing only the access token",
+	"server.api_key_command":          "Command printing the access token, e.g. a password manager",
+	"server.proxy":                    "Proxy to connect through (http, https or socks5), defaults to the HTTPS_PROXY environment variable, or \"direct\"",
+	"server.tls":                      "TLS options, for servers using a self-signed or private CA certificate",
+	"server.tls.ca_file":              "PEM bundle of CA certificates to trust, in addition to the system's",
+	"server.tls.fingerprint":          "SHA-256 fingerprint of the server's certificate, trusted instead of any CA",
+	"server.tls.client_cert":          "PEM client certificate, for servers requiring mutual TLS",
+	"server.tls.client_key":           "PEM private key of the client certificate",
+	"server.tls.insecure":             "Skip certificate verification entirely, the connection can be intercepted",
+	"server.tunnel":                   "SSH server to connect through, e.g. a bastion host, which resolves the server's URL",
+	"server.tunnel.host":              "Address of the SSH server, with an optional port, e.g. bastion.example.com:2222",
+	"server.tunnel.user":              "User to authenticate as, defaults to the current user",
+	"server.tunnel.identity_file":     "Unencrypted private key, tried before the keys in the SSH agent",
+	"server.tunnel.known_hosts":       "Known hosts file verifying the SSH server's host key, defaults to ~/.ssh/known_hosts",
+	"entity":                          "Entities shown by the tray icon",
+	"entity.id":                       "Entity ID, e.g. binary_sensor.front_door",
+	"entity.server":                   "Name of the server providing the entity",
+	"entity.label":                    "Name shown in the tray, defaults to the entity ID",
+	"entity.icons":                    "Icon for each state (open, closed, unknown, warning or critical), other states show open when 'on' and closed otherwise",
+	"entity.rule":                     "Rules mapping states to an icon and tooltip, the first matching rule is used, before icons",
+	"entity.rule.state":               "Match this exact state",
+	"entity.rule.regex":               "Match states matching this regular expression",
+	"entity.rule.above":               "Match numeric states greater than this",
+	"entity.rule.below":               "Match numeric states less than this",
+	"entity.rule.attribute":           "Match the value of this attribute instead of the state",
+	"entity.rule.icon":                "Icon shown when the rule matches (open, closed, unknown, warning or critical)",
+	"entity.rule.tooltip":             "Tooltip shown in place of the state when the rule matches",
+	"entity.threshold":                "Warning and critical levels of a numeric entity, e.g. a temperature or CO2 sensor",
+	"entity.threshold.unit":           "Unit of the levels, e.g. °C, states in another unit are converted",
+	"entity.threshold.warn_above":     "Show the warning icon when the value is greater than this",
+	"entity.threshold.warn_below":     "Show the warning icon when the value is less than this",
+	"entity.threshold.critical_above": "Show the critical icon when the value is greater than this",
+	"entity.threshold.critical_below": "Show the critical icon when the value is less than this",
+	"entity.threshold.hysteresis":     "How far a value must return past a level before it clears, so that the icon does not flap",
+	"aggregate":                       "Groups of entities shown as a single status, e.g. any door open",
+	"aggregate.name":                  "Name shown in the tray",
+	"aggregate.server":                "Name of the server providing the entities",
+	"aggregate.entities":              "Entity IDs or patterns, e.g. binary_sensor.*_door",
+	"aggregate.domain":                "Include every entity of this domain, e.g. binary_sensor",
+	"aggregate.mode":                  "When the aggregate is triggered: any (default), all, or count (at least threshold) entities active",
+	"aggregate.threshold":             "Active entities triggering count mode, defaults to 1",
+	"aggregate.states":                "States counted as active, defaults to [\"on\"]",
+	"aggregate.icon":                  "Icon shown while triggered, defaults to open",
+	"aggregate.idle_icon":             "Icon shown while not triggered, defaults to closed",
+	"icons":                           "ICO or PNG files replacing the built-in icons (open, closed, unknown, warning or critical), reloaded when they change",
+	"tray":                            "Templates for the tray's text, using Go text/template syntax, e.g. {{ (.Entity \"sensor.outside\").Value }}",
+	"tray.title":                      "Title shown next to the icon, on platforms that support it",
+	"tray.tooltip":                    "Tooltip shown below the status line, in place of the state of each entity",
+	"tray.icon_text":                  "Up to 3 characters drawn over a rendered icon, e.g. {{ round 0 (.Entity \"sensor.outside\").State }}",
+	"tray.icon_badge":                 "Color of a badge drawn over a rendered icon, a name (e.g. red) or hex color, empty for none",
+	"tray.icon_glyph":                 "Shape of a rendered icon: circle (default), square or ring",
+	"tray.icon_colors":                "Fill colors of a rendered icon by icon (open, closed, unknown, warning or critical), defaults to the built-in colors",
+}
+
+// annotateTOML adds the configuration header, and a comment above the first occurrence of each key in configComments
+func annotateTOML(src string) string {
+	comments := make(map[int]string)
+	commented := make(map[string]bool)
+	for _, found := range scanTOML(src) {
+		plain := stripIndices(found.Path)
+		if comment, ok := configComments[plain]; ok && !commented[plain] {
+			comments[found.Line] = comment
+			commented[plain] = true
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(configHeader)
+	b.WriteString("\n")
+	for i, line := range strings.Split(src, "\n") {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		if comment, ok := comments[i+1]; ok {
+			indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+			b.WriteString(indent + "# " + comment + "\n")
+		}
+		b.WriteString(line)
+	}
+
+	return b.String()
+}
@@ -1,242 +1,323 @@
 package app
 
 import (
+	"errors"
 	"fmt"
 	"ha-tray/internal"
 	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
-
-	ga "github.com/Xevion/go-ha"
 )
 
 // App represents the main application layer that is generic and cross-platform
+// Every change in state goes through a single transition function, see lifecycle.go for the permitted transitions.
 type App struct {
 	logger      *slog.Logger
 	mu          sync.RWMutex
 	state       AppState
+	configPath  string   // explicit configuration path (i.e. --config flag), empty to auto-discover
+	configFlags []string // configuration overrides (i.e. --set flags), as key=value pairs
+	configFile  string   // resolved configuration path of the active configuration
 	config      *Config
-	lastStarted *time.Time // time of last start, nil if never started
-	tray        *Tray      // simple interface to systray
-	ha          *ga.App
+	watcher     *fileWatcher         // reloads the configuration when it changes on disk, nil while paused
+	iconWatcher *fileWatcher         // reloads icon files when they change on disk, nil if none are configured or while paused
+	lastStarted *time.Time           // time of last start, nil if never started
+	tray        *Tray                // simple interface to systray
+	instances   map[string]*instance // connections by server name, see instance.go
+
+	entitiesMu sync.Mutex
+	entities   map[string]*trackedEntity    // watched entities by ID, guarded by entitiesMu
+	aggregates map[string]*trackedAggregate // aggregates by key, guarded by entitiesMu
+	templates  *trayTemplates               // tray title, tooltip and icon templates, nil if not configured, guarded by entitiesMu
+	renderer   *iconRenderer                // renders the tray icon when configured, see TrayConfig
+
+	refreshStop chan struct{} // stops rendering the tray templates periodically, nil while paused, see startRefresh
+
+	subscribersMu  sync.Mutex
+	subscribers    map[int]chan Transition
+	nextSubscriber int
 }
 
-// AppState represents the current state of the application
-type AppState int
-
-const (
-	StatePaused AppState = iota
-	StateRunning
-)
+// StateError is returned when a lifecycle operation cannot be performed in the current state
+type StateError struct {
+	Action string
+	State  AppState
+}
 
-// String returns the string representation of the AppState
-func (s AppState) String() string {
-	switch s {
-	case StatePaused:
-		return "paused"
-	case StateRunning:
-		return "running"
-	default:
-		return "unknown"
-	}
+func (e *StateError) Error() string {
+	return fmt.Sprintf("cannot %s application while %s", e.Action, e.State)
 }
 
 // NewApp creates a new application instance
-func NewApp(logger *slog.Logger) *App {
-	return &App{
+// configPath may be empty, in which case the configuration file is discovered via ResolveConfigPath.
+// configFlags override configuration values on every load, see LoadConfig.
+func NewApp(logger *slog.Logger, configPath string, configFlags []string) *App {
+	app := &App{
 		logger:      logger.With("type", "app"),
-		state:       StatePaused,
+		state:       StateStopped,
+		configPath:  configPath,
+		configFlags: configFlags,
 		config:      nil,
 		lastStarted: nil,
 		tray:        NewTray(logger.With("type", "tray")),
-		ha:          nil,
+		instances:   make(map[string]*instance),
+		entities:    make(map[string]*trackedEntity),
+		aggregates:  make(map[string]*trackedAggregate),
+		renderer:    newIconRenderer(),
+		subscribers: make(map[int]chan Transition),
 	}
+
+	transitions, _ := app.Subscribe()
+	go app.observeLifecycle(transitions)
+
+	return app
 }
 
 // Pause disconnects from the server and ceases any background tasks
-func (app *App) Pause() error {
-	app.mu.Lock()
-	defer app.mu.Unlock()
+func (a *App) Pause() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 
-	switch app.state {
-	case StatePaused:
-		app.logger.Warn("application is already paused")
+	switch a.state {
+	case StatePaused, StateStopped:
+		a.logger.Warn("application is already paused", "state", a.state)
 		return nil
-	case StateRunning:
-		// valid state to pause from, do nothing
-	default:
-		return fmt.Errorf("unexpected state encountered while pausing application: %s", app.state)
 	}
 
-	app.logger.Info("pausing application",
-		"action", "pause",
-		"previous_state", app.state,
-		"new_state", StatePaused)
-
-	// - Disconnect from Home Assistant WebSocket
-	err := app.ha.Close()
-	if err != nil {
-		app.logger.Error("failed to close home assistant connection", "error", err)
+	if err := a.transition(StatePausing, nil); err != nil {
 		return err
 	}
 
-	// - Stop tray icon event loop
-	err = app.tray.Stop()
-	if err != nil {
-		app.logger.Error("failed to stop tray", "error", err)
-		return err
+	// - Disconnect from every Home Assistant WebSocket
+	if err := a.closeInstances(); err != nil {
+		a.logger.Error("failed to close home assistant connection", "error", err)
+		return a.fail(err)
 	}
 
-	app.state = StatePaused
+	// - Stop watching the configuration file
+	if a.watcher != nil {
+		if err := a.watcher.Close(); err != nil {
+			a.logger.Warn("failed to close configuration watcher", "error", err)
+		}
+		a.watcher = nil
+	}
+	if a.iconWatcher != nil {
+		if err := a.iconWatcher.Close(); err != nil {
+			a.logger.Warn("failed to close icon watcher", "error", err)
+		}
+		a.iconWatcher = nil
+	}
 
-	app.logger.Info("paused successfully",
-		"action", "pause",
-		"state", app.state)
+	// - Stop rendering the tray templates
+	a.stopRefresh()
 
-	return nil
+	// - Stop tray icon event loop
+	if a.tray.Active() {
+		if err := a.tray.Stop(); err != nil {
+			a.logger.Error("failed to stop tray", "error", err)
+			return a.fail(err)
+		}
+	}
+
+	return a.transition(StatePaused, nil)
 }
 
 // Resume connects to the server and initiates background tasks
 // This function does not block permanently, it will return very quickly with an error if anything goes wrong.
-func (app *App) Resume() error {
-	app.mu.Lock()
-	defer app.mu.Unlock()
+// If some servers cannot be connected or some entities cannot be watched, the application is left degraded rather than failed.
+func (a *App) Resume() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 
-	switch app.state {
-	case StateRunning:
-		app.logger.Warn("application is already running")
+	if a.state.Active() {
+		a.logger.Warn("application is already running", "state", a.state)
 		return nil
-	case StatePaused:
-		// valid state to resume from, do nothing
-	default:
-		return fmt.Errorf("unexpected state encountered while resuming application: %s", app.state)
 	}
 
-	app.logger.Info("resuming application",
+	a.logger.Info("resuming application",
 		"action", "resume",
-		"previous_state", app.state,
-		"new_state", StateRunning,
-		"has_started", app.lastStarted,
+		"has_started", a.lastStarted,
 	)
 
-	// TODO: Implement actual resume logic
-	// - Connect to Home Assistant WebSocket
-	// - Start background tasks
-	// - Resume sensor monitoring
-	err := app.tray.Start(fmt.Sprintf("HATray v%s", "0.0.1"))
-	if err != nil {
-		app.logger.Error("failed to start tray", "error", err)
-		return err
-	}
-
-	app.config = DefaultConfig()
-
-	if err := app.config.Validate(); err != nil {
-		app.logger.Error("invalid configuration", "error", err)
+	if err := a.transition(StateStarting, nil); err != nil {
 		return err
 	}
 
-	app.ha, err = ga.NewApp(ga.NewAppRequest{
-		URL:         *app.config.Server,
-		HAAuthToken: app.config.APIKey,
-	})
+	// The configuration is loaded first, so that an invalid configuration does not leave a tray behind
+	config, path, err := a.loadConfig()
 	if err != nil {
-		app.logger.Error("failed to create Home Assistant app", "error", err)
-		return err
+		a.logger.Error("failed to load configuration", "error", err)
+		return a.fail(err)
 	}
 
-	app.ha.RegisterEntityListeners(ga.NewEntityListener().EntityIds("binary_sensor.bedroom_door_opening").Call(app.onEntityStateChange).Build())
-
-	go app.ha.Start()
-
-	time.Sleep(2 * time.Second)
-	state, err := app.ha.GetState().Get("binary_sensor.bedroom_door_opening")
-	if err != nil {
-		app.logger.Error("failed to get entity", "error", err)
-		return err
+	if err := a.tray.Start(fmt.Sprintf("HATray v%s", "0.0.1")); err != nil {
+		a.logger.Error("failed to start tray", "error", err)
+		return a.fail(err)
 	}
-
-	app.logger.Info("state", "state", state.State)
-
-	if state.State == "on" {
-		app.tray.SetIcon(IconOpen)
-	} else {
-		app.tray.SetIcon(IconClosed)
+	a.config = config
+	a.configFile = path
+	a.watchConfig()
+	a.loadIcons()
+
+	a.trackEntities(a.config.Entities)
+	a.trackAggregates(a.config.Aggregates)
+	a.trackTemplates(a.config.Tray)
+	if err := a.connect(a.config.ServerNames()); err != nil {
+		a.logger.Error("failed to connect to Home Assistant", "error", err)
+		return err
 	}
+	a.startRefresh()
 
-	app.state = StateRunning
-	app.lastStarted = internal.Ptr(time.Now())
-
-	app.logger.Info("resumed successfully",
-		"action", "resume",
-		"state", app.state)
+	a.lastStarted = internal.Ptr(time.Now())
 
 	return nil
 }
 
-func (a *App) onEntityStateChange(se *ga.Service, st ga.State, e ga.EntityData) {
-	entity, err := st.Get(e.TriggerEntityId)
-	if err != nil {
-		a.logger.Error("failed to get entity", "error", err)
-		return
+// Stop pauses the application if necessary, then stops it for good, closing every subscription
+func (a *App) Stop() error {
+	if err := a.Pause(); err != nil {
+		a.logger.Error("failed to pause while stopping", "error", err)
 	}
-	a.logger.Info("sensor.test state changed", "entity", e.TriggerEntityId, "state", entity.State)
 
-	if entity.State == "on" {
-		a.tray.SetIcon(IconOpen)
-	} else {
-		a.tray.SetIcon(IconClosed)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.state == StateStopped {
+		return nil
 	}
+	return a.transition(StateStopped, nil)
 }
 
-// Reload pauses the application, re-reads configuration files, then resumes
+// Reload re-reads the configuration and applies only what changed
+// Only servers whose address or credentials changed (or that are unhealthy) are reconnected, the others keep their
+// connection. Listeners are only registered for newly added entities, and the tray is refreshed in place.
+// If the new configuration is invalid, the current one is kept.
 func (a *App) Reload() error {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	switch a.state {
-	case StatePaused:
-		return fmt.Errorf("cannot reload application when paused")
-	case StateRunning:
-		// valid state to reload from, do nothing
-	default:
-		return fmt.Errorf("unexpected state encountered while reloading application: %s", a.state)
+	if a.state != StateRunning && a.state != StateDegraded {
+		return &StateError{Action: "reload", State: a.state}
 	}
 
 	a.logger.Info("starting application reload",
 		"action", "reload",
 		"current_state", a.state)
 
-	// Pause if not already paused
-	switch a.state {
-	case StatePaused:
-		// already paused, do nothing
-		a.logger.Info("application is already paused during reload")
-	case StateRunning:
-		if err := a.Pause(); err != nil {
-			a.logger.Error("failed to pause during reload",
-				"action", "reload",
-				"error", err)
-			return err
+	next, path, err := a.loadConfig()
+	if err != nil {
+		a.logger.Error("failed to load configuration, keeping current configuration",
+			"action", "reload",
+			"error", err)
+		return err
+	}
+
+	diff := a.config.Diff(next)
+
+	// Reconnect changed servers that remain, and any server that is unhealthy
+	reconnect := make(map[string]bool)
+	for _, name := range diff.Servers {
+		reconnect[name] = true
+	}
+	for name, inst := range a.instances {
+		if inst.err != nil {
+			reconnect[name] = true
+		}
+	}
+	var names []string
+	for _, name := range next.ServerNames() {
+		if reconnect[name] {
+			names = append(names, name)
 		}
-	default:
-		return fmt.Errorf("unexpected state encountered while pausing for reload: %s", a.state)
 	}
 
-	// TODO: Implement configuration reload logic
-	// - Re-read TOML configuration files
-	// - Validate configuration
-	// - Update internal state with new configuration
+	if diff.Empty() && len(names) == 0 {
+		a.logger.Info("configuration unchanged",
+			"action", "reload")
+		return nil
+	}
 
-	a.logger.Info("configuration reloaded successfully",
-		"action", "reload")
+	a.logger.Info("configuration changed",
+		"action", "reload",
+		"servers", diff.Servers,
+		"reconnect", names,
+		"added", diff.Added,
+		"removed", diff.Removed,
+		"changed", diff.Changed,
+		"aggregates", diff.Aggregates,
+		"tray", diff.Tray,
+		"icons", diff.Icons)
+
+	a.config = next
+	a.configFile = path
+	a.watchConfig()
+	if diff.Icons {
+		a.loadIcons()
+	}
+	a.trackEntities(next.Entities)
+	a.trackAggregates(next.Aggregates)
+	a.trackTemplates(next.Tray)
+
+	// Disconnect from servers that were removed
+	for name, inst := range a.instances {
+		if _, ok := next.Server(name); ok {
+			continue
+		}
+		if err := inst.close(); err != nil {
+			a.logger.Warn("failed to close Home Assistant connection", "server", name, "error", err)
+		}
+		delete(a.instances, name)
+	}
 
-	// Resume the application
-	if err := a.Resume(); err != nil {
-		a.logger.Error("failed to resume during reload",
-			"action", "reload",
-			"error", err)
-		return err
+	// Entities added to servers that keep their connection only need listeners
+	for _, key := range diff.Added {
+		server, id, _ := strings.Cut(key, "/")
+		inst, ok := a.instances[server]
+		if !ok || reconnect[server] {
+			continue
+		}
+
+		a.listen(inst, []string{id})
+		if err := a.seed(inst, inst.ha.GetState(), []string{id}); err != nil {
+			inst.err = err
+		}
+	}
+
+	// Aggregates changed on servers that keep their connection only need their members resolved again
+	resolve := make(map[string]bool)
+	for _, key := range diff.Aggregates {
+		server, _, _ := strings.Cut(key, "/")
+		resolve[server] = true
+	}
+	for server := range resolve {
+		inst, ok := a.instances[server]
+		if !ok || reconnect[server] {
+			continue
+		}
+
+		members, err := a.resolveAggregates(inst, inst.ha.GetState())
+		if err != nil {
+			inst.logger.Error("failed to resolve aggregates", "error", err)
+			inst.err = err
+		}
+		a.listen(inst, members)
+	}
+
+	if len(names) > 0 {
+		if err := a.connect(names); err != nil {
+			a.logger.Error("failed to reconnect during reload",
+				"action", "reload",
+				"error", err)
+			return err
+		}
+	} else {
+		a.refreshTray()
+		if err := a.settle(); err != nil {
+			return err
+		}
 	}
 
 	a.logger.Info("application reload completed successfully",
@@ -246,6 +327,82 @@ func (a *App) Reload() error {
 	return nil
 }
 
+// loadConfig resolves, loads and validates the configuration file, returning it along with its path
+func (a *App) loadConfig() (*Config, string, error) {
+	path, err := ResolveConfigPath(a.configPath)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to resolve configuration path: %w", err)
+	}
+
+	config, err := LoadConfig(path, a.configFlags...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, warning := range config.Warnings() {
+		a.logger.Warn("configuration warning", "path", path, "warning", warning)
+	}
+
+	if err := config.Validate(); err != nil {
+		var problems ValidationErrors
+		if errors.As(err, &problems) {
+			for _, problem := range problems {
+				a.logger.Error("configuration problem", "path", path, "key", problem.Path, "line", problem.Line, "message", problem.Message)
+			}
+		}
+		return nil, "", fmt.Errorf("invalid configuration %s: %w", path, err)
+	}
+
+	a.logger.Info("configuration loaded", "path", path, "drop_ins", config.meta.dropIns)
+
+	// Redacted, so that debug logs can be attached to bug reports as-is
+	values := config.Redacted()
+	attrs := make([]any, 0, len(values))
+	for _, value := range values {
+		attrs = append(attrs, slog.String(value.Path, fmt.Sprintf("%v (%s)", value.Value, value.Source)))
+	}
+	a.logger.Debug("effective configuration", slog.Group("config", attrs...))
+	return config, path, nil
+}
+
+// watchConfig watches the active configuration file and its drop-ins, reloading automatically when it changes.
+// Failing to watch is not fatal, as the configuration can still be reloaded manually. The caller must hold a.mu.
+func (a *App) watchConfig() {
+	if a.watcher == nil {
+		watcher, err := newFileWatcher(a.logger.With("component", "watcher"), a.onConfigChange)
+		if err != nil {
+			a.logger.Warn("failed to watch configuration, automatic reload disabled", "error", err)
+			return
+		}
+		a.watcher = watcher
+	}
+
+	if err := a.watcher.Watch(a.configFile); err != nil {
+		a.logger.Warn("failed to watch configuration, automatic reload disabled", "path", a.configFile, "error", err)
+	}
+
+	// Creating (or removing) the drop-in directory itself also triggers a reload, which then watches the files within it
+	dropIns := filepath.Join(filepath.Dir(a.configFile), dropInDirName)
+	if err := a.watcher.Watch(dropIns); err != nil {
+		a.logger.Warn("failed to watch configuration drop-ins", "path", dropIns, "error", err)
+	}
+	if _, err := os.Stat(dropIns); err == nil {
+		if err := a.watcher.WatchPattern(filepath.Join(dropIns, "*.toml")); err != nil {
+			a.logger.Warn("failed to watch configuration drop-ins", "path", dropIns, "error", err)
+		}
+	}
+}
+
+// onConfigChange reloads the configuration after the file changed on disk
+// An invalid configuration is logged and rejected by Reload, keeping the current configuration running.
+func (a *App) onConfigChange() {
+	a.logger.Info("configuration file changed, reloading")
+
+	if err := a.Reload(); err != nil {
+		a.logger.Warn("automatic reload failed", "error", err)
+	}
+}
+
 // GetState returns the current state of the application
 func (a *App) GetState() AppState {
 	a.mu.RLock()
@@ -0,0 +1,178 @@
+package app
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	ga "github.com/Xevion/go-ha"
+)
+
+// reloadConfig is the configuration TestReload starts from, connected to both servers
+const reloadConfig = `version = 3
+
+[[server]]
+name = "home"
+url = "https://home.example.com"
+api_key = "home-key"
+
+[[server]]
+name = "office"
+url = "https://office.example.com"
+api_key = "office-key"
+
+[[entity]]
+server = "home"
+id = "binary_sensor.door"
+label = "Door"
+
+[[entity]]
+server = "office"
+id = "light.desk"
+label = "Desk"
+`
+
+func TestReload(t *testing.T) {
+	a, driver := newTestApp(t)
+	a.configPath = writeConfig(t, reloadConfig)
+
+	// Reloads are made by the test rather than the configuration watcher
+	watcher, err := newFileWatcher(a.logger, func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.watcher = watcher
+
+	if err := a.Reload(); err == nil {
+		t.Error("expected reloading before running to fail")
+	}
+
+	config, path, err := a.loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.config, a.configFile = config, path
+	a.trackEntities(config.Entities)
+	// Connections are never used by the reloads below, only whether they were replaced
+	for _, name := range config.ServerNames() {
+		a.instances[name] = &instance{name: name, logger: a.logger, ha: &ga.App{}, listening: make(map[string]bool)}
+	}
+	a.state = StateRunning
+	t.Cleanup(func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.watcher.Close()
+		// Ends the reconnection of servers that could not be connected
+		a.instances = make(map[string]*instance)
+		a.state = StateStopped
+	})
+
+	tests := []struct {
+		name      string
+		config    string
+		wantErr   bool
+		reconnect []string // servers whose connection is replaced
+		removed   []string // servers whose connection is closed
+		state     AppState
+		tooltip   string // expected in the tooltip
+	}{
+		{name: "unchanged", config: reloadConfig, state: StateRunning},
+		{
+			name:    "entity label",
+			config:  strings.Replace(reloadConfig, `label = "Door"`, `label = "Front door"`, 1),
+			state:   StateRunning,
+			tooltip: "Front door",
+		},
+		{
+			name:    "tray template",
+			config:  strings.Replace(reloadConfig, `label = "Door"`, `label = "Front door"`, 1) + "\n[tray]\ntooltip = \"{{ len .Entities }} watched\"\n",
+			state:   StateRunning,
+			tooltip: "2 watched",
+		},
+		{
+			name:    "invalid configuration",
+			config:  "version = 3\n[[server]\n",
+			wantErr: true,
+			state:   StateRunning,
+			tooltip: "2 watched",
+		},
+		{
+			// The new key cannot be resolved, so the server is left unhealthy without going through go-ha
+			name:      "server credentials",
+			config:    strings.Replace(reloadConfig, `api_key = "office-key"`, `api_key_file = "/nonexistent/office-key"`, 1),
+			reconnect: []string{"office"},
+			state:     StateDegraded,
+			tooltip:   "Desk: unknown",
+		},
+		{
+			// Unhealthy servers are reconnected on every reload
+			name:      "unchanged while degraded",
+			config:    strings.Replace(reloadConfig, `api_key = "office-key"`, `api_key_file = "/nonexistent/office-key"`, 1),
+			reconnect: []string{"office"},
+			state:     StateDegraded,
+		},
+		{
+			name:    "server removed",
+			config:  reloadConfig[:strings.Index(reloadConfig, "[[server]]\nname = \"office\"")] + reloadConfig[strings.Index(reloadConfig, "[[entity]]"):strings.LastIndex(reloadConfig, "[[entity]]")],
+			removed: []string{"office"},
+			state:   StateRunning,
+			tooltip: "Door",
+		},
+	}
+
+	for _, tt := range tests {
+		if err := os.WriteFile(a.configPath, []byte(tt.config), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		a.mu.RLock()
+		previous := make(map[string]*instance, len(a.instances))
+		for name, inst := range a.instances {
+			previous[name] = inst
+		}
+		a.mu.RUnlock()
+
+		err := a.Reload()
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("%s: unexpected error %v", tt.name, err)
+		}
+
+		a.mu.RLock()
+		for name, inst := range previous {
+			current, ok := a.instances[name]
+			switch {
+			case slices.Contains(tt.removed, name):
+				if ok {
+					t.Errorf("%s: expected %s to be disconnected", tt.name, name)
+				}
+			case slices.Contains(tt.reconnect, name):
+				if current == inst {
+					t.Errorf("%s: expected %s to be reconnected", tt.name, name)
+				}
+			default:
+				if current != inst {
+					t.Errorf("%s: expected %s to keep its connection", tt.name, name)
+				}
+			}
+		}
+		state := a.state
+		a.mu.RUnlock()
+
+		if state != tt.state {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.state, state)
+		}
+		if _, tooltip := driver.shown(); !strings.Contains(tooltip, tt.tooltip) {
+			t.Errorf("%s: expected the tooltip to contain %q, got %q", tt.name, tt.tooltip, tooltip)
+		}
+	}
+
+	var stateErr *StateError
+	a.mu.Lock()
+	a.state = StatePaused
+	a.mu.Unlock()
+	if err := a.Reload(); !errors.As(err, &stateErr) {
+		t.Errorf("expected reloading while paused to fail with a StateError, got %v", err)
+	}
+}
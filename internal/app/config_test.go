@@ -0,0 +1,126 @@
+package app
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestConfigDiff(t *testing.T) {
+	// base returns a fresh configuration, so that each case can modify its own copy
+	base := func() *Config {
+		return &Config{
+			Servers: []ServerConfig{
+				{Name: "home", URL: "https://home.example.com", APIKey: "home-key"},
+				{Name: "office", URL: "https://office.example.com", APIKeyFile: "~/office-key"},
+			},
+			Entities: []EntityConfig{
+				{ID: "binary_sensor.door", Server: "home", Label: "Door"},
+				{ID: "light.desk", Server: "office"},
+			},
+			Aggregates: []AggregateConfig{{Name: "Doors", Server: "home", Domain: "binary_sensor"}},
+			Tray:       TrayConfig{Title: "{{ len .Entities }}"},
+			Icons:      map[IconReference]string{"open": "~/icons/open.ico"},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   ConfigDiff
+	}{
+		{name: "unchanged", change: func(c *Config) {}},
+		{
+			name:   "server address",
+			change: func(c *Config) { c.Servers[0].URL = "https://ha.example.com" },
+			want:   ConfigDiff{Servers: []string{"home"}},
+		},
+		{
+			name:   "server credentials",
+			change: func(c *Config) { c.Servers[1].APIKeyFile = "~/token" },
+			want:   ConfigDiff{Servers: []string{"office"}},
+		},
+		{
+			name:   "server transport",
+			change: func(c *Config) { c.Servers[0].TLS.Fingerprint = "ab:cd" },
+			want:   ConfigDiff{Servers: []string{"home"}},
+		},
+		{
+			name: "server added",
+			change: func(c *Config) {
+				c.Servers = append(c.Servers, ServerConfig{Name: "cabin", URL: "https://cabin.example.com"})
+			},
+			want: ConfigDiff{Servers: []string{"cabin"}},
+		},
+		{
+			name: "server removed",
+			change: func(c *Config) {
+				c.Servers = c.Servers[:1]
+				c.Entities = c.Entities[:1]
+			},
+			want: ConfigDiff{Servers: []string{"office"}, Removed: []string{"office/light.desk"}},
+		},
+		{
+			name:   "servers reordered",
+			change: func(c *Config) { c.Servers[0], c.Servers[1] = c.Servers[1], c.Servers[0] },
+		},
+		{
+			name:   "entity label",
+			change: func(c *Config) { c.Entities[0].Label = "Front door" },
+			want:   ConfigDiff{Changed: []string{"home/binary_sensor.door"}},
+		},
+		{
+			name:   "entity icons",
+			change: func(c *Config) { c.Entities[1].Icons = map[string]IconReference{"on": "open"} },
+			want:   ConfigDiff{Changed: []string{"office/light.desk"}},
+		},
+		{
+			name: "entity added",
+			change: func(c *Config) {
+				c.Entities = append(c.Entities, EntityConfig{ID: "binary_sensor.window", Server: "home"})
+			},
+			want: ConfigDiff{Added: []string{"home/binary_sensor.window"}},
+		},
+		{
+			name:   "entity moved to another server",
+			change: func(c *Config) { c.Entities[1].Server = "home" },
+			want:   ConfigDiff{Added: []string{"home/light.desk"}, Removed: []string{"office/light.desk"}},
+		},
+		{
+			name:   "aggregate changed",
+			change: func(c *Config) { c.Aggregates[0].Mode = AggregateAll },
+			want:   ConfigDiff{Aggregates: []string{"home/Doors"}},
+		},
+		{
+			name:   "aggregate removed",
+			change: func(c *Config) { c.Aggregates = nil },
+			want:   ConfigDiff{Aggregates: []string{"home/Doors"}},
+		},
+		{
+			name:   "tray template",
+			change: func(c *Config) { c.Tray.Title = "HA" },
+			want:   ConfigDiff{Tray: true},
+		},
+		{
+			name:   "icon files",
+			change: func(c *Config) { c.Icons["open"] = "~/icons/door-open.ico" },
+			want:   ConfigDiff{Icons: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := base()
+			tt.change(next)
+
+			diff := base().Diff(next)
+			if !slices.Equal(diff.Servers, tt.want.Servers) || !slices.Equal(diff.Added, tt.want.Added) ||
+				!slices.Equal(diff.Removed, tt.want.Removed) || !slices.Equal(diff.Changed, tt.want.Changed) ||
+				!slices.Equal(diff.Aggregates, tt.want.Aggregates) || diff.Tray != tt.want.Tray || diff.Icons != tt.want.Icons {
+				t.Errorf("expected %+v, got %+v", tt.want, diff)
+			}
+			if diff.Empty() != tt.want.Empty() {
+				t.Errorf("expected Empty() to be %v for %+v", tt.want.Empty(), diff)
+			}
+		})
+	}
+}
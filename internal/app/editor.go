@@ -0,0 +1,605 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// pathPart is a single element of a key path, either a key or an array index
+type pathPart struct {
+	key   string
+	index int // -1 for keys
+}
+
+// splitPath parses an indexed key path, e.g. entity[0].icons."not home"
+func splitPath(path string) ([]pathPart, error) {
+	var parts []pathPart
+	for rest := path; rest != ""; {
+		keys, remainder := parseTOMLKey(rest)
+		if len(keys) == 0 {
+			return nil, fmt.Errorf("invalid key %q", path)
+		}
+		for _, key := range keys {
+			parts = append(parts, pathPart{key: key, index: -1})
+		}
+
+		for strings.HasPrefix(remainder, "[") {
+			end := strings.IndexByte(remainder, ']')
+			if end == -1 {
+				return nil, fmt.Errorf("invalid key %q", path)
+			}
+			index, err := strconv.Atoi(remainder[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid index in key %q", path)
+			}
+			parts = append(parts, pathPart{index: index})
+			remainder = remainder[end+1:]
+		}
+
+		switch {
+		case remainder == "":
+		case strings.HasPrefix(remainder, "."):
+			remainder = remainder[1:]
+		default:
+			return nil, fmt.Errorf("invalid key %q", path)
+		}
+		rest = remainder
+	}
+	return parts, nil
+}
+
+// formatPath formats path parts as an indexed key path
+func formatPath(parts []pathPart) string {
+	path := ""
+	for _, part := range parts {
+		if part.index >= 0 {
+			path += "[" + strconv.Itoa(part.index) + "]"
+		} else {
+			path = joinPath(path, formatKey(part.key))
+		}
+	}
+	return path
+}
+
+// parseConfigValue parses a value for the configuration key at path, according to the type of its field
+// Lists are comma-separated, as with environment variables.
+func parseConfigValue(parts []pathPart, value string) (any, error) {
+	t := reflect.TypeOf(Config{})
+	for _, part := range parts {
+		switch {
+		case part.index >= 0 && t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Struct:
+			t = t.Elem()
+		case part.index < 0 && t.Kind() == reflect.Struct:
+			field, ok := fieldByTOMLKey(t, part.key)
+			if !ok {
+				return nil, fmt.Errorf("unknown key %q", formatPath(parts))
+			}
+			t = field.Type
+		case part.index < 0 && t.Kind() == reflect.Map:
+			t = t.Elem()
+		default:
+			return nil, fmt.Errorf("unknown key %q", formatPath(parts))
+		}
+	}
+
+	// Optional values (e.g. rule[0].above) are written as their plain value
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		return nil, fmt.Errorf("%s is a table, set its keys individually", formatPath(parts))
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Struct {
+			return nil, fmt.Errorf("%s is an array of tables, set the keys of each element individually, e.g. %s[0]", formatPath(parts), formatPath(parts))
+		}
+	}
+
+	v := reflect.New(t).Elem()
+	if err := setScalar(v, value); err != nil {
+		return nil, err
+	}
+	return plainValue(v), nil
+}
+
+// plainValue converts a value to the basic types used when decoding TOML into a map, e.g. IconReference -> string
+func plainValue(v reflect.Value) any {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	case reflect.Slice:
+		list := make([]any, v.Len())
+		for i := range list {
+			list[i] = plainValue(v.Index(i))
+		}
+		return list
+	}
+	return v.Interface()
+}
+
+// formatTOMLValue formats a value as an inline TOML value, e.g. "text", 42, ["a", "b"] or { on = "open" }
+func formatTOMLValue(value any) (string, error) {
+	switch v := value.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		fields := make([]string, 0, len(keys))
+		for _, key := range keys {
+			formatted, err := formatTOMLValue(v[key])
+			if err != nil {
+				return "", err
+			}
+			fields = append(fields, formatKey(key)+" = "+formatted)
+		}
+		if len(fields) == 0 {
+			return "{}", nil
+		}
+		return "{ " + strings.Join(fields, ", ") + " }", nil
+	case []map[string]any:
+		list := make([]any, len(v))
+		for i, table := range v {
+			list[i] = table
+		}
+		return formatTOMLValue(list)
+	case []any:
+		elements := make([]string, 0, len(v))
+		for _, element := range v {
+			formatted, err := formatTOMLValue(element)
+			if err != nil {
+				return "", err
+			}
+			elements = append(elements, formatted)
+		}
+		return "[" + strings.Join(elements, ", ") + "]", nil
+	}
+
+	// Scalars are formatted by the encoder, which handles escaping
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(map[string]any{"v": value}); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(strings.TrimPrefix(buf.String(), "v = ")), nil
+}
+
+// configEditor edits individual keys of a TOML document in place, preserving comments, ordering and layout
+// Like tomlScanner, it expects the document to be valid TOML.
+type configEditor struct {
+	lines []string
+}
+
+func newConfigEditor(src string) *configEditor {
+	return &configEditor{lines: strings.Split(src, "\n")}
+}
+
+func (e *configEditor) String() string {
+	return strings.Join(e.lines, "\n")
+}
+
+// find returns the key or header defined at path, if any
+func (e *configEditor) find(path string) (tomlLine, bool) {
+	for _, found := range scanTOML(e.String()) {
+		if found.Path == path {
+			return found, true
+		}
+	}
+	return tomlLine{}, false
+}
+
+// Set sets the value at path, replacing an existing value in place or adding the key to the table it belongs to
+func (e *configEditor) Set(parts []pathPart, value any) error {
+	path := formatPath(parts)
+	formatted, err := formatTOMLValue(value)
+	if err != nil {
+		return err
+	}
+
+	if found, ok := e.find(path); ok {
+		if found.Header {
+			return fmt.Errorf("%s is a table, set its keys individually", path)
+		}
+		e.replace(found, formatted)
+		return nil
+	}
+
+	for i := len(parts) - 1; i > 0; i-- {
+		found, ok := e.find(formatPath(parts[:i]))
+		if !ok {
+			continue
+		}
+
+		// The value is within an inline table or array, which is rewritten as a whole
+		if !found.Header {
+			return e.rewriteInline(found, parts[i:], value, false)
+		}
+
+		// A new element of an array of tables within the table, e.g. entity[0].rule[0].state
+		relative := parts[i:]
+		if len(relative) == 3 && relative[0].index < 0 && relative[1].index >= 0 && relative[2].index < 0 {
+			return e.createElement(found.Path, parts[:i+2], formatKey(relative[2].key)+" = "+formatted)
+		}
+
+		for _, part := range relative {
+			if part.index >= 0 {
+				return fmt.Errorf("cannot add %s, add the table it belongs to first", path)
+			}
+		}
+		e.insert(found.Path, formatPath(relative)+" = "+formatted)
+		return nil
+	}
+
+	return e.create(parts, formatted)
+}
+
+// Unset removes the key or table at path
+func (e *configEditor) Unset(parts []pathPart) error {
+	path := formatPath(parts)
+
+	if found, ok := e.find(path); ok {
+		if found.Header {
+			e.removeSection(found)
+		} else {
+			e.lines = append(e.lines[:found.Line-1], e.lines[found.End:]...)
+		}
+		return nil
+	}
+
+	for i := len(parts) - 1; i > 0; i-- {
+		found, ok := e.find(formatPath(parts[:i]))
+		if ok && !found.Header {
+			return e.rewriteInline(found, parts[i:], nil, true)
+		}
+		if ok {
+			break
+		}
+	}
+
+	return fmt.Errorf("%s is not set", path)
+}
+
+// replace replaces the value of a key, keeping the key's own formatting and any trailing comment
+func (e *configEditor) replace(found tomlLine, value string) {
+	line := e.lines[found.Line-1]
+	trimmed := strings.TrimLeft(line, " \t")
+	_, rest := parseTOMLKey(trimmed)
+	prefix := line[:len(line)-len(rest)]
+
+	replacement := strings.TrimRight(prefix, " \t") + " = " + value
+	if found.End == found.Line {
+		if comment := (&tomlScanner{}).scanValue(rest[1:]); comment != -1 {
+			replacement += " " + rest[1+comment:]
+		}
+	}
+
+	e.lines = append(e.lines[:found.Line-1], append([]string{replacement}, e.lines[found.End:]...)...)
+}
+
+// rewriteInline sets (or removes) a value within an inline table or array, rewriting the whole inline value
+func (e *configEditor) rewriteInline(found tomlLine, relative []pathPart, value any, remove bool) error {
+	var doc map[string]any
+	if _, err := toml.Decode(e.String(), &doc); err != nil {
+		return fmt.Errorf("failed to decode config: %w", err)
+	}
+
+	parts, err := splitPath(found.Path)
+	if err != nil {
+		return err
+	}
+
+	var current any = doc
+	for _, part := range parts {
+		if current, err = childValue(current, part); err != nil {
+			return err
+		}
+	}
+
+	updated, err := setInline(current, relative, value, remove)
+	if err != nil {
+		return fmt.Errorf("%s: %w", formatPath(append(parts, relative...)), err)
+	}
+
+	formatted, err := formatTOMLValue(updated)
+	if err != nil {
+		return err
+	}
+	e.replace(found, formatted)
+	return nil
+}
+
+// childValue returns the element of a decoded table or array addressed by part
+func childValue(value any, part pathPart) (any, error) {
+	if part.index >= 0 {
+		list, ok := tableArray(value)
+		if !ok || part.index >= len(list) {
+			return nil, errors.New("no such element")
+		}
+		return list[part.index], nil
+	}
+
+	table, ok := value.(map[string]any)
+	if !ok {
+		return nil, errors.New("not a table")
+	}
+	child, ok := table[part.key]
+	if !ok {
+		return nil, errors.New("not set")
+	}
+	return child, nil
+}
+
+// setInline sets (or removes) the value at relative within a decoded value, returning the updated value
+// Arrays of tables may be extended by one element, by setting a key of the element just past the end.
+func setInline(current any, relative []pathPart, value any, remove bool) (any, error) {
+	part := relative[0]
+
+	if part.index >= 0 {
+		list, ok := tableArray(current)
+		if !ok {
+			return nil, errors.New("not an array of tables")
+		}
+		switch {
+		case part.index == len(list) && !remove:
+			list = append(list, map[string]any{})
+		case part.index >= len(list):
+			return nil, errors.New("not set")
+		}
+
+		if len(relative) == 1 {
+			if !remove {
+				return nil, errors.New("set the keys of each element individually")
+			}
+			return append(list[:part.index], list[part.index+1:]...), nil
+		}
+
+		updated, err := setInline(list[part.index], relative[1:], value, remove)
+		if err != nil {
+			return nil, err
+		}
+		list[part.index] = updated.(map[string]any)
+		return list, nil
+	}
+
+	table, ok := current.(map[string]any)
+	if !ok {
+		return nil, errors.New("not a table")
+	}
+
+	if len(relative) == 1 {
+		if remove {
+			if _, ok := table[part.key]; !ok {
+				return nil, errors.New("not set")
+			}
+			delete(table, part.key)
+		} else {
+			table[part.key] = value
+		}
+		return table, nil
+	}
+
+	child, ok := table[part.key]
+	if !ok {
+		if remove {
+			return nil, errors.New("not set")
+		}
+		child = map[string]any{}
+	}
+
+	updated, err := setInline(child, relative[1:], value, remove)
+	if err != nil {
+		return nil, err
+	}
+	table[part.key] = updated
+	return table, nil
+}
+
+// section returns the header line and last line of the table whose header is at path, excluding trailing blank lines and
+// comments (which usually describe the next table). Sub-tables (e.g. [entity.icons]) are part of the section, unless
+// own is set, in which case the section ends before the first sub-table, covering only the table's own keys.
+// The root table (an empty path) has no header, so starts at 0 and spans every line before the first header.
+func (e *configEditor) section(path string, own bool) (int, int) {
+	start, end := 0, len(e.lines)
+	for _, found := range scanTOML(e.String()) {
+		if !found.Header {
+			continue
+		}
+
+		if path != "" {
+			if start == 0 {
+				if found.Path == path {
+					start = found.Line
+				}
+				continue
+			}
+			if _, within := withinPath(found.Path, path); within && !own {
+				continue
+			}
+		}
+
+		end = found.Line - 1
+		break
+	}
+
+	for end > start {
+		trimmed := strings.TrimSpace(e.lines[end-1])
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			break
+		}
+		end--
+	}
+	return start, end
+}
+
+// insert adds a line after the last key of the table whose header is at path, indented like the table's other keys.
+// Keys following a sub-table header (e.g. [[entity.rule]]) would belong to the sub-table, so the line is added before it.
+func (e *configEditor) insert(path, line string) {
+	start, end := e.section(path, true)
+
+	indent := ""
+	if end > start && end > 0 {
+		previous := e.lines[end-1]
+		indent = previous[:len(previous)-len(strings.TrimLeft(previous, " \t"))]
+	}
+
+	e.lines = append(e.lines[:end], append([]string{indent + line}, e.lines[end:]...)...)
+}
+
+// removeSection removes a table, along with any sub-tables
+func (e *configEditor) removeSection(found tomlLine) {
+	start, end := e.section(found.Path, false)
+
+	// Remove the blank line separating the table from the previous one, if any
+	if start > 1 && strings.TrimSpace(e.lines[start-2]) == "" {
+		start--
+	}
+	e.lines = append(e.lines[:start-1], e.lines[end:]...)
+}
+
+// create adds a key whose table is not defined yet, appending a new table (or array element) to the document
+// Only the first level is created, e.g. server[1].url or tunnel.host, but not entity[0].icons.on.
+func (e *configEditor) create(parts []pathPart, value string) error {
+	path := formatPath(parts)
+
+	switch {
+	case len(parts) == 1:
+		e.insert("", formatKey(parts[0].key)+" = "+value)
+	case len(parts) == 2 && parts[1].index < 0:
+		e.append("["+formatKey(parts[0].key)+"]", formatKey(parts[1].key)+" = "+value)
+	case len(parts) == 3 && parts[1].index >= 0 && parts[2].index < 0:
+		array := formatKey(parts[0].key)
+		if err := e.checkNextElement(array, parts[1].index); err != nil {
+			return fmt.Errorf("cannot add %s, %w", path, err)
+		}
+
+		e.append("[["+array+"]]", formatKey(parts[2].key)+" = "+value)
+	default:
+		return fmt.Errorf("cannot add %s, add the table it belongs to first", path)
+	}
+	return nil
+}
+
+// createElement adds an element (the last part of element, e.g. entity[0].rule[1]) to an array of tables within the
+// table whose header is at parent, with line as its first key
+func (e *configEditor) createElement(parent string, element []pathPart, line string) error {
+	array := formatPath(element[:len(element)-1])
+	if err := e.checkNextElement(array, element[len(element)-1].index); err != nil {
+		return fmt.Errorf("cannot add %s, %w", formatPath(element), err)
+	}
+
+	_, end := e.section(parent, false)
+	header := "[[" + stripIndices(array) + "]]"
+	e.lines = append(e.lines[:end], append([]string{"", header, line}, e.lines[end:]...)...)
+	return nil
+}
+
+// checkNextElement returns an error unless index is the next element of the array of tables at path, as arrays cannot
+// have gaps
+func (e *configEditor) checkNextElement(array string, index int) error {
+	count := 0
+	for _, found := range scanTOML(e.String()) {
+		if found.Header && found.Path != array && parentPath(found.Path) == array {
+			count++
+		}
+	}
+	if index != count {
+		return fmt.Errorf("the next element of %s is %s[%d]", array, array, count)
+	}
+	return nil
+}
+
+// append adds a table header and its first key to the end of the document
+func (e *configEditor) append(header, line string) {
+	for len(e.lines) > 0 && strings.TrimSpace(e.lines[len(e.lines)-1]) == "" {
+		e.lines = e.lines[:len(e.lines)-1]
+	}
+	e.lines = append(e.lines, "", header, line, "")
+}
+
+// SetConfigValue sets a single value in a configuration file, preserving its comments and layout
+// path is an indexed key path (e.g. entity[0].label), and value is parsed according to the key's type.
+func SetConfigValue(filename, path, value string) error {
+	parts, err := splitPath(path)
+	if err != nil {
+		return err
+	}
+	if formatPath(parts) == "version" {
+		return errors.New("version is managed by HATray")
+	}
+
+	parsed, err := parseConfigValue(parts, value)
+	if err != nil {
+		return err
+	}
+
+	return editConfigFile(filename, func(editor *configEditor) error {
+		return editor.Set(parts, parsed)
+	})
+}
+
+// UnsetConfigValue removes a single key, or a whole table (e.g. entity[1]), from a configuration file, preserving its
+// comments and layout
+func UnsetConfigValue(filename, path string) error {
+	parts, err := splitPath(path)
+	if err != nil {
+		return err
+	}
+	if formatPath(parts) == "version" {
+		return errors.New("version is managed by HATray")
+	}
+
+	return editConfigFile(filename, func(editor *configEditor) error {
+		return editor.Unset(parts)
+	})
+}
+
+// editConfigFile applies an edit to a configuration file, writing the result atomically with the same permissions
+// The file is migrated first, so that edits always apply to the current format.
+func editConfigFile(filename string, edit func(editor *configEditor) error) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	data, _, err = migrateConfigFile(filename, data, true)
+	if err != nil {
+		return err
+	}
+
+	editor := newConfigEditor(string(data))
+	if err := edit(editor); err != nil {
+		return err
+	}
+
+	// The edited document must still decode, otherwise the edit is a bug rather than a configuration problem
+	edited := editor.String()
+	if _, err := toml.Decode(edited, &Config{}); err != nil {
+		return fmt.Errorf("edit produced an invalid config file: %w", err)
+	}
+
+	if err := writeFileAtomic(filename, []byte(edited), info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	return nil
+}
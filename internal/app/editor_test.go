@@ -0,0 +1,150 @@
+package app
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// ruleConfig has an entity with a nested [[entity.rule]] table, followed by another entity
+const ruleConfig = `version = 3
+
+[[server]]
+url = "https://homeassistant.local:8123"
+api_key = "token"
+
+# Living room
+[[entity]]
+id = "sensor.temperature"
+
+# Too hot
+[[entity.rule]]
+above = 25
+icon = "open"
+
+[[entity]]
+id = "binary_sensor.front_door"
+`
+
+func TestEditorRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		path  string
+		value string
+		check func(t *testing.T, config *Config)
+	}{
+		{"key of element with sub-table", "entity[0].label", "Temp", func(t *testing.T, config *Config) {
+			if config.Entities[0].Label != "Temp" {
+				t.Errorf("expected the label to be set on the entity, got %q", config.Entities[0].Label)
+			}
+		}},
+		{"dotted key of element with sub-table", "entity[0].threshold.warn_above", "25.5", func(t *testing.T, config *Config) {
+			if warn := config.Entities[0].Threshold.WarnAbove; warn == nil || *warn != 25.5 {
+				t.Errorf("expected the threshold to be set on the entity, got %v", warn)
+			}
+		}},
+		{"key of sub-table", "entity[0].rule[0].tooltip", "Too hot", func(t *testing.T, config *Config) {
+			if rule := config.Entities[0].Rules[0]; rule.Tooltip != "Too hot" || rule.Icon != IconOpen {
+				t.Errorf("expected the tooltip to be set on the rule, got %+v", rule)
+			}
+		}},
+		{"new sub-table element", "entity[0].rule[1].icon", "closed", func(t *testing.T, config *Config) {
+			if rules := config.Entities[0].Rules; len(rules) != 2 || rules[1].Icon != IconClosed {
+				t.Errorf("expected a second rule, got %+v", rules)
+			}
+		}},
+		{"key of last element", "entity[1].label", "Front Door", func(t *testing.T, config *Config) {
+			if config.Entities[1].Label != "Front Door" || config.Entities[0].Label != "" {
+				t.Errorf("expected the label to be set on the second entity only, got %+v", config.Entities)
+			}
+		}},
+		{"new element", "entity[2].id", "light.desk", func(t *testing.T, config *Config) {
+			if len(config.Entities) != 3 || config.Entities[2].ID != "light.desk" {
+				t.Errorf("expected a third entity, got %+v", config.Entities)
+			}
+		}},
+		{"existing key", "server[0].url", "https://ha.example.com", func(t *testing.T, config *Config) {
+			if config.Servers[0].URL != "https://ha.example.com" {
+				t.Errorf("expected the url to be replaced, got %q", config.Servers[0].URL)
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfig(t, ruleConfig)
+			if err := SetConfigValue(path, tt.path, tt.value); err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := LoadConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := config.Validate(); err != nil {
+				data, _ := os.ReadFile(path)
+				t.Fatalf("edited config is invalid: %v\n%s", err, data)
+			}
+			tt.check(t, config)
+
+			// Everything else, including comments, is kept
+			data, _ := os.ReadFile(path)
+			for _, comment := range []string{"# Living room", "# Too hot"} {
+				if !strings.Contains(string(data), comment) {
+					t.Errorf("expected comment %q to be kept:\n%s", comment, data)
+				}
+			}
+			if len(config.Entities[0].Rules) == 0 || config.Entities[0].Rules[0].Above == nil {
+				t.Errorf("expected the existing rule to be kept, got %+v", config.Entities[0].Rules)
+			}
+		})
+	}
+}
+
+func TestEditorInsertsBeforeSubTables(t *testing.T) {
+	editor := newConfigEditor(ruleConfig)
+	if err := editor.Set(keyPath("entity", 0, "label"), "Temp"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := strings.Replace(ruleConfig, "id = \"sensor.temperature\"\n", "id = \"sensor.temperature\"\nlabel = \"Temp\"\n", 1)
+	if got := editor.String(); got != want {
+		t.Errorf("unexpected edit:\n%s", got)
+	}
+}
+
+func TestEditorUnset(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want func(config *Config) bool
+	}{
+		{"sub-table element", "entity[0].rule[0]", func(config *Config) bool {
+			return len(config.Entities) == 2 && len(config.Entities[0].Rules) == 0
+		}},
+		{"element with sub-tables", "entity[0]", func(config *Config) bool {
+			return len(config.Entities) == 1 && config.Entities[0].ID == "binary_sensor.front_door" && len(config.Entities[0].Rules) == 0
+		}},
+		{"key", "entity[0].rule[0].above", func(config *Config) bool {
+			return config.Entities[0].Rules[0].Above == nil && config.Entities[0].Rules[0].Icon == IconOpen
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfig(t, ruleConfig)
+			if err := UnsetConfigValue(path, tt.path); err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := LoadConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.want(config) {
+				data, _ := os.ReadFile(path)
+				t.Errorf("unexpected config after unsetting %s:\n%s", tt.path, data)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package app
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	// encryptedPrefix marks the format of encrypted values, allowing the scheme to change in the future
+	encryptedPrefix = "v1:"
+	// encryptionKeySize is the size of the AES-256 key stored in the key file
+	encryptionKeySize = 32
+)
+
+// encryptionAAD binds ciphertexts to their purpose, so they cannot be swapped with other values encrypted by the same key
+var encryptionAAD = []byte("HATray api_key")
+
+// EncryptionKeyPath returns the path of the per-user encryption key, $XDG_DATA_HOME/HATray/key
+// This falls back to ~/.local/share/HATray/key, or %LocalAppData%\HATray\key on Windows.
+func EncryptionKeyPath() (string, error) {
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, "HATray", "key"), nil
+	}
+	if dir := os.Getenv("LocalAppData"); runtime.GOOS == "windows" && dir != "" {
+		return filepath.Join(dir, "HATray", "key"), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine data directory: %w", err)
+	}
+	return filepath.Join(home, ".local", "share", "HATray", "key"), nil
+}
+
+// loadEncryptionKey reads the per-user encryption key, generating it first if create is true and it does not exist
+func loadEncryptionKey(create bool) ([]byte, error) {
+	path, err := EncryptionKeyPath()
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) && create {
+		key, genErr := generateEncryptionKey(path)
+		if !errors.Is(genErr, fs.ErrExist) {
+			return key, genErr
+		}
+		// Generated by another process in the meantime, whose key is used instead
+		info, err = os.Stat(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption key: %w", err)
+	}
+
+	// Windows does not use Unix permission bits, access is controlled by the user profile's ACLs instead
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("encryption key %s must only be accessible by its owner (chmod 600), has %s", path, info.Mode().Perm())
+	}
+
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption key: %w", err)
+	}
+	if len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("encryption key %s is corrupt: expected %d bytes, got %d", path, encryptionKeySize, len(key))
+	}
+
+	return key, nil
+}
+
+// generateEncryptionKey creates a new random key at path with 0600 permissions, failing with fs.ErrExist if it already
+// exists. The key is written to a temporary file which is then linked into place, so that another process never reads
+// a partially written key, and a key generated concurrently is never replaced.
+func generateEncryptionKey(path string) ([]byte, error) {
+	key := make([]byte, encryptionKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fmt.Errorf("failed to generate encryption key: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	// Created with 0600 permissions
+	file, err := os.CreateTemp(filepath.Dir(path), ".key-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create encryption key: %w", err)
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(key)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write encryption key: %w", err)
+	}
+
+	if err := os.Link(file.Name(), path); err != nil {
+		return nil, fmt.Errorf("failed to create encryption key: %w", err)
+	}
+	return key, nil
+}
+
+// newAEAD creates the AES-256-GCM cipher used for encrypted values
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptSecret encrypts a secret with the per-user encryption key, generating the key if necessary
+func EncryptSecret(plaintext string) (string, error) {
+	key, err := loadEncryptionKey(true)
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), encryptionAAD)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptSecret decrypts a value produced by EncryptSecret
+func DecryptSecret(ciphertext string) (string, error) {
+	encoded, ok := strings.CutPrefix(strings.TrimSpace(ciphertext), encryptedPrefix)
+	if !ok {
+		return "", fmt.Errorf("unsupported encrypted value format, expected %q prefix", encryptedPrefix)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode encrypted value: %w", err)
+	}
+
+	key, err := loadEncryptionKey(false)
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("encrypted value is truncated")
+	}
+
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, encryptionAAD)
+	if err != nil {
+		return "", errors.New("failed to decrypt value, it may have been encrypted with a different key")
+	}
+
+	return string(plaintext), nil
+}
+
+// EncryptConfigAPIKey replaces the plaintext api_key of every server in a configuration file with api_key_encrypted, in
+// place, preserving the file's comments and layout. Only the file's own values are used, environment variables are not
+// applied.
+func EncryptConfigAPIKey(filename string) error {
+	return editConfigFile(filename, func(editor *configEditor) error {
+		config := DefaultConfig()
+		if _, err := toml.Decode(editor.String(), config); err != nil {
+			return fmt.Errorf("failed to decode config file: %w", err)
+		}
+
+		encrypted := 0
+		for i, server := range config.Servers {
+			if server.APIKey == "" {
+				continue
+			}
+
+			value, err := EncryptSecret(server.APIKey)
+			if err != nil {
+				return err
+			}
+
+			element := []pathPart{{key: "server", index: -1}, {index: i}}
+			if err := editor.Set(append(element, pathPart{key: "api_key_encrypted", index: -1}), value); err != nil {
+				return err
+			}
+			if err := editor.Unset(append(element, pathPart{key: "api_key", index: -1})); err != nil {
+				return err
+			}
+			encrypted++
+		}
+
+		if encrypted == 0 {
+			for _, server := range config.Servers {
+				if server.APIKeyEncrypted != "" {
+					return errors.New("API key is already encrypted")
+				}
+			}
+			return errors.New("no plaintext api_key to encrypt")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,247 @@
+package app
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// useEncryptionKeyDir stores the encryption key in a temporary directory for the duration of a test, returning the
+// key's path
+func useEncryptionKeyDir(t *testing.T) string {
+	t.Helper()
+
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	path, err := EncryptionKeyPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEncryptSecretRoundTrip(t *testing.T) {
+	path := useEncryptionKeyDir(t)
+
+	first, err := EncryptSecret("secret-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := EncryptSecret("secret-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(first, encryptedPrefix) {
+		t.Errorf("expected the %q prefix, got %q", encryptedPrefix, first)
+	}
+	if first == second {
+		t.Error("expected a random nonce, so that the same secret encrypts differently each time")
+	}
+
+	for _, ciphertext := range []string{first, second, " " + first + "\n"} {
+		plaintext, err := DecryptSecret(ciphertext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plaintext != "secret-key" {
+			t.Errorf("expected the secret back, got %q", plaintext)
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("expected the key to be created with 0600 permissions, got %s", info.Mode().Perm())
+	}
+}
+
+func TestDecryptSecretErrors(t *testing.T) {
+	useEncryptionKeyDir(t)
+
+	ciphertext, err := EncryptSecret("secret-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(ciphertext, encryptedPrefix))
+
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 1
+
+	// Sealed with the same key, but for another purpose
+	key, err := loadEncryptionKey(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, _ := newAEAD(key)
+	nonce := make([]byte, aead.NonceSize())
+	otherPurpose := aead.Seal(nonce, nonce, []byte("secret-key"), []byte("HATray other"))
+
+	tests := []struct {
+		name       string
+		ciphertext string
+		wantErr    string
+	}{
+		{"missing prefix", base64.StdEncoding.EncodeToString(sealed), `expected "v1:" prefix`},
+		{"other version", "v2:" + base64.StdEncoding.EncodeToString(sealed), `expected "v1:" prefix`},
+		{"invalid base64", encryptedPrefix + "not base64!", "failed to decode encrypted value"},
+		{"truncated", encryptedPrefix + base64.StdEncoding.EncodeToString(sealed[:4]), "truncated"},
+		{"tampered", encryptedPrefix + base64.StdEncoding.EncodeToString(tampered), "failed to decrypt value"},
+		{"other purpose", encryptedPrefix + base64.StdEncoding.EncodeToString(otherPurpose), "failed to decrypt value"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecryptSecret(tt.ciphertext); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestDecryptSecretWrongKey(t *testing.T) {
+	path := useEncryptionKeyDir(t)
+
+	ciphertext, err := EncryptSecret("secret-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := make([]byte, encryptionKeySize)
+	rand.Read(other)
+	if err := os.WriteFile(path, other, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecryptSecret(ciphertext); err == nil || !strings.Contains(err.Error(), "encrypted with a different key") {
+		t.Errorf("expected decryption with another key to fail, got %v", err)
+	}
+}
+
+func TestLoadEncryptionKey(t *testing.T) {
+	t.Run("missing", func(t *testing.T) {
+		useEncryptionKeyDir(t)
+		if _, err := DecryptSecret(encryptedPrefix + base64.StdEncoding.EncodeToString(make([]byte, 32))); err == nil {
+			t.Error("expected decryption to fail without generating a key")
+		}
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		path := useEncryptionKeyDir(t)
+		os.MkdirAll(filepath.Dir(path), 0700)
+		if err := os.WriteFile(path, []byte("short"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadEncryptionKey(true); err == nil || !strings.Contains(err.Error(), "is corrupt") {
+			t.Errorf("expected a corrupt key to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("accessible by others", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("permission bits are not used on Windows")
+		}
+		path := useEncryptionKeyDir(t)
+		if _, err := EncryptSecret("secret-key"); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadEncryptionKey(false); err == nil || !strings.Contains(err.Error(), "chmod 600") {
+			t.Errorf("expected a key readable by others to be rejected, got %v", err)
+		}
+	})
+
+	// Processes started together (e.g. several encrypt commands) must agree on a single key
+	t.Run("generated concurrently", func(t *testing.T) {
+		useEncryptionKeyDir(t)
+
+		keys := make([][]byte, 8)
+		errs := make([]error, len(keys))
+		var wg sync.WaitGroup
+		for i := range keys {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				keys[i], errs[i] = loadEncryptionKey(true)
+			}()
+		}
+		wg.Wait()
+
+		for i := range keys {
+			if errs[i] != nil {
+				t.Fatal(errs[i])
+			}
+			if !bytes.Equal(keys[i], keys[0]) {
+				t.Error("expected every caller to load the same key")
+			}
+		}
+	})
+}
+
+func TestEncryptConfigAPIKey(t *testing.T) {
+	useEncryptionKeyDir(t)
+
+	filename := filepath.Join(t.TempDir(), "config.toml")
+	original := `version = 3
+
+# Home Assistant at home
+[[server]]
+name = "home"
+url = "https://home.example.com"
+api_key = "home-key" # from the profile page
+
+[[server]]
+name = "office"
+url = "https://office.example.com"
+api_key_file = "~/office-key"
+
+[[server]]
+name = "cabin"
+url = "https://cabin.example.com"
+api_key = "cabin-key"
+`
+	if err := os.WriteFile(filename, []byte(original), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := EncryptConfigAPIKey(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []struct{ name, key string }{{"home", "home-key"}, {"cabin", "cabin-key"}} {
+		server, _ := config.Server(want.name)
+		if server.APIKey != "" {
+			t.Errorf("%s: expected the plaintext api_key to be removed", want.name)
+		}
+		key, err := server.ResolveAPIKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != want.key {
+			t.Errorf("%s: expected the encrypted API key to decrypt to %q, got %q", want.name, want.key, key)
+		}
+	}
+	if office, _ := config.Server("office"); office.APIKeyEncrypted != "" || office.APIKeyFile != "~/office-key" {
+		t.Errorf("expected servers without a plaintext api_key to be left unchanged, got %+v", office)
+	}
+
+	data, _ := os.ReadFile(filename)
+	if !strings.Contains(string(data), "# Home Assistant at home") {
+		t.Errorf("expected comments to be preserved, got:\n%s", data)
+	}
+
+	if err := EncryptConfigAPIKey(filename); err == nil || !strings.Contains(err.Error(), "already encrypted") {
+		t.Errorf("expected encrypting twice to fail, got %v", err)
+	}
+}
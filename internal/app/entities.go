@@ -0,0 +1,308 @@
+package app
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	ga "github.com/Xevion/go-ha"
+)
+
+// trackedEntity pairs a configured entity with its compiled rules and last known state
+type trackedEntity struct {
+	config   EntityConfig
+	order    int               // position in the configuration, entities are listed in the tooltip in this order
+	rules    []rule            // see compileRules
+	snapshot *entitySnapshot   // nil until the first state is received
+	reading  *thresholdReading // nil until the first state is received, or if the entity has no thresholds
+}
+
+// display returns the icon and tooltip for the entity's last known state
+func (e *trackedEntity) display() (IconReference, string) {
+	return e.config.evaluate(e.rules, e.snapshot, e.reading)
+}
+
+// setSnapshot records the entity's latest state, reading it against the entity's thresholds. The level previously
+// reached is carried over from the previous reading, see ThresholdConfig.level.
+func (e *trackedEntity) setSnapshot(snapshot *entitySnapshot, previous *thresholdReading) {
+	e.snapshot = snapshot
+	if snapshot == nil || !e.config.Threshold.configured() {
+		e.reading = nil
+		return
+	}
+
+	level := levelNormal
+	if previous != nil {
+		level = previous.level
+	}
+	e.reading = e.config.Threshold.read(*snapshot, level)
+}
+
+// trackEntities replaces the set of watched entities, keeping the last known state of entities that remain
+func (a *App) trackEntities(entities []EntityConfig) {
+	a.entitiesMu.Lock()
+	defer a.entitiesMu.Unlock()
+
+	tracked := make(map[string]*trackedEntity, len(entities))
+	for i, entity := range entities {
+		// The configuration is validated before it is used, so this only guards against rules being skipped silently
+		rules, err := compileRules(entity.Rules)
+		if err != nil {
+			a.logger.Error("invalid entity rules, using the defaults", "entity", entity.key(), "error", err)
+		}
+
+		tracked[entity.key()] = &trackedEntity{config: entity, order: i, rules: rules}
+		if previous, ok := a.entities[entity.key()]; ok {
+			tracked[entity.key()].setSnapshot(previous.snapshot, previous.reading)
+		}
+	}
+	a.entities = tracked
+}
+
+// listen registers state listeners on an instance's connection for entities that do not have one yet
+// Listeners cannot be removed from a connection, so events for entities no longer tracked are ignored instead.
+func (a *App) listen(inst *instance, ids []string) {
+	onChange := func(se *ga.Service, st ga.State, e ga.EntityData) {
+		a.onEntityStateChange(inst, st, e)
+	}
+
+	for _, id := range ids {
+		if inst.listening[id] {
+			continue
+		}
+		inst.ha.RegisterEntityListeners(ga.NewEntityListener().EntityIds(id).Call(onChange).Build())
+		inst.listening[id] = true
+	}
+}
+
+// seed fetches the current state of each of an instance's entities
+// Every entity is attempted, and the errors of those that failed are joined together.
+func (a *App) seed(inst *instance, st ga.State, ids []string) error {
+	var errs []error
+	for _, id := range ids {
+		state, err := st.Get(id)
+		if err != nil {
+			inst.logger.Error("failed to get entity", "entity", id, "error", err)
+			errs = append(errs, fmt.Errorf("failed to get entity %s: %w", id, err))
+			continue
+		}
+
+		inst.logger.Info("state", "entity", id, "state", state.State)
+		a.setEntityState(inst.name, id, state)
+	}
+
+	return errors.Join(errs...)
+}
+
+func (a *App) onEntityStateChange(inst *instance, st ga.State, e ga.EntityData) {
+	entity, err := st.Get(e.TriggerEntityId)
+	if err != nil {
+		inst.logger.Error("failed to get entity", "error", err)
+		return
+	}
+	inst.logger.Info("entity state changed", "entity", e.TriggerEntityId, "state", entity.State)
+
+	a.setEntityState(inst.name, e.TriggerEntityId, entity)
+	a.refreshTray()
+}
+
+// setEntityState records the latest state of an entity watched on the named server, directly or as an aggregate member
+func (a *App) setEntityState(server, id string, state ga.EntityState) {
+	a.entitiesMu.Lock()
+	defer a.entitiesMu.Unlock()
+
+	snapshot := &entitySnapshot{
+		State:       state.State,
+		Attributes:  state.Attributes,
+		LastChanged: state.LastChanged,
+	}
+
+	watched := false
+	if entity, ok := a.entities[EntityConfig{Server: server, ID: id}.key()]; ok {
+		entity.setSnapshot(snapshot, entity.reading)
+		if entity.reading != nil && entity.reading.err != nil {
+			a.logger.Debug("entity state cannot be compared against its thresholds", "server", server, "entity", id, "state", state.State, "error", entity.reading.err)
+		}
+		watched = true
+	}
+	for _, aggregate := range a.aggregates {
+		if _, ok := aggregate.members[id]; ok && aggregate.config.Server == server {
+			aggregate.members[id] = snapshot
+			watched = true
+		}
+	}
+
+	if !watched {
+		a.logger.Debug("state received for unwatched entity", "server", server, "entity", id)
+	}
+}
+
+// refreshTray sets the tray icon and tooltip from the last known state of every watched entity and aggregate, across
+// every server. The icon with the highest priority among them is shown, see iconPriority. The title and tooltip are
+// rendered from the tray templates, if configured.
+func (a *App) refreshTray() {
+	a.entitiesMu.Lock()
+	defer a.entitiesMu.Unlock()
+
+	entities := make([]*trackedEntity, 0, len(a.entities))
+	for _, entity := range a.entities {
+		entities = append(entities, entity)
+	}
+	sort.Slice(entities, func(i, j int) bool { return entities[i].order < entities[j].order })
+
+	aggregates := make([]*trackedAggregate, 0, len(a.aggregates))
+	for _, aggregate := range a.aggregates {
+		aggregates = append(aggregates, aggregate)
+	}
+	sort.Slice(aggregates, func(i, j int) bool { return aggregates[i].order < aggregates[j].order })
+
+	icon := IconClosed
+	lines := make([]string, 0, len(entities)+len(aggregates))
+	data := templateData{
+		Entities:   make([]templateEntity, 0, len(entities)),
+		Aggregates: make([]templateAggregate, 0, len(aggregates)),
+		Now:        time.Now(),
+	}
+	add := func(name string, itemIcon IconReference, tooltip string) {
+		if itemIcon.priority() > icon.priority() {
+			icon = itemIcon
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", name, tooltip))
+	}
+	for _, entity := range entities {
+		entityIcon, tooltip := entity.display()
+		add(entity.config.Name(), entityIcon, tooltip)
+		data.Entities = append(data.Entities, entity.templateEntity(entityIcon, tooltip))
+	}
+	for _, aggregate := range aggregates {
+		aggregateIcon, tooltip := aggregate.display()
+		add(aggregate.config.Name, aggregateIcon, tooltip)
+		data.Aggregates = append(data.Aggregates, templateAggregate{
+			Name:    aggregate.config.Name,
+			Server:  aggregate.config.Server,
+			Icon:    aggregateIcon,
+			Tooltip: tooltip,
+		})
+	}
+	data.Icon = icon
+
+	title, details := a.tray.Title(), strings.Join(lines, "\n")
+	var rendered []byte // icon rendered at runtime in place of the icon file, see iconRenderer
+	if !a.templates.empty() {
+		text, err := a.templates.render(data)
+		if err == nil {
+			title = cmp.Or(text.title, title)
+			details = cmp.Or(text.tooltip, details)
+		}
+
+		if a.templates.glyph != "" {
+			// Without text or badge if the templates failed, so that the icon still shows the state
+			spec, specErr := a.templates.iconSpec(icon, text)
+			err = errors.Join(err, specErr)
+			var renderErr error
+			if rendered, renderErr = a.renderer.Render(spec); renderErr != nil {
+				a.logger.Error("failed to render tray icon, using the icon file", "icon", icon, "error", renderErr)
+			}
+		}
+
+		switch {
+		case err != nil:
+			// Logged once per distinct error, as templates are rendered on every state change and refresh
+			if err.Error() != a.templates.lastErr {
+				a.logger.Error("failed to render tray templates, using the defaults", "error", err)
+			}
+			a.templates.lastErr = err.Error()
+		default:
+			a.templates.lastErr = ""
+		}
+	}
+
+	if rendered != nil {
+		if err := a.tray.SetRenderedIcon(icon, rendered); err != nil {
+			a.logger.Error("failed to set tray icon", "icon", icon, "error", err)
+		}
+	} else if err := a.tray.SetIcon(icon); err != nil {
+		a.logger.Error("failed to set tray icon", "icon", icon, "error", err)
+	}
+	if err := a.tray.SetTitle(title); err != nil {
+		a.logger.Error("failed to set tray title", "error", err)
+	}
+	if err := a.tray.SetDetails(details); err != nil {
+		a.logger.Error("failed to set tray tooltip", "error", err)
+	}
+}
+
+// templateEntity returns the entity as available to the tray templates
+func (e *trackedEntity) templateEntity(icon IconReference, tooltip string) templateEntity {
+	entity := templateEntity{
+		ID:      e.config.ID,
+		Server:  e.config.Server,
+		Name:    e.config.Name(),
+		Icon:    icon,
+		Tooltip: tooltip,
+	}
+	entity.FriendlyName = entity.Name
+	if e.snapshot != nil {
+		entity.State = e.snapshot.State
+		entity.Attributes = e.snapshot.Attributes
+		entity.LastChanged = e.snapshot.LastChanged
+		if name, ok := e.snapshot.Attributes["friendly_name"].(string); ok && name != "" {
+			entity.FriendlyName = name
+		}
+	}
+	return entity
+}
+
+// trackTemplates replaces the tray templates. The configuration is validated before it is used, so a template that
+// does not parse is only logged, and the default title and tooltip used instead.
+func (a *App) trackTemplates(c TrayConfig) {
+	a.entitiesMu.Lock()
+	defer a.entitiesMu.Unlock()
+
+	templates, err := parseTrayTemplates(c)
+	if err != nil {
+		a.logger.Error("invalid tray templates, using the defaults", "error", err)
+	}
+	a.templates = templates
+}
+
+// startRefresh renders the tray templates periodically while the application is active, see templateRefresh.
+// The caller must hold a.mu.
+func (a *App) startRefresh() {
+	if a.refreshStop != nil {
+		return
+	}
+
+	stop := make(chan struct{})
+	a.refreshStop = stop
+	go func() {
+		ticker := time.NewTicker(templateRefresh)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			a.entitiesMu.Lock()
+			empty := a.templates.empty()
+			a.entitiesMu.Unlock()
+			if !empty {
+				a.refreshTray()
+			}
+		}
+	}()
+}
+
+// stopRefresh stops rendering the tray templates periodically. The caller must hold a.mu.
+func (a *App) stopRefresh() {
+	if a.refreshStop != nil {
+		close(a.refreshStop)
+		a.refreshStop = nil
+	}
+}
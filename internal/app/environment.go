@@ -0,0 +1,260 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+// envPrefix is the prefix of environment variables overriding configuration values.
+// Names are derived from TOML keys, with arrays indexed and tables separated by underscores:
+// server[0].url -> HATRAY_SERVER_0_URL, entity[0].label -> HATRAY_ENTITY_0_LABEL, entity[0].icons.on -> HATRAY_ENTITY_0_ICONS_ON
+const envPrefix = "HATRAY_"
+
+// envReserved lists HATRAY_ variables that are not configuration values
+var envReserved = map[string]bool{
+	"HATRAY_CONFIG": true,
+}
+
+// legacyEnvAliases maps deprecated environment variables to the variables replacing them
+// These predate multiple servers, so they address the first server.
+var legacyEnvAliases = map[string]string{
+	"API_KEY":      "HATRAY_SERVER_0_API_KEY",
+	"INSTANCE_URL": "HATRAY_SERVER_0_URL",
+}
+
+// errUnknownKey is returned when an environment variable or --set flag does not address any configuration value
+var errUnknownKey = errors.New("unknown configuration key")
+
+// applyEnvironment overrides configuration values with HATRAY_ environment variables, and their deprecated aliases.
+// Variables may also be provided by a .env file in the working directory; these never override the real environment.
+// The file is read on every load rather than into the process environment, so that edits are picked up by Reload.
+func (c *Config) applyEnvironment() error {
+	env := environment()
+
+	// Deprecated aliases are applied first, so that their replacements take precedence when both are set
+	legacy := make([]string, 0, len(legacyEnvAliases))
+	for name := range legacyEnvAliases {
+		legacy = append(legacy, name)
+	}
+	sort.Strings(legacy)
+
+	for _, name := range legacy {
+		value, ok := env[name]
+		if !ok || strings.TrimSpace(value) == "" {
+			continue
+		}
+
+		replacement := legacyEnvAliases[name]
+		c.meta.warnings = append(c.meta.warnings, fmt.Sprintf("environment variable %s is deprecated, use %s instead", name, replacement))
+		if err := c.setEnv(name, strings.TrimPrefix(replacement, envPrefix), value); err != nil {
+			return err
+		}
+	}
+
+	var names []string
+	for name := range env {
+		if strings.HasPrefix(name, envPrefix) && !envReserved[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return lessEnvName(names[i], names[j]) })
+
+	for _, name := range names {
+		err := c.setEnv(name, strings.TrimPrefix(name, envPrefix), env[name])
+		if errors.Is(err, errUnknownKey) {
+			c.meta.warnings = append(c.meta.warnings, fmt.Sprintf("environment variable %s does not match any configuration key", name))
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// environment returns the variables of the .env file in the working directory, if any, merged with the real
+// environment, which takes precedence
+func environment() map[string]string {
+	// A missing or unreadable .env file is not an error
+	env, err := godotenv.Read()
+	if err != nil {
+		env = make(map[string]string)
+	}
+
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+		env[name] = value
+	}
+	return env
+}
+
+// lessEnvName orders environment variable names with array indices compared as numbers, so that arrays are extended
+// in order (e.g. HATRAY_SERVER_2_URL before HATRAY_SERVER_10_URL)
+func lessEnvName(a, b string) bool {
+	as, bs := strings.Split(a, "_"), strings.Split(b, "_")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] == bs[i] {
+			continue
+		}
+		an, aErr := strconv.Atoi(as[i])
+		bn, bErr := strconv.Atoi(bs[i])
+		if aErr == nil && bErr == nil {
+			return an < bn
+		}
+		return as[i] < bs[i]
+	}
+	return len(as) < len(bs)
+}
+
+// setEnv sets the configuration value addressed by key (an environment variable name without its prefix)
+func (c *Config) setEnv(name, key, value string) error {
+	path, err := setEnvValue(reflect.ValueOf(c).Elem(), key, "", strings.TrimSpace(value))
+	if err != nil {
+		return fmt.Errorf("invalid environment variable %s: %w", name, err)
+	}
+
+	c.meta.overrides[path] = ValueSource{Kind: SourceEnv, Name: name}
+	return nil
+}
+
+// setEnvValue sets the value within v addressed by key, returning the TOML path of the value that was set.
+// key is the remainder of an environment variable name after the path already walked, e.g. ENTITY_0_LABEL -> 0_LABEL.
+func setEnvValue(v reflect.Value, key, path, value string) (string, error) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return setEnvValue(v.Elem(), key, path, value)
+	case reflect.Struct:
+		for _, field := range envFields(v.Type()) {
+			name := tomlName(field)
+			upper := strings.ToUpper(name)
+
+			if key == upper {
+				return setEnvValue(v.FieldByIndex(field.Index), "", joinPath(path, name), value)
+			}
+			if rest, ok := strings.CutPrefix(key, upper+"_"); ok {
+				return setEnvValue(v.FieldByIndex(field.Index), rest, joinPath(path, name), value)
+			}
+		}
+		return "", errUnknownKey
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Struct {
+			break // a list of scalars, set as a whole below
+		}
+
+		indexKey, rest, _ := strings.Cut(key, "_")
+		index, err := strconv.Atoi(indexKey)
+		if err != nil || index < 0 || rest == "" {
+			return "", errUnknownKey
+		}
+		elem, err := sliceElement(v, path, index)
+		if err != nil {
+			return "", err
+		}
+		return setEnvValue(elem, rest, fmt.Sprintf("%s[%d]", path, index), value)
+	case reflect.Map:
+		if key == "" {
+			return "", errUnknownKey
+		}
+
+		// Environment variables are conventionally upper case, whereas map keys (e.g. entity states) are lower case
+		mapKey := strings.ToLower(key)
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if err := setScalar(elem, value); err != nil {
+			return "", err
+		}
+
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		v.SetMapIndex(reflect.ValueOf(mapKey).Convert(v.Type().Key()), elem)
+		return joinPath(path, formatKey(mapKey)), nil
+	}
+
+	if key != "" {
+		return "", errUnknownKey
+	}
+	return path, setScalar(v, value)
+}
+
+// sliceElement returns the element of an array of tables at index, appending it if index is just past the end.
+// Arrays are only extended one element at a time, so that a mistyped index cannot create empty elements.
+func sliceElement(v reflect.Value, path string, index int) (reflect.Value, error) {
+	switch {
+	case index < v.Len():
+		return v.Index(index), nil
+	case index == v.Len():
+		v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+		return v.Index(index), nil
+	}
+	return reflect.Value{}, fmt.Errorf("%s[%d] is out of range, the next element is %s[%d]", path, index, path, v.Len())
+}
+
+// envFields returns the fields of a struct that can be set by environment variables, longest key first so that
+// keys sharing a prefix (e.g. api_key and api_key_file) resolve to the most specific field
+func envFields(t reflect.Type) []reflect.StructField {
+	var fields []reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if tomlName(field) != "" && field.Tag.Get("env") != "-" {
+			fields = append(fields, field)
+		}
+	}
+
+	sort.SliceStable(fields, func(i, j int) bool {
+		return len(tomlName(fields[i])) > len(tomlName(fields[j]))
+	})
+	return fields
+}
+
+// setScalar parses value into v according to its kind; lists are comma-separated, and optional values are allocated
+func setScalar(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.Pointer:
+		elem := reflect.New(v.Type().Elem())
+		if err := setScalar(elem.Elem(), value); err != nil {
+			return err
+		}
+		v.Set(elem)
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("expected a boolean: %q", value)
+		}
+		v.SetBool(parsed)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		parsed, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("expected an integer: %q", value)
+		}
+		v.SetInt(parsed)
+	case reflect.Float32, reflect.Float64:
+		parsed, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("expected a number: %q", value)
+		}
+		v.SetFloat(parsed)
+	case reflect.Slice:
+		parts := strings.Split(value, ",")
+		list := reflect.MakeSlice(v.Type(), len(parts), len(parts))
+		for i, part := range parts {
+			if err := setScalar(list.Index(i), strings.TrimSpace(part)); err != nil {
+				return err
+			}
+		}
+		v.Set(list)
+	default:
+		return fmt.Errorf("unsupported value type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// chdir changes the working directory for the duration of a test, e.g. to the directory of a .env file
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(previous) })
+}
+
+// environmentConfig applies environment variables to config, from a working directory without a .env file
+func environmentConfig(t *testing.T, config *Config, env map[string]string) error {
+	t.Helper()
+
+	chdir(t, t.TempDir())
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	config.meta = newConfigMeta("")
+	return config.applyEnvironment()
+}
+
+func TestEnvironmentIndices(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		wantServers int
+		wantErr     string
+	}{
+		{"existing element", map[string]string{"HATRAY_SERVER_0_URL": "http://a"}, 1, ""},
+		{"next element", map[string]string{"HATRAY_SERVER_1_URL": "http://b"}, 2, ""},
+		{"skipped element", map[string]string{"HATRAY_SERVER_2_URL": "http://c"}, 0, "server[2] is out of range, the next element is server[1]"},
+		{"huge index", map[string]string{"HATRAY_ENTITY_100000000_ID": "x"}, 0, "entity[100000000] is out of range"},
+		{
+			name: "elements added in numeric order",
+			env: map[string]string{
+				"HATRAY_SERVER_1_URL": "http://b", "HATRAY_SERVER_2_URL": "http://c", "HATRAY_SERVER_3_URL": "http://d",
+				"HATRAY_SERVER_4_URL": "http://e", "HATRAY_SERVER_5_URL": "http://f", "HATRAY_SERVER_6_URL": "http://g",
+				"HATRAY_SERVER_7_URL": "http://h", "HATRAY_SERVER_8_URL": "http://i", "HATRAY_SERVER_9_URL": "http://j",
+				"HATRAY_SERVER_10_URL": "http://k",
+			},
+			wantServers: 11,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{Servers: []ServerConfig{{URL: "http://original"}}}
+			err := environmentConfig(t, config, tt.env)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(config.Servers) != tt.wantServers {
+				t.Errorf("expected %d servers, got %d", tt.wantServers, len(config.Servers))
+			}
+		})
+	}
+}
+
+func TestLegacyEnvironment(t *testing.T) {
+	tests := []struct {
+		name         string
+		env          map[string]string
+		wantURL      string
+		wantAPIKey   string
+		wantWarnings []string
+	}{
+		{
+			name:         "INSTANCE_URL",
+			env:          map[string]string{"INSTANCE_URL": "http://legacy"},
+			wantURL:      "http://legacy",
+			wantWarnings: []string{"environment variable INSTANCE_URL is deprecated, use HATRAY_SERVER_0_URL instead"},
+		},
+		{
+			name:         "API_KEY",
+			env:          map[string]string{"API_KEY": "legacy-key"},
+			wantURL:      "http://original",
+			wantAPIKey:   "legacy-key",
+			wantWarnings: []string{"environment variable API_KEY is deprecated, use HATRAY_SERVER_0_API_KEY instead"},
+		},
+		{
+			name:       "replacements take precedence",
+			env:        map[string]string{"INSTANCE_URL": "http://legacy", "HATRAY_SERVER_0_URL": "http://new", "API_KEY": "legacy-key", "HATRAY_SERVER_0_API_KEY": "new-key"},
+			wantURL:    "http://new",
+			wantAPIKey: "new-key",
+			wantWarnings: []string{
+				"environment variable API_KEY is deprecated, use HATRAY_SERVER_0_API_KEY instead",
+				"environment variable INSTANCE_URL is deprecated, use HATRAY_SERVER_0_URL instead",
+			},
+		},
+		{name: "empty aliases are ignored", env: map[string]string{"INSTANCE_URL": " ", "API_KEY": ""}, wantURL: "http://original"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{Servers: []ServerConfig{{URL: "http://original"}}}
+			if err := environmentConfig(t, config, tt.env); err != nil {
+				t.Fatal(err)
+			}
+			if config.Servers[0].URL != tt.wantURL || config.Servers[0].APIKey != tt.wantAPIKey {
+				t.Errorf("expected url %q and api_key %q, got %q and %q", tt.wantURL, tt.wantAPIKey, config.Servers[0].URL, config.Servers[0].APIKey)
+			}
+			if !slices.Equal(config.meta.warnings, tt.wantWarnings) {
+				t.Errorf("expected warnings %q, got %q", tt.wantWarnings, config.meta.warnings)
+			}
+		})
+	}
+}
+
+func TestDotEnv(t *testing.T) {
+	dir := t.TempDir()
+	chdir(t, dir)
+	writeDotEnv := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, ".env"), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	load := func() *Config {
+		t.Helper()
+		config := &Config{Servers: []ServerConfig{{URL: "http://original"}}, Entities: []EntityConfig{{ID: "light.desk"}}}
+		config.meta = newConfigMeta("")
+		if err := config.applyEnvironment(); err != nil {
+			t.Fatal(err)
+		}
+		return config
+	}
+
+	writeDotEnv("HATRAY_SERVER_0_URL=http://dotenv\nHATRAY_ENTITY_0_LABEL=Desk\nINSTANCE_URL=http://legacy\n")
+	t.Setenv("HATRAY_SERVER_0_URL", "http://real")
+
+	config := load()
+	if config.Servers[0].URL != "http://real" {
+		t.Errorf("expected the real environment to take precedence over .env, got %q", config.Servers[0].URL)
+	}
+	if config.Entities[0].Label != "Desk" {
+		t.Errorf("expected the label from .env, got %q", config.Entities[0].Label)
+	}
+	if source := config.meta.overrides["entity[0].label"]; source != (ValueSource{Kind: SourceEnv, Name: "HATRAY_ENTITY_0_LABEL"}) {
+		t.Errorf("expected the label to be attributed to its variable, got %+v", source)
+	}
+	if len(config.meta.warnings) != 1 || !strings.Contains(config.meta.warnings[0], "INSTANCE_URL is deprecated") {
+		t.Errorf("expected a deprecation warning for the alias in .env, got %q", config.meta.warnings)
+	}
+	if _, ok := os.LookupEnv("HATRAY_ENTITY_0_LABEL"); ok {
+		t.Error("expected .env to be left out of the process environment")
+	}
+
+	// Edits are picked up by the next load, e.g. on reload
+	writeDotEnv("HATRAY_ENTITY_0_LABEL=Office desk\n")
+	if config := load(); config.Entities[0].Label != "Office desk" {
+		t.Errorf("expected the edited label, got %q", config.Entities[0].Label)
+	}
+
+	os.Remove(filepath.Join(dir, ".env"))
+	if config := load(); config.Entities[0].Label != "" {
+		t.Errorf("expected the label to be gone with .env, got %q", config.Entities[0].Label)
+	}
+}
@@ -0,0 +1,75 @@
+package app
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// applyFlags overrides configuration values with key=value pairs from the command line (i.e. --set flags), which take
+// precedence over every other source. Keys are paths as used by 'config get', e.g. server[0].url or entity[1].icons.on.
+func (c *Config) applyFlags(flags []string) error {
+	for _, flag := range flags {
+		key, value, ok := strings.Cut(flag, "=")
+		if !ok {
+			return fmt.Errorf("invalid --set %q, expected key=value", flag)
+		}
+		key = strings.TrimSpace(key)
+
+		parts, err := splitPath(key)
+		if err != nil {
+			return fmt.Errorf("invalid --set %s: %w", key, err)
+		}
+
+		path, err := setPathValue(reflect.ValueOf(c).Elem(), parts, "", strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("invalid --set %s: %w", key, err)
+		}
+		c.meta.overrides[path] = ValueSource{Kind: SourceFlag, Name: "--set " + key}
+	}
+
+	return nil
+}
+
+// setPathValue sets the value within v addressed by parts, returning the TOML path of the value that was set.
+// Arrays of tables are extended by one element at a time, as with environment variables, see sliceElement.
+func setPathValue(v reflect.Value, parts []pathPart, path, value string) (string, error) {
+	if len(parts) == 0 {
+		switch {
+		case v.Kind() == reflect.Struct || v.Kind() == reflect.Map:
+			return "", fmt.Errorf("%s is a table, set its keys individually", path)
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct:
+			return "", fmt.Errorf("%s is an array of tables, set the keys of each element individually", path)
+		}
+		return path, setScalar(v, value)
+	}
+
+	part, rest := parts[0], parts[1:]
+	switch {
+	case part.index >= 0 && v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct:
+		elem, err := sliceElement(v, path, part.index)
+		if err != nil {
+			return "", err
+		}
+		return setPathValue(elem, rest, fmt.Sprintf("%s[%d]", path, part.index), value)
+	case part.index < 0 && v.Kind() == reflect.Struct:
+		field, ok := fieldByTOMLKey(v.Type(), part.key)
+		if !ok || field.Tag.Get("env") == "-" {
+			return "", errUnknownKey
+		}
+		return setPathValue(v.FieldByIndex(field.Index), rest, joinPath(path, formatKey(part.key)), value)
+	case part.index < 0 && v.Kind() == reflect.Map && len(rest) == 0:
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if err := setScalar(elem, value); err != nil {
+			return "", err
+		}
+
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		v.SetMapIndex(reflect.ValueOf(part.key).Convert(v.Type().Key()), elem)
+		return joinPath(path, formatKey(part.key)), nil
+	}
+
+	return "", errUnknownKey
+}
@@ -0,0 +1,43 @@
+package app
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApplyFlags(t *testing.T) {
+	tests := []struct {
+		name         string
+		flags        []string
+		wantEntities int
+		wantErr      string
+	}{
+		{"existing element", []string{"entity[0].label=Front Door"}, 1, ""},
+		{"next element", []string{"entity[1].id=binary_sensor.back_door"}, 2, ""},
+		{"elements added in order", []string{"entity[1].id=binary_sensor.a", "entity[2].id=binary_sensor.b"}, 3, ""},
+		{"skipped element", []string{"entity[2].id=binary_sensor.a"}, 0, "entity[2] is out of range, the next element is entity[1]"},
+		{"huge index", []string{"entity[99999999].id=x"}, 0, "entity[99999999] is out of range"},
+		{"table", []string{"tray=x"}, 0, "tray is a table"},
+		{"unknown key", []string{"entity[0].colour=red"}, 0, errUnknownKey.Error()},
+		{"missing value", []string{"entity[0].label"}, 0, "expected key=value"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{Entities: []EntityConfig{{ID: "binary_sensor.front_door"}}, meta: newConfigMeta("")}
+			err := config.applyFlags(tt.flags)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(config.Entities) != tt.wantEntities {
+				t.Errorf("expected %d entities, got %d", tt.wantEntities, len(config.Entities))
+			}
+		})
+	}
+}
@@ -0,0 +1,370 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// maxAuthMessage is the largest websocket authentication message accepted by the gateway, from clients and servers
+const maxAuthMessage = 64 * 1024
+
+// gateway is a reverse proxy on the loopback interface, forwarding every request to a single server through a custom
+// transport. go-ha only accepts a URL and API key, so servers needing TLS options (or other transport options) are
+// connected to by pointing go-ha at a gateway instead, which carries both websocket and REST traffic.
+//
+// The loopback interface is reachable by every local process, while the gateway presents the client certificate on
+// their behalf. It is therefore authenticated with a random token, which is given to go-ha in place of the API key: REST
+// requests must carry it as their bearer token, and websocket connections in their auth message. The gateway replaces
+// it with the server's API key, so the API key itself never reaches the gateway's clients.
+type gateway struct {
+	logger   *slog.Logger
+	listener net.Listener
+	server   *http.Server
+	tunnel   *tunnel // SSH tunnel the server is reached through, nil if not configured
+	url      string  // base URL of the gateway, used in place of the server's URL
+	token    string  // authenticates the gateway's clients, used in place of the server's API key
+
+	upstream  *url.URL
+	transport *http.Transport
+	apiKey    string
+}
+
+// newGateway starts a gateway forwarding to a server through its transport, and SSH tunnel if it has one
+func newGateway(logger *slog.Logger, server ServerConfig, apiKey string) (*gateway, error) {
+	upstream, err := url.Parse(server.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server URL: %w", err)
+	}
+
+	transport, err := server.newTransport()
+	if err != nil {
+		return nil, err
+	}
+
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return nil, fmt.Errorf("failed to generate gateway token: %w", err)
+	}
+
+	g := &gateway{
+		logger:    logger.With("component", "gateway"),
+		token:     hex.EncodeToString(token),
+		upstream:  upstream,
+		transport: transport,
+		apiKey:    apiKey,
+	}
+
+	if server.Tunnel != (TunnelConfig{}) {
+		if g.tunnel, err = newTunnel(logger.With("component", "tunnel"), server.Tunnel); err != nil {
+			return nil, err
+		}
+		// The server's address is resolved by the SSH server, so proxies (which cannot be combined with tunnels) are not
+		// used, even if set by the environment
+		transport.Proxy = nil
+		transport.DialContext = g.tunnel.DialContext
+	}
+
+	g.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		if g.tunnel != nil {
+			g.tunnel.Close()
+		}
+		return nil, fmt.Errorf("failed to start gateway: %w", err)
+	}
+	g.url = "http://" + g.listener.Addr().String()
+
+	g.server = &http.Server{Handler: http.HandlerFunc(g.serveHTTP)}
+
+	go func() {
+		if err := g.server.Serve(g.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			g.logger.Error("gateway stopped", "error", err)
+		}
+	}()
+
+	g.logger.Debug("gateway started", "address", g.url, "server", upstream.Redacted())
+	return g, nil
+}
+
+// serveHTTP authenticates a request with the gateway's token, then forwards it to the server
+func (g *gateway) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if isWebsocketUpgrade(r) {
+		g.serveWebsocket(w, r)
+		return
+	}
+
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !g.authenticated(token) {
+		g.logger.Warn("rejected unauthenticated gateway request", "path", r.URL.Path, "remote", r.RemoteAddr)
+		http.Error(w, "invalid gateway token", http.StatusUnauthorized)
+		return
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(g.upstream)
+			r.Out.Header.Set("Authorization", "Bearer "+g.apiKey)
+		},
+		Transport:    g.transport,
+		ErrorHandler: g.fail,
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// serveWebsocket forwards a websocket connection to the server. Home Assistant asks for an auth message with
+// auth_required as soon as a websocket is opened, and authenticates the connection with the first message sent by the
+// client. The gateway completes the handshake with the client and asks for the auth message itself, so that its token
+// is checked before any connection is made to the server, then sends the message to the server with the API key.
+// Nothing else is relayed between them until then.
+func (g *gateway) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+
+	client, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		g.logger.Warn("gateway websocket failed", "error", err)
+		return
+	}
+	defer client.Close()
+
+	// No extensions are accepted, so that frames are never compressed and the auth message can be read
+	fmt.Fprintf(buffered, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", websocketAccept(key))
+	if err := writeFrame(buffered, websocketText, []byte(`{"type":"auth_required"}`), false); err != nil || buffered.Flush() != nil {
+		return
+	}
+
+	auth, err := g.authenticateWebsocket(buffered.Reader)
+	if err != nil {
+		g.logger.Warn("rejected unauthenticated gateway websocket", "remote", r.RemoteAddr, "error", err)
+		writeAuthInvalid(client, "Invalid gateway token")
+		return
+	}
+
+	upstream, err := g.dialWebsocket(r)
+	if err != nil {
+		g.logger.Warn("gateway websocket failed", "error", err)
+		// Reported as the outcome of authentication, the only failure the client expects at this point
+		writeAuthInvalid(client, fmt.Sprintf("gateway could not connect to the server: %v", err))
+		return
+	}
+	defer upstream.Close()
+	if err := writeFrame(upstream, websocketText, auth, true); err != nil {
+		return
+	}
+
+	// The server's response to the auth message (auth_ok or auth_invalid) is relayed as any other message
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(client, upstream)
+		client.Close()
+	}()
+
+	io.Copy(upstream, buffered.Reader)
+	upstream.Close()
+	<-done
+}
+
+// writeAuthInvalid answers a websocket client's auth message with auth_invalid, as a server rejecting it would
+func writeAuthInvalid(client io.Writer, reason string) error {
+	payload, err := json.Marshal(map[string]string{"type": "auth_invalid", "message": reason})
+	if err != nil {
+		return err
+	}
+	return writeFrame(client, websocketText, payload, false)
+}
+
+// authenticateWebsocket reads the client's auth message and checks its token, returning the message with the API key
+func (g *gateway) authenticateWebsocket(client io.Reader) ([]byte, error) {
+	opcode, payload, err := readFrame(client, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var message map[string]any
+	if opcode != websocketText || json.Unmarshal(payload, &message) != nil || message["type"] != "auth" {
+		return nil, errors.New("first message is not an auth message")
+	}
+	if token, _ := message["access_token"].(string); !g.authenticated(token) {
+		return nil, errors.New("invalid gateway token")
+	}
+
+	message["access_token"] = g.apiKey
+	return json.Marshal(message)
+}
+
+// dialWebsocket opens a websocket connection to the server through the transport, then reads the server's
+// auth_required message, which the gateway has already sent to the client
+func (g *gateway) dialWebsocket(r *http.Request) (io.ReadWriteCloser, error) {
+	out := r.Clone(r.Context())
+	(&httputil.ProxyRequest{In: r, Out: out}).SetURL(g.upstream)
+	out.RequestURI = ""
+	out.Body = nil
+	// Compressed frames could not be read, and the client's own credentials are not forwarded
+	out.Header.Del("Sec-WebSocket-Extensions")
+	out.Header.Del("Authorization")
+
+	response, err := g.transport.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		response.Body.Close()
+		return nil, fmt.Errorf("server refused the websocket connection: %s", response.Status)
+	}
+	upstream := response.Body.(io.ReadWriteCloser)
+
+	opcode, payload, err := readFrame(upstream, false)
+	if err == nil {
+		var message struct {
+			Type string `json:"type"`
+		}
+		if opcode != websocketText || json.Unmarshal(payload, &message) != nil || message.Type != "auth_required" {
+			err = errors.New("first message from the server is not auth_required")
+		}
+	}
+	if err != nil {
+		upstream.Close()
+		return nil, err
+	}
+	return upstream, nil
+}
+
+// authenticated returns true if the token is the gateway's
+func (g *gateway) authenticated(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(g.token)) == 1
+}
+
+// fail reports why a request could not be forwarded to the server in the response body
+func (g *gateway) fail(w http.ResponseWriter, r *http.Request, err error) {
+	g.logger.Warn("gateway request failed", "path", r.URL.Path, "error", err)
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
+
+// Close stops the gateway from accepting connections, and closes its SSH tunnel
+// Websocket connections already forwarded end when go-ha closes its side, so the connection should be closed first.
+func (g *gateway) Close() error {
+	err := g.server.Close()
+	if g.tunnel != nil {
+		err = errors.Join(err, g.tunnel.Close())
+	}
+	return err
+}
+
+// websocketText is the opcode of websocket text frames
+const websocketText = 0x1
+
+// isWebsocketUpgrade returns true if the request opens a websocket connection
+func isWebsocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// websocketGUID is appended to the client's key to derive Sec-WebSocket-Accept, see RFC 6455 section 4.2.2
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// websocketAccept returns the Sec-WebSocket-Accept header accepting a client's Sec-WebSocket-Key
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// readFrame reads a single websocket frame, returning its opcode and unmasked payload. Frames sent by clients are
+// masked, and frames sent by servers are not.
+// Fragmented frames are not supported, the authentication messages are small enough to be sent in one frame.
+func readFrame(r io.Reader, masked bool) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	if header[0]&0x80 == 0 {
+		return 0, nil, errors.New("fragmented frame")
+	}
+	if (header[1]&0x80 != 0) != masked {
+		return 0, nil, errors.New("unexpected frame masking")
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(r, extended[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(r, extended[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if length > maxAuthMessage {
+		return 0, nil, fmt.Errorf("frame of %d bytes is too large", length)
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return header[0] & 0x0f, payload, nil
+}
+
+// writeFrame writes a single websocket frame, masking its payload if sent as a client
+func writeFrame(w io.Writer, opcode byte, payload []byte, masked bool) error {
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+	frame := []byte{0x80 | opcode}
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xffff:
+		frame = binary.BigEndian.AppendUint16(append(frame, maskBit|126), uint16(length))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, maskBit|127), uint64(length))
+	}
+
+	if !masked {
+		_, err := w.Write(append(frame, payload...))
+		return err
+	}
+
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	_, err := w.Write(frame)
+	return err
+}
@@ -0,0 +1,276 @@
+package app
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"log"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testAPIKey is the API key accepted by testHomeAssistant
+const testAPIKey = "test-api-key"
+
+// testHomeAssistant is a minimal Home Assistant server, answering websocket authentication and get_states, and REST
+// requests for /api/states, with a single entity
+func testHomeAssistant() http.Handler {
+	states := []map[string]any{{
+		"entity_id":  "sensor.temperature",
+		"state":      "21.5",
+		"attributes": map[string]any{"friendly_name": "Temperature"},
+	}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/websocket", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.WriteJSON(map[string]any{"type": "auth_required", "ha_version": "2025.1.0"})
+		var auth probeMessage
+		if err := conn.ReadJSON(&auth); err != nil {
+			return
+		}
+		if auth.Type != "auth" || auth.AccessToken != testAPIKey {
+			conn.WriteJSON(map[string]any{"type": "auth_invalid", "message": "Invalid access token"})
+			return
+		}
+		conn.WriteJSON(map[string]any{"type": "auth_ok", "ha_version": "2025.1.0"})
+
+		for {
+			var message probeMessage
+			if err := conn.ReadJSON(&message); err != nil {
+				return
+			}
+			response := map[string]any{"id": message.ID, "type": "result", "success": true}
+			if message.Type == "get_states" {
+				response["result"] = states
+			}
+			conn.WriteJSON(response)
+		}
+	})
+	mux.HandleFunc("/api/states", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+testAPIKey {
+			http.Error(w, "401: Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(states)
+	})
+	return mux
+}
+
+// writeCertificate generates a self-signed certificate, returning the paths of its PEM certificate and key
+func writeCertificate(t *testing.T, name string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+// writePEM writes a single PEM block to a file
+func writePEM(t *testing.T, filename, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGatewayTLS(t *testing.T) {
+	clientCert, clientKey := writeCertificate(t, "client")
+	otherCA, _ := writeCertificate(t, "other")
+
+	clientPEM, _ := os.ReadFile(clientCert)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(clientPEM)
+
+	tests := []struct {
+		name              string
+		requireClientCert bool
+		tls               func(server *httptest.Server, caFile string) TLSConfig
+		wantErr           string
+	}{
+		{"ca_file", false, func(_ *httptest.Server, caFile string) TLSConfig {
+			return TLSConfig{CAFile: caFile}
+		}, ""},
+		{"ca_file of another CA", false, func(_ *httptest.Server, _ string) TLSConfig {
+			return TLSConfig{CAFile: otherCA}
+		}, "certificate signed by unknown authority"},
+		{"fingerprint", false, func(server *httptest.Server, _ string) TLSConfig {
+			fingerprint := sha256.Sum256(server.Certificate().Raw)
+			return TLSConfig{Fingerprint: formatFingerprint(fingerprint[:])}
+		}, ""},
+		{"fingerprint mismatch", false, func(_ *httptest.Server, _ string) TLSConfig {
+			return TLSConfig{Fingerprint: strings.Repeat("00", sha256.Size)}
+		}, "does not match the pinned tls.fingerprint"},
+		{"client certificate", true, func(_ *httptest.Server, caFile string) TLSConfig {
+			return TLSConfig{CAFile: caFile, ClientCert: clientCert, ClientKey: clientKey}
+		}, ""},
+		{"missing client certificate", true, func(_ *httptest.Server, caFile string) TLSConfig {
+			return TLSConfig{CAFile: caFile}
+		}, "certificate required"},
+		{"insecure", false, func(_ *httptest.Server, _ string) TLSConfig {
+			return TLSConfig{Insecure: true}
+		}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewUnstartedServer(testHomeAssistant())
+			server.Config.ErrorLog = log.New(io.Discard, "", 0) // rejected handshakes are expected
+			if tt.requireClientCert {
+				server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+			}
+			server.StartTLS()
+			defer server.Close()
+
+			caFile := filepath.Join(t.TempDir(), "ca.crt")
+			writePEM(t, caFile, "CERTIFICATE", server.Certificate().Raw)
+
+			config := ServerConfig{URL: server.URL, APIKey: testAPIKey, TLS: tt.tls(server, caFile)}
+			probe, err := ProbeServer(context.Background(), config)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if probe.Version != "2025.1.0" || len(probe.Entities) != 1 || probe.Entities[0].ID != "sensor.temperature" {
+				t.Errorf("unexpected probe %+v", probe)
+			}
+		})
+	}
+}
+
+func TestGatewayToken(t *testing.T) {
+	var websockets atomic.Int32 // websocket connections reaching the server
+	homeAssistant := testHomeAssistant()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/websocket" {
+			websockets.Add(1)
+		}
+		homeAssistant.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	g, err := newGateway(slog.New(slog.NewTextHandler(io.Discard, nil)), ServerConfig{URL: server.URL, TLS: TLSConfig{Insecure: true}}, testAPIKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	t.Run("rest", func(t *testing.T) {
+		for _, tt := range []struct {
+			name   string
+			token  string
+			status int
+		}{
+			{"gateway token", g.token, http.StatusOK},
+			{"api key", testAPIKey, http.StatusUnauthorized},
+			{"no token", "", http.StatusUnauthorized},
+		} {
+			request, _ := http.NewRequest(http.MethodGet, g.url+"/api/states", nil)
+			if tt.token != "" {
+				request.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+			if response.StatusCode != tt.status {
+				t.Errorf("%s: expected status %d, got %d", tt.name, tt.status, response.StatusCode)
+			}
+		}
+	})
+
+	t.Run("websocket", func(t *testing.T) {
+		endpoint, err := websocketURL(g.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tt := range []struct {
+			name  string
+			token string
+			want  string
+		}{
+			{"api key", testAPIKey, "auth_invalid"},
+			{"wrong token", "wrong", "auth_invalid"},
+			{"gateway token", g.token, "auth_ok"},
+		} {
+			conn, _, err := websocket.DefaultDialer.Dial(endpoint, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+			var message probeMessage
+			if err := conn.ReadJSON(&message); err != nil || message.Type != "auth_required" {
+				t.Fatalf("%s: expected auth_required, got %+v, %v", tt.name, message, err)
+			}
+			conn.WriteJSON(probeMessage{Type: "auth", AccessToken: tt.token})
+
+			message = probeMessage{}
+			conn.ReadJSON(&message)
+			if message.Type != tt.want {
+				t.Errorf("%s: expected %q, got %q", tt.name, tt.want, message.Type)
+			}
+			conn.Close()
+		}
+
+		// Rejected connections are answered by the gateway, without connecting to the server
+		if count := websockets.Load(); count != 1 {
+			t.Errorf("expected only the authenticated websocket to reach the server, got %d", count)
+		}
+	})
+}
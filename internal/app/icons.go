@@ -0,0 +1,266 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"ha-tray/internal"
+	"image/png"
+	"log/slog"
+	"sort"
+)
+
+// pngSignature starts every PNG file, including PNG images stored within ICO files
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// icoHeader is the header of an ICO file, followed by an icoEntry for each image it contains
+type icoHeader struct {
+	Reserved uint16 // always 0
+	Type     uint16 // 1 for icons, 2 for cursors
+	Count    uint16
+}
+
+// icoEntry describes an image within an ICO file
+type icoEntry struct {
+	Width, Height uint8 // 0 means 256
+	Colors        uint8
+	Reserved      uint8
+	Planes        uint16
+	BitCount      uint16
+	Size          uint32 // size of the image data
+	Offset        uint32 // offset of the image data from the start of the file
+}
+
+// bmpInfoHeaderSize is the size of the BITMAPINFOHEADER starting images within ICO files that are not PNG
+const bmpInfoHeaderSize = 40
+
+// iconSizes are the sizes of the embedded icon sources, covering the tray at 100% to 300% scaling on every platform,
+// along with a large image for high resolution displays
+var iconSizes = []int{16, 20, 24, 32, 48, 64, 256}
+
+// iconImage is a PNG image of an icon at one size
+type iconImage struct {
+	width, height int
+	data          []byte
+}
+
+// iconSet is an icon at one or more sizes, from which the tray icon is encoded for the platform, see encodeTrayIcon
+type iconSet struct {
+	images []iconImage // PNG images, smallest first
+	ico    []byte      // ICO file used as is, as it contains bitmap images, which are not converted to PNG
+}
+
+// nearest returns the smallest image at least as wide as size, or the largest image if none are
+func (s iconSet) nearest(size int) iconImage {
+	for _, image := range s.images {
+		if image.width >= size {
+			return image
+		}
+	}
+	return s.images[len(s.images)-1]
+}
+
+// embeddedIconSet reads the embedded sources of an icon at every size in iconSizes
+func embeddedIconSet(icon IconReference) (iconSet, error) {
+	var set iconSet
+	for _, size := range iconSizes {
+		data, err := internal.Icons.ReadFile(icon.Path(size))
+		if err != nil {
+			return iconSet{}, fmt.Errorf("failed to read icon: %w", err)
+		}
+		set.images = append(set.images, iconImage{width: size, height: size, data: data})
+	}
+	return set, nil
+}
+
+// loadIconFile reads and validates an ICO or PNG icon file
+func loadIconFile(path string) (iconSet, error) {
+	data, err := readConfigFile(path)
+	if err != nil {
+		return iconSet{}, err
+	}
+
+	set, err := decodeIcon(data)
+	if err != nil {
+		return iconSet{}, fmt.Errorf("invalid icon %s: %w", path, err)
+	}
+	return set, nil
+}
+
+// decodeIcon validates an ICO or PNG icon, decoding every image it contains. The PNG images of an ICO file are kept
+// at each size, so that they can be encoded for the platform like the embedded icons.
+func decodeIcon(data []byte) (iconSet, error) {
+	if bytes.HasPrefix(data, pngSignature) {
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return iconSet{}, fmt.Errorf("invalid PNG: %w", err)
+		}
+		return iconSet{images: []iconImage{{width: img.Bounds().Dx(), height: img.Bounds().Dy(), data: data}}}, nil
+	}
+
+	var header icoHeader
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &header); err != nil || header.Reserved != 0 || header.Type != 1 {
+		return iconSet{}, errors.New("not an ICO or PNG file")
+	}
+	if header.Count == 0 {
+		return iconSet{}, errors.New("ICO file contains no images")
+	}
+
+	entries := make([]icoEntry, header.Count)
+	if err := binary.Read(bytes.NewReader(data[binary.Size(header):]), binary.LittleEndian, entries); err != nil {
+		return iconSet{}, fmt.Errorf("truncated ICO file: %w", err)
+	}
+
+	var set iconSet
+	for i, entry := range entries {
+		if uint64(entry.Offset)+uint64(entry.Size) > uint64(len(data)) {
+			return iconSet{}, fmt.Errorf("image %d extends past the end of the ICO file", i)
+		}
+		image := data[entry.Offset : entry.Offset+entry.Size]
+
+		if bytes.HasPrefix(image, pngSignature) {
+			img, err := png.Decode(bytes.NewReader(image))
+			if err != nil {
+				return iconSet{}, fmt.Errorf("invalid PNG image %d: %w", i, err)
+			}
+			set.images = append(set.images, iconImage{width: img.Bounds().Dx(), height: img.Bounds().Dy(), data: image})
+			continue
+		}
+
+		// Bitmap images are validated by their header only, as the tray decodes them itself
+		if len(image) < bmpInfoHeaderSize || binary.LittleEndian.Uint32(image) != bmpInfoHeaderSize {
+			return iconSet{}, fmt.Errorf("image %d is neither a PNG nor a bitmap", i)
+		}
+		set.ico = data
+	}
+
+	if set.ico != nil {
+		set.images = nil
+	}
+	sort.SliceStable(set.images, func(i, j int) bool { return set.images[i].width < set.images[j].width })
+	return set, nil
+}
+
+// encodeICO returns an ICO containing the PNG images, as supported since Windows Vista
+func encodeICO(images []iconImage) []byte {
+	header := icoHeader{Type: 1, Count: uint16(len(images))}
+	offset := binary.Size(header) + len(images)*binary.Size(icoEntry{})
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, header)
+	for _, image := range images {
+		entry := icoEntry{
+			Width:    uint8(image.width), // 256 wraps to 0, which means 256
+			Height:   uint8(image.height),
+			Planes:   1,
+			BitCount: 32,
+			Size:     uint32(len(image.data)),
+			Offset:   uint32(offset),
+		}
+		if image.width > 256 || image.height > 256 {
+			entry.Width, entry.Height = 0, 0
+		}
+		binary.Write(&b, binary.LittleEndian, entry)
+		offset += len(image.data)
+	}
+	for _, image := range images {
+		b.Write(image.data)
+	}
+	return b.Bytes()
+}
+
+// readIconFiles loads each configured icon file, encoded for the platform, leaving out (and so falling back to the
+// embedded icon for) any that cannot be loaded
+func readIconFiles(logger *slog.Logger, files map[IconReference]string) map[IconReference][]byte {
+	icons := make(map[IconReference][]byte, len(files))
+	for icon, file := range files {
+		set, err := loadIconFile(file)
+		if err != nil {
+			logger.Error("failed to load icon, using the built-in icon", "icon", icon, "path", file, "error", err)
+			continue
+		}
+		icons[icon] = encodeTrayIcon(set)
+		logger.Debug("icon loaded", "icon", icon, "path", file)
+	}
+	return icons
+}
+
+// checkIconFiles records a warning for each icon file that cannot be loaded. These are not validation errors, as a
+// configuration shared between machines may refer to icons that only exist on some of them, and the embedded icon is
+// used in their place.
+func (c *Config) checkIconFiles() {
+	icons := make([]IconReference, 0, len(c.Icons))
+	for icon := range c.Icons {
+		icons = append(icons, icon)
+	}
+	sort.Slice(icons, func(i, j int) bool { return icons[i] < icons[j] })
+
+	for _, icon := range icons {
+		file := c.Icons[icon]
+		if !icon.Valid() || file == "" {
+			continue // reported by Validate
+		}
+		if _, err := loadIconFile(file); err != nil {
+			problem := ValidationError{Path: "icons." + formatKey(string(icon)), Message: err.Error() + ", the built-in icon is used instead"}
+			problem.File, problem.Line = c.meta.location(problem.Path)
+			c.meta.warnings = append(c.meta.warnings, problem.Error())
+		}
+	}
+}
+
+// loadIcons loads the configured icon files into the tray, then watches them so that they are reloaded when they
+// change, without reconnecting. The caller must hold a.mu.
+func (a *App) loadIcons() {
+	if err := a.tray.SetCustomIcons(readIconFiles(a.logger, a.config.Icons)); err != nil {
+		a.logger.Error("failed to set tray icons", "error", err)
+	}
+
+	if a.iconWatcher != nil {
+		if err := a.iconWatcher.Close(); err != nil {
+			a.logger.Warn("failed to close icon watcher", "error", err)
+		}
+		a.iconWatcher = nil
+	}
+	if len(a.config.Icons) == 0 {
+		return
+	}
+
+	watcher, err := newFileWatcher(a.logger.With("component", "icon-watcher"), a.onIconChange)
+	if err != nil {
+		a.logger.Warn("failed to watch icons, automatic reload disabled", "error", err)
+		return
+	}
+	a.iconWatcher = watcher
+
+	paths := make([]string, 0, len(a.config.Icons))
+	for _, file := range a.config.Icons {
+		paths = append(paths, file)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		expanded, err := expandConfigPath(path)
+		if err == nil {
+			err = watcher.Watch(expanded)
+		}
+		if err != nil {
+			a.logger.Warn("failed to watch icon, automatic reload disabled", "path", path, "error", err)
+		}
+	}
+}
+
+// onIconChange reloads the icon files after one changed on disk. An icon that no longer loads falls back to the
+// embedded icon until it is fixed.
+func (a *App) onIconChange() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.state.Active() || a.config == nil {
+		return
+	}
+
+	a.logger.Info("icon file changed, reloading icons")
+	if err := a.tray.SetCustomIcons(readIconFiles(a.logger, a.config.Icons)); err != nil {
+		a.logger.Error("failed to set tray icons", "error", err)
+	}
+}
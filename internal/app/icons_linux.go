@@ -0,0 +1,34 @@
+//go:build linux
+
+package app
+
+import (
+	"math"
+	"os"
+	"strconv"
+)
+
+// trayIconSize is the size of tray icons at 100% scaling, as StatusNotifier panels are usually 22 to 24px tall
+const trayIconSize = 24
+
+// encodeTrayIcon encodes an icon for the Linux tray: a single PNG, as StatusNotifier hosts expect, at the size of the
+// panel at the display's scaling. Hosts scale the image to fit, so a larger image stays sharp where a smaller one would
+// blur. ICO files containing bitmap images are given as is, as they are decoded by the host.
+func encodeTrayIcon(set iconSet) []byte {
+	if set.ico != nil {
+		return set.ico
+	}
+	return set.nearest(trayIconSize * displayScale()).data
+}
+
+// displayScale returns the display's scaling as set by GDK_SCALE or QT_SCALE_FACTOR, rounded up. At least 2 is
+// returned, as fractional scaling is often configured without either, and a 2x icon scales down cleanly.
+func displayScale() int {
+	scale := 2.0
+	for _, name := range []string{"GDK_SCALE", "QT_SCALE_FACTOR"} {
+		if value, err := strconv.ParseFloat(os.Getenv(name), 64); err == nil && value > scale && value <= 16 {
+			scale = value
+		}
+	}
+	return int(math.Ceil(scale))
+}
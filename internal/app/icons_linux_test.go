@@ -0,0 +1,55 @@
+//go:build linux
+
+package app
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodeTrayIcon(t *testing.T) {
+	set, err := embeddedIconSet(IconOpen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		gdkScale string
+		qtScale  string
+		want     int
+	}{
+		{"no scaling set", "", "", 48},
+		{"100%", "1", "1", 48},
+		{"fractional", "", "1.25", 48},
+		{"200%", "2", "", 48},
+		{"250%", "", "2.5", 256}, // rounded up to 72px, larger than the 64px image
+		{"300%", "3", "", 256},   // 72px
+		{"largest wins", "3", "2", 256},
+		{"invalid", "two", "", 48},
+		{"out of range", "100", "", 48},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GDK_SCALE", tt.gdkScale)
+			t.Setenv("QT_SCALE_FACTOR", tt.qtScale)
+
+			// A single PNG, as StatusNotifier hosts expect
+			decoded, err := decodeIcon(encodeTrayIcon(set))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if width := decoded.images[0].width; len(decoded.images) != 1 || width != tt.want {
+				t.Errorf("expected the %dpx image, got %d images, the first %dpx", tt.want, len(decoded.images), width)
+			}
+		})
+	}
+}
+
+func TestEncodeTrayIconKeepsBitmapICO(t *testing.T) {
+	set := iconSet{ico: []byte("ICO")}
+	if got := encodeTrayIcon(set); !bytes.Equal(got, set.ico) {
+		t.Error("expected an ICO file of bitmap images to be given to the tray as is")
+	}
+}
@@ -0,0 +1,144 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// testIconSet returns an embedded icon at the given sizes only
+func testIconSet(t *testing.T, sizes ...int) iconSet {
+	t.Helper()
+
+	set, err := embeddedIconSet(IconOpen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var images []iconImage
+	for _, image := range set.images {
+		for _, size := range sizes {
+			if image.width == size {
+				images = append(images, image)
+			}
+		}
+	}
+	return iconSet{images: images}
+}
+
+func TestEmbeddedIconsRoundTrip(t *testing.T) {
+	for _, icon := range iconPriority {
+		t.Run(string(icon), func(t *testing.T) {
+			set, err := embeddedIconSet(icon)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Every source decodes at the size it is named after
+			for i, size := range iconSizes {
+				decoded, err := decodeIcon(set.images[i].data)
+				if err != nil {
+					t.Fatalf("%dpx source: %v", size, err)
+				}
+				if image := decoded.images[0]; image.width != size || image.height != size {
+					t.Errorf("%dpx source is %dx%d", size, image.width, image.height)
+				}
+			}
+
+			decoded, err := decodeIcon(encodeICO(set.images))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded.ico != nil {
+				t.Error("expected an ICO of PNG images to be decoded into its images")
+			}
+			if len(decoded.images) != len(iconSizes) {
+				t.Fatalf("expected %d images, got %d", len(iconSizes), len(decoded.images))
+			}
+			for i, size := range iconSizes {
+				image := decoded.images[i]
+				if image.width != size || image.height != size {
+					t.Errorf("image %d: expected %dx%d, got %dx%d", i, size, size, image.width, image.height)
+				}
+				if !bytes.Equal(image.data, set.images[i].data) {
+					t.Errorf("image %d: PNG data changed by the round trip", i)
+				}
+			}
+		})
+	}
+}
+
+func TestNearestIcon(t *testing.T) {
+	set, err := embeddedIconSet(IconClosed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[int]int{1: 16, 16: 16, 17: 20, 24: 24, 25: 32, 48: 48, 72: 256, 256: 256, 1024: 256}
+	for size, want := range tests {
+		if got := set.nearest(size).width; got != want {
+			t.Errorf("nearest(%d) = %d, expected %d", size, got, want)
+		}
+	}
+}
+
+func TestDecodeBitmapIcon(t *testing.T) {
+	bitmap := make([]byte, bmpInfoHeaderSize+16)
+	binary.LittleEndian.PutUint32(bitmap, bmpInfoHeaderSize)
+	ico := encodeICO([]iconImage{{width: 16, height: 16, data: bitmap}})
+
+	set, err := decodeIcon(ico)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(set.ico, ico) || set.images != nil {
+		t.Errorf("expected an ICO of bitmap images to be kept as is, got %d images", len(set.images))
+	}
+}
+
+func TestDecodeMalformedIcon(t *testing.T) {
+	valid := encodeICO(testIconSet(t, 16, 32).images)
+	png16 := testIconSet(t, 16).images[0].data
+
+	// header returns an ICO header followed by a single entry
+	header := func(icoType, count uint16, entry icoEntry) []byte {
+		var b bytes.Buffer
+		binary.Write(&b, binary.LittleEndian, icoHeader{Type: icoType, Count: count})
+		binary.Write(&b, binary.LittleEndian, entry)
+		return b.Bytes()
+	}
+	entrySize := uint32(binary.Size(icoHeader{}) + binary.Size(icoEntry{}))
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"empty", nil, "not an ICO or PNG file"},
+		{"other format", []byte("GIF89a\x10\x00\x10\x00"), "not an ICO or PNG file"},
+		{"cursor", header(2, 1, icoEntry{}), "not an ICO or PNG file"},
+		{"no images", header(1, 0, icoEntry{})[:6], "ICO file contains no images"},
+		{"truncated entries", header(1, 2, icoEntry{}), "truncated ICO file"},
+		{"image past the end", header(1, 1, icoEntry{Offset: entrySize, Size: 100}), "image 0 extends past the end of the ICO file"},
+		{"offset overflow", header(1, 1, icoEntry{Offset: 0xffffffff, Size: 2}), "image 0 extends past the end of the ICO file"},
+		{"neither PNG nor bitmap", append(header(1, 1, icoEntry{Offset: entrySize, Size: 4}), "junk"...), "image 0 is neither a PNG nor a bitmap"},
+		{"truncated PNG image", append(header(1, 1, icoEntry{Offset: entrySize, Size: 40}), png16[:40]...), "invalid PNG image 0"},
+		{"truncated PNG", png16[:len(png16)/2], "invalid PNG"},
+		{"PNG signature only", pngSignature, "invalid PNG"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeIcon(tt.data); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	// No truncation of a valid ICO file is accepted
+	for n := range len(valid) {
+		if _, err := decodeIcon(valid[:n]); err == nil {
+			t.Fatalf("expected an ICO file truncated to %d of %d bytes to be rejected", n, len(valid))
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build windows
+
+package app
+
+// encodeTrayIcon encodes an icon for the Windows tray: an ICO containing every size, from which Windows picks the image
+// matching the display's scaling (e.g. 16px at 100%, 24px at 150% and 32px at 200%) rather than scaling a single image
+func encodeTrayIcon(set iconSet) []byte {
+	if set.ico != nil {
+		return set.ico
+	}
+	return encodeICO(set.images)
+}
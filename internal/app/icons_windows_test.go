@@ -0,0 +1,21 @@
+//go:build windows
+
+package app
+
+import "testing"
+
+func TestEncodeTrayIcon(t *testing.T) {
+	set, err := embeddedIconSet(IconOpen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Windows picks the image for the display's scaling, so every size is included
+	decoded, err := decodeIcon(encodeTrayIcon(set))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.images) != len(iconSizes) {
+		t.Errorf("expected %d images, got %d", len(iconSizes), len(decoded.images))
+	}
+}
@@ -0,0 +1,323 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	ga "github.com/Xevion/go-ha"
+)
+
+// instance is the connection to a single Home Assistant server, see Config.Servers
+// Each instance connects, fails and reconnects independently of the others.
+type instance struct {
+	name      string
+	logger    *slog.Logger
+	ha        *ga.App         // nil if not connected
+	gateway   *gateway        // forwards the connection through a custom transport, nil if not needed
+	listening map[string]bool // entity IDs with a listener registered on the current connection
+	err       error           // why the instance is unhealthy, nil if connected and every entity is watched
+}
+
+// close closes the instance's connection and gateway, if it has them
+func (i *instance) close() error {
+	var errs []error
+	if i.ha != nil {
+		errs = append(errs, i.ha.Close())
+		i.ha = nil
+	}
+	if i.gateway != nil {
+		errs = append(errs, i.gateway.Close())
+		i.gateway = nil
+	}
+	return errors.Join(errs...)
+}
+
+// closeInstances closes the connection to every server. The caller must hold a.mu.
+func (a *App) closeInstances() error {
+	var errs []error
+	for name, inst := range a.instances {
+		if err := inst.close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close connection to %s: %w", name, err))
+		}
+	}
+	a.instances = make(map[string]*instance)
+
+	return errors.Join(errs...)
+}
+
+const (
+	// seedTimeout is how long seeding an instance's entities is retried after connecting, while the server gets ready
+	seedTimeout = 30 * time.Second
+	// seedRetryDelay is the delay before the first retry of seeding, doubled on each retry up to maxSeedRetryDelay
+	seedRetryDelay    = 250 * time.Millisecond
+	maxSeedRetryDelay = 5 * time.Second
+
+	// reconnectDelay is the delay before reconnecting to a server whose connection was lost or could not be established,
+	// doubled after each failed attempt up to maxReconnectDelay
+	reconnectDelay    = 5 * time.Second
+	maxReconnectDelay = 5 * time.Minute
+)
+
+// connect (re)connects to the named servers concurrently, then settles into running, degraded or failed.
+// A server failing to connect does not affect the others, and is reconnected in the background unless every server
+// failed, see reconnect. The state of each server's entities is seeded in the background once connected, see
+// seedInstance. The caller must hold a.mu.
+func (a *App) connect(names []string) error {
+	if err := a.transition(StateConnecting, nil); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for _, name := range names {
+		if previous, ok := a.instances[name]; ok {
+			if err := previous.close(); err != nil {
+				a.logger.Warn("failed to close previous Home Assistant connection", "server", name, "error", err)
+			}
+		}
+
+		server, _ := a.config.Server(name)
+		inst := &instance{
+			name:   name,
+			logger: a.logger.With("server", name),
+		}
+		a.instances[name] = inst
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			inst.err = a.connectInstance(inst, server)
+			if inst.err != nil {
+				inst.logger.Error("failed to connect to Home Assistant", "error", inst.err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	a.refreshTray()
+	if err := a.settle(); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		inst := a.instances[name]
+		if inst == nil {
+			continue
+		}
+		if inst.ha != nil {
+			go a.seedInstance(inst, inst.ha, a.config.entityIDs(name))
+		} else {
+			go a.reconnect(inst)
+		}
+	}
+	return nil
+}
+
+// connectInstance creates a new Home Assistant connection for a server, then listens to each of its entities. An error
+// is returned if the server could not be connected.
+func (a *App) connectInstance(inst *instance, server ServerConfig) error {
+	apiKey, err := server.ResolveAPIKey()
+	if err != nil {
+		return err
+	}
+
+	url := server.URL
+	if server.customTransport() {
+		if proxy, err := parseProxyURL(server.Proxy); err == nil {
+			inst.logger.Info("connecting through proxy", "proxy", proxy.Redacted())
+		}
+		if server.TLS.Insecure {
+			inst.logger.Warn("TLS certificate verification is DISABLED for this server (tls.insecure), the connection and API key can be intercepted")
+		}
+
+		inst.gateway, err = newGateway(inst.logger, server, apiKey)
+		if err != nil {
+			return err
+		}
+		url, apiKey = inst.gateway.url, inst.gateway.token
+	}
+
+	ha, err := ga.NewApp(ga.NewAppRequest{
+		URL:         url,
+		HAAuthToken: apiKey,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create Home Assistant app: %w", err)
+	}
+	inst.ha = ha
+	inst.listening = make(map[string]bool)
+
+	ids := a.config.entityIDs(inst.name)
+	a.listen(inst, ids)
+
+	go a.run(inst, ha)
+	return nil
+}
+
+// seedInstance fetches the state of an instance's entities and resolves its aggregates, retrying with backoff until
+// seedTimeout as the server may not answer until the connection is ready. It runs without holding a.mu, so that a
+// slow server does not block pausing or reloading, then settles the application once seeding succeeded or gave up.
+func (a *App) seedInstance(inst *instance, ha *ga.App, ids []string) {
+	deadline := time.Now().Add(seedTimeout)
+	delay := seedRetryDelay
+
+	var (
+		members []string
+		err     error
+	)
+	for {
+		st := ha.GetState()
+		members, err = a.resolveAggregates(inst, st)
+		err = errors.Join(a.seed(inst, st, ids), err)
+		if err == nil || time.Now().Add(delay).After(deadline) || !a.connected(inst, ha) {
+			break
+		}
+
+		inst.logger.Debug("failed to seed entities, retrying", "delay", delay, "error", err)
+		time.Sleep(delay)
+		delay = min(delay*2, maxSeedRetryDelay)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.state.Active() || inst.ha != ha || a.instances[inst.name] != inst {
+		return
+	}
+
+	a.listen(inst, members)
+	if err != nil {
+		inst.logger.Error("failed to seed entities", "error", err)
+		inst.err = err
+	}
+	a.refreshTray()
+	if err := a.settle(); err != nil {
+		a.logger.Error("failed to settle after seeding", "server", inst.name, "error", err)
+	}
+}
+
+// connected returns true if the instance still uses the connection, i.e. it was not paused or reconnected since
+func (a *App) connected(inst *instance, ha *ga.App) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return inst.ha == ha && a.instances[inst.name] == inst
+}
+
+// run processes events until the connection closes. If it was not closed intentionally, the application is degraded and
+// the server reconnected in the background, see reconnect.
+func (a *App) run(inst *instance, ha *ga.App) {
+	ha.Start()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Pausing or reconnecting replaces the connection before closing it
+	if inst.ha != ha || a.instances[inst.name] != inst {
+		return
+	}
+
+	inst.err = errors.New("connection to Home Assistant closed")
+	inst.logger.Warn("connection to Home Assistant closed")
+
+	if !a.state.Active() {
+		return
+	}
+	go a.reconnect(inst)
+
+	if a.state != StateRunning {
+		return
+	}
+	if err := a.transition(StateDegraded, fmt.Errorf("%s: %w", inst.name, inst.err)); err != nil {
+		a.logger.Error("failed to degrade after connection closed", "error", err)
+	}
+}
+
+// reconnect reconnects an instance whose connection was lost or could not be established, backing off between
+// attempts, until it succeeds or the instance is replaced by pausing or reloading. The gateway and SSH tunnel are
+// rebuilt along with the connection, so that a tunnel or transport broken with the connection is not reused.
+func (a *App) reconnect(inst *instance) {
+	delay := reconnectDelay
+	for {
+		inst.logger.Info("reconnecting to Home Assistant", "delay", delay)
+		time.Sleep(delay)
+
+		if a.reconnectInstance(inst) {
+			return
+		}
+		delay = min(delay*2, maxReconnectDelay)
+	}
+}
+
+// reconnectInstance makes a single attempt at reconnecting an instance, returning true once there is nothing left to
+// do, i.e. it reconnected or the instance was replaced
+func (a *App) reconnectInstance(inst *instance) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	server, ok := a.config.Server(inst.name)
+	if !a.state.Active() || a.instances[inst.name] != inst || !ok {
+		return true
+	}
+
+	if err := inst.close(); err != nil {
+		inst.logger.Warn("failed to close previous Home Assistant connection", "error", err)
+	}
+	if err := a.connectInstance(inst, server); err != nil {
+		inst.err = err
+		inst.logger.Error("failed to reconnect to Home Assistant", "error", err)
+		return false
+	}
+
+	inst.err = nil
+	inst.logger.Info("reconnected to Home Assistant")
+	go a.seedInstance(inst, inst.ha, a.config.entityIDs(inst.name))
+
+	a.refreshTray()
+	if err := a.settle(); err != nil {
+		a.logger.Error("failed to settle after reconnecting", "server", inst.name, "error", err)
+	}
+	return true
+}
+
+// settle moves the application into running if every server is healthy, degraded if only some are, or failed if none
+// could be connected. The caller must hold a.mu.
+func (a *App) settle() error {
+	names := make([]string, 0, len(a.instances))
+	for name := range a.instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var (
+		errs      []error
+		connected int
+	)
+	for _, name := range names {
+		inst := a.instances[name]
+		if inst.ha != nil {
+			connected++
+		}
+		if inst.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, inst.err))
+		}
+	}
+
+	switch {
+	case connected == 0:
+		return a.fail(errors.Join(errs...))
+	case len(errs) > 0:
+		if a.state == StateDegraded {
+			return nil
+		}
+		return a.transition(StateDegraded, errors.Join(errs...))
+	default:
+		if a.state == StateRunning {
+			return nil
+		}
+		return a.transition(StateRunning, nil)
+	}
+}
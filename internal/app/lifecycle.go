@@ -0,0 +1,217 @@
+package app
+
+import (
+	"fmt"
+	"time"
+)
+
+// AppState represents the current state of the application lifecycle
+type AppState int
+
+const (
+	StateStopped    AppState = iota // not started yet, or stopped for good
+	StateStarting                   // starting the tray and loading configuration
+	StateConnecting                 // connecting to Home Assistant, entity states are seeded in the background
+	StateRunning                    // connected to every server and watching every configured entity
+	StateDegraded                   // connected, but some servers could not be reached or some entities could not be watched
+	StatePausing                    // disconnecting and ceasing background tasks
+	StatePaused                     // disconnected, no background tasks are running
+	StateFailed                     // an error occurred while starting or connecting
+)
+
+// String returns the string representation of the AppState
+func (s AppState) String() string {
+	switch s {
+	case StateStopped:
+		return "stopped"
+	case StateStarting:
+		return "starting"
+	case StateConnecting:
+		return "connecting"
+	case StateRunning:
+		return "running"
+	case StateDegraded:
+		return "degraded"
+	case StatePausing:
+		return "pausing"
+	case StatePaused:
+		return "paused"
+	case StateFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// Active returns true if the application is connected (or connecting) to Home Assistant
+func (s AppState) Active() bool {
+	return s == StateConnecting || s == StateRunning || s == StateDegraded
+}
+
+// transitions lists the states that can be entered from each state
+var transitions = map[AppState][]AppState{
+	StateStopped:    {StateStarting},
+	StateStarting:   {StateConnecting, StateFailed},
+	StateConnecting: {StateRunning, StateDegraded, StateFailed},
+	StateRunning:    {StateConnecting, StateDegraded, StatePausing},
+	StateDegraded:   {StateConnecting, StateRunning, StatePausing, StateFailed},
+	StatePausing:    {StatePaused, StateFailed},
+	StatePaused:     {StateStarting, StateStopped},
+	StateFailed:     {StateStarting, StatePausing, StateStopped},
+}
+
+// CanTransition returns true if the state can move directly into the next state
+func (s AppState) CanTransition(next AppState) bool {
+	for _, allowed := range transitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// TransitionError is returned when a lifecycle operation is not permitted from the current state
+type TransitionError struct {
+	From AppState
+	To   AppState
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("invalid state transition from %s to %s", e.From, e.To)
+}
+
+// Transition describes a change in the application's lifecycle state
+type Transition struct {
+	From AppState
+	To   AppState
+	At   time.Time
+	Err  error // the error that caused the transition, if any (e.g. into Degraded or Failed)
+}
+
+// transitionBuffer is the number of transitions buffered per subscriber before newer transitions are dropped
+const transitionBuffer = 16
+
+// Subscribe returns a channel receiving every subsequent state transition, and a function to cancel the subscription.
+// Subscribers that fall behind have transitions dropped rather than blocking the application.
+// The channel is closed when the subscription is cancelled or the application is stopped.
+func (a *App) Subscribe() (<-chan Transition, func()) {
+	a.subscribersMu.Lock()
+	defer a.subscribersMu.Unlock()
+
+	id := a.nextSubscriber
+	a.nextSubscriber++
+
+	ch := make(chan Transition, transitionBuffer)
+	a.subscribers[id] = ch
+
+	cancel := func() {
+		a.subscribersMu.Lock()
+		defer a.subscribersMu.Unlock()
+
+		if ch, ok := a.subscribers[id]; ok {
+			delete(a.subscribers, id)
+			close(ch)
+		}
+	}
+
+	return ch, cancel
+}
+
+// transition moves the application into the next state and notifies subscribers.
+// cause is the error responsible for the transition, if any. The caller must hold a.mu.
+func (a *App) transition(to AppState, cause error) error {
+	if !a.state.CanTransition(to) {
+		return &TransitionError{From: a.state, To: to}
+	}
+
+	t := Transition{From: a.state, To: to, At: time.Now(), Err: cause}
+	a.state = to
+
+	if cause != nil {
+		a.logger.Warn("state transition", "from", t.From, "to", t.To, "error", cause)
+	} else {
+		a.logger.Info("state transition", "from", t.From, "to", t.To)
+	}
+
+	a.subscribersMu.Lock()
+	defer a.subscribersMu.Unlock()
+
+	for id, ch := range a.subscribers {
+		select {
+		case ch <- t:
+		default:
+			a.logger.Warn("subscriber is not keeping up, dropping transition", "subscriber", id, "to", t.To)
+		}
+	}
+
+	// Stopping is final, so release every subscriber
+	if to == StateStopped {
+		for id, ch := range a.subscribers {
+			delete(a.subscribers, id)
+			close(ch)
+		}
+	}
+
+	return nil
+}
+
+// fail moves the application into the failed state, releasing every connection that was made and stopping the tray,
+// and returns the cause. The caller must hold a.mu.
+func (a *App) fail(cause error) error {
+	if err := a.closeInstances(); err != nil {
+		a.logger.Warn("failed to close home assistant connection", "error", err)
+	}
+
+	a.stopRefresh()
+	if a.tray.Active() {
+		if err := a.tray.Stop(); err != nil {
+			a.logger.Warn("failed to stop tray", "error", err)
+		}
+	}
+
+	if err := a.transition(StateFailed, cause); err != nil {
+		a.logger.Error("failed to enter failed state", "error", err)
+	}
+
+	return cause
+}
+
+// observeLifecycle reflects lifecycle transitions in the tray until the subscription is closed
+func (a *App) observeLifecycle(transitions <-chan Transition) {
+	for t := range transitions {
+		a.reflectTransition(t)
+	}
+}
+
+// reflectTransition sets the tray's status and icon for a transition. Transitions that have since been superseded
+// are skipped, as the tray already reflects a later state.
+func (a *App) reflectTransition(t Transition) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.state != t.To || !a.tray.Active() {
+		return
+	}
+
+	switch t.To {
+	case StateRunning:
+		a.tray.SetStatus(a.tray.Title())
+		a.refreshTray()
+	case StateConnecting:
+		a.tray.SetStatus(transitionStatus(a.tray.Title(), t))
+		a.tray.SetIcon(IconUnknown)
+	case StateDegraded:
+		// Entities of the servers still connected keep their icons, the status line marks the tray as degraded
+		a.tray.SetStatus(transitionStatus(a.tray.Title(), t))
+		a.refreshTray()
+	}
+}
+
+// transitionStatus returns the tooltip's status line for a transition, e.g. "HA Tray (degraded): home: EOF"
+func transitionStatus(title string, t Transition) string {
+	status := fmt.Sprintf("%s (%s)", title, t.To)
+	if t.Err != nil {
+		status = fmt.Sprintf("%s: %v", status, t.Err)
+	}
+	return status
+}
@@ -0,0 +1,188 @@
+package app
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"slices"
+	"testing"
+)
+
+// allStates lists every lifecycle state
+var allStates = []AppState{
+	StateStopped, StateStarting, StateConnecting, StateRunning, StateDegraded, StatePausing, StatePaused, StateFailed,
+}
+
+// lifecycleApp returns an application without a tray, in the given state
+func lifecycleApp(state AppState) *App {
+	a := NewApp(slog.New(slog.NewTextHandler(io.Discard, nil)), "", nil)
+	a.state = state
+	return a
+}
+
+// transitionLocked calls transition holding a.mu, as the application does, returning the resulting state
+func transitionLocked(a *App, to AppState, cause error) (AppState, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	err := a.transition(to, cause)
+	return a.state, err
+}
+
+func TestTransitions(t *testing.T) {
+	allowed := map[AppState][]AppState{
+		StateStopped:    {StateStarting},
+		StateStarting:   {StateConnecting, StateFailed},
+		StateConnecting: {StateRunning, StateDegraded, StateFailed},
+		StateRunning:    {StateConnecting, StateDegraded, StatePausing},
+		StateDegraded:   {StateConnecting, StateRunning, StatePausing, StateFailed},
+		StatePausing:    {StatePaused, StateFailed},
+		StatePaused:     {StateStarting, StateStopped},
+		StateFailed:     {StateStarting, StatePausing, StateStopped},
+	}
+
+	for _, from := range allStates {
+		for _, to := range allStates {
+			want := slices.Contains(allowed[from], to)
+			if got := from.CanTransition(to); got != want {
+				t.Errorf("%s -> %s: expected CanTransition %v, got %v", from, to, want, got)
+			}
+
+			a := lifecycleApp(from)
+			state, err := transitionLocked(a, to, nil)
+			if want {
+				if err != nil || state != to {
+					t.Errorf("%s -> %s: expected the transition to succeed, got %v in %s", from, to, err, state)
+				}
+				continue
+			}
+
+			var transitionErr *TransitionError
+			if !errors.As(err, &transitionErr) || transitionErr.From != from || transitionErr.To != to {
+				t.Errorf("%s -> %s: expected a TransitionError, got %v", from, to, err)
+			}
+			if state != from {
+				t.Errorf("%s -> %s: expected a rejected transition to leave the state unchanged, got %s", from, to, state)
+			}
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	a := lifecycleApp(StateStopped)
+	first, _ := a.Subscribe()
+	cancelled, cancel := a.Subscribe()
+
+	cause := errors.New("office: EOF")
+	steps := []struct {
+		to    AppState
+		cause error
+	}{
+		{StateStarting, nil},
+		{StateConnecting, nil},
+		{StateDegraded, cause},
+		{StateRunning, nil},
+		{StatePausing, nil},
+		{StatePaused, nil},
+		{StateStopped, nil},
+	}
+
+	for i, step := range steps {
+		if i == 2 {
+			cancel()
+		}
+		if _, err := transitionLocked(a, step.to, step.cause); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Rejected transitions are not sent
+	transitionLocked(a, StateRunning, nil)
+
+	from := StateStopped
+	for _, step := range steps {
+		transition, ok := <-first
+		if !ok {
+			t.Fatalf("expected a transition to %s, the channel was closed", step.to)
+		}
+		if transition.From != from || transition.To != step.to || transition.Err != step.cause || transition.At.IsZero() {
+			t.Errorf("expected %s -> %s (%v), got %+v", from, step.to, step.cause, transition)
+		}
+		from = step.to
+	}
+	if _, ok := <-first; ok {
+		t.Error("expected the channel to be closed once stopped")
+	}
+
+	// Only the transitions before the subscription was cancelled are received
+	var received []AppState
+	for transition := range cancelled {
+		received = append(received, transition.To)
+	}
+	if !slices.Equal(received, []AppState{StateStarting, StateConnecting}) {
+		t.Errorf("expected the transitions before cancelling, got %v", received)
+	}
+}
+
+func TestSubscriberFallingBehind(t *testing.T) {
+	a := lifecycleApp(StateStopped)
+	transitions, cancel := a.Subscribe()
+	defer cancel()
+
+	// Transitions beyond the buffer are dropped rather than blocking
+	transitionLocked(a, StateStarting, nil)
+	transitionLocked(a, StateConnecting, nil)
+	for i := 0; i < transitionBuffer; i++ {
+		if i%2 == 0 {
+			transitionLocked(a, StateDegraded, nil)
+		} else {
+			transitionLocked(a, StateRunning, nil)
+		}
+	}
+
+	if len(transitions) != transitionBuffer {
+		t.Errorf("expected %d buffered transitions, got %d", transitionBuffer, len(transitions))
+	}
+	if first := <-transitions; first.To != StateStarting {
+		t.Errorf("expected the oldest transitions to be kept, got %s first", first.To)
+	}
+}
+
+func TestFail(t *testing.T) {
+	cause := errors.New("office: invalid API key")
+
+	for _, from := range []AppState{StateStarting, StateConnecting, StateDegraded, StatePausing} {
+		a := lifecycleApp(from)
+		transitions, cancel := a.Subscribe()
+		a.refreshStop = make(chan struct{})
+		refreshStop := a.refreshStop
+
+		a.mu.Lock()
+		err := a.fail(cause)
+		state := a.state
+		a.mu.Unlock()
+
+		if err != cause {
+			t.Errorf("%s: expected fail to return its cause, got %v", from, err)
+		}
+		if state != StateFailed {
+			t.Errorf("%s: expected the failed state, got %s", from, state)
+		}
+		if transition := <-transitions; transition.From != from || transition.To != StateFailed || transition.Err != cause {
+			t.Errorf("%s: expected a transition to failed with its cause, got %+v", from, transition)
+		}
+		select {
+		case <-refreshStop:
+		default:
+			t.Errorf("%s: expected the refresh loop to be stopped", from)
+		}
+		cancel()
+	}
+
+	// Running cannot fail directly, the state is left unchanged
+	a := lifecycleApp(StateRunning)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.fail(cause); err != cause || a.state != StateRunning {
+		t.Errorf("expected running to be left unchanged, got %v in %s", err, a.state)
+	}
+}
@@ -0,0 +1,297 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// dropInDirName is the name of the directory, next to the main configuration file, holding drop-in files
+const dropInDirName = "config.d"
+
+// configDropIns returns the drop-in files for the main configuration file, i.e. config.d/*.toml, in lexical order
+// A missing drop-in directory is not an error.
+func configDropIns(filename string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(filepath.Dir(filename), dropInDirName, "*.toml"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list config drop-ins: %w", err)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// configLayer is a single configuration file, decoded into a document along with the location of each of its keys
+type configLayer struct {
+	file      string
+	doc       map[string]any
+	locations map[string]int  // line of each indexed key path in the file
+	tables    map[string]bool // indexed key paths defined by [table] or [[array]] headers in the file
+	unknown   []unknownKey
+}
+
+// readConfigLayer reads, migrates and decodes a single configuration file
+// legacy is set if the file may be a legacy file without a 'version' key, see configVersion. The file itself is left
+// unchanged, older formats are only upgraded in memory.
+func readConfigLayer(filename string, legacy bool) (*configLayer, int, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	// Upgrade older configuration formats before decoding, so that renamed or restructured keys are not lost
+	data, migratedFrom, err := migrateConfig(data, legacy)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", filename, err)
+	}
+	src := string(data)
+
+	// Each file is decoded on its own first, so that type errors and unknown keys are reported against the right file
+	md, err := toml.Decode(src, &Config{})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to decode config file %s: %w", filename, err)
+	}
+
+	layer := &configLayer{
+		file:      filename,
+		locations: make(map[string]int),
+		tables:    make(map[string]bool),
+	}
+	if _, err := toml.Decode(src, &layer.doc); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode config file %s: %w", filename, err)
+	}
+
+	for _, found := range scanTOML(src) {
+		layer.locations[found.Path] = found.Line
+		if found.Header {
+			layer.tables[found.Path] = true
+		}
+	}
+
+	lines := tomlKeyLines(src)
+	for _, key := range md.Undecoded() {
+		layer.unknown = append(layer.unknown, unknownKey{key: key, file: filename, line: lookupLine(lines, formatKeys(key))})
+	}
+
+	return layer, migratedFrom, nil
+}
+
+// mergeIdentities identifies the elements of top-level arrays of tables, so that drop-ins replace matching elements
+// rather than appending duplicates. Other arrays are replaced as a whole.
+var mergeIdentities = map[string]func(table map[string]any) string{
+	"server": func(table map[string]any) string {
+		name, _ := table["name"].(string)
+		return name
+	},
+	"entity": func(table map[string]any) string {
+		id, _ := table["id"].(string)
+		server, _ := table["server"].(string)
+		return server + "/" + id
+	},
+	"aggregate": func(table map[string]any) string {
+		name, _ := table["name"].(string)
+		server, _ := table["server"].(string)
+		return server + "/" + name
+	},
+}
+
+// configMerger merges configuration layers in order, tracking which file and line each merged key path came from.
+//   - Tables are merged key by key, recursively
+//   - Servers and aggregates are replaced by name, and entities by ID, or appended if new
+//   - Any other value (including other arrays) replaces the previous value
+type configMerger struct {
+	doc       map[string]any
+	locations map[string]ValueSource
+	tables    map[string]bool
+}
+
+func newConfigMerger() *configMerger {
+	return &configMerger{
+		doc:       make(map[string]any),
+		locations: make(map[string]ValueSource),
+		tables:    make(map[string]bool),
+	}
+}
+
+// merge merges a layer over the layers merged so far
+func (m *configMerger) merge(layer *configLayer) {
+	m.mergeTable(layer, m.doc, layer.doc, "", "")
+}
+
+// mergeTable merges the src table (at srcPath in the layer) into the dst table (at dstPath in the merged document)
+func (m *configMerger) mergeTable(layer *configLayer, dst, src map[string]any, dstPath, srcPath string) {
+	keys := make([]string, 0, len(src))
+	for key := range src {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := src[key]
+		dstKey, srcKey := joinPath(dstPath, formatKey(key)), joinPath(srcPath, formatKey(key))
+
+		if table, ok := value.(map[string]any); ok {
+			if existing, ok := dst[key].(map[string]any); ok {
+				m.copyLocation(layer, srcKey, dstKey)
+				m.mergeTable(layer, existing, table, dstKey, srcKey)
+				continue
+			}
+		}
+
+		if identity, ok := mergeIdentities[key]; ok && dstPath == "" {
+			tables, isArray := tableArray(value)
+			existing, hasExisting := tableArray(dst[key])
+			if isArray && hasExisting {
+				dst[key] = m.mergeArray(layer, existing, tables, dstKey, srcKey, identity)
+				continue
+			}
+		}
+
+		m.forget(dstKey)
+		dst[key] = value
+		m.copySubtree(layer, srcKey, dstKey)
+	}
+}
+
+// mergeArray merges an array of tables by identity, replacing matching elements and appending the rest
+func (m *configMerger) mergeArray(layer *configLayer, dst, src []map[string]any, dstPath, srcPath string, identity func(map[string]any) string) []map[string]any {
+	for i, table := range src {
+		index := -1
+		for j, existing := range dst {
+			if identity(existing) == identity(table) {
+				index = j
+				break
+			}
+		}
+
+		if index == -1 {
+			index = len(dst)
+			dst = append(dst, table)
+		} else {
+			dst[index] = table
+		}
+
+		dstElement := fmt.Sprintf("%s[%d]", dstPath, index)
+		m.forget(dstElement)
+		m.copySubtree(layer, fmt.Sprintf("%s[%d]", srcPath, i), dstElement)
+	}
+	return dst
+}
+
+// copyLocation records the location of a single key path from the layer, if it has one
+func (m *configMerger) copyLocation(layer *configLayer, srcPath, dstPath string) {
+	if line, ok := layer.locations[srcPath]; ok {
+		m.locations[dstPath] = ValueSource{Kind: SourceFile, Name: layer.file, Line: line}
+	}
+	if layer.tables[srcPath] {
+		m.tables[dstPath] = true
+	}
+}
+
+// copySubtree records the location of a key path from the layer and every key path within it
+func (m *configMerger) copySubtree(layer *configLayer, srcPath, dstPath string) {
+	for path, line := range layer.locations {
+		if rest, ok := withinPath(path, srcPath); ok {
+			m.locations[dstPath+rest] = ValueSource{Kind: SourceFile, Name: layer.file, Line: line}
+		}
+	}
+	for path := range layer.tables {
+		if rest, ok := withinPath(path, srcPath); ok {
+			m.tables[dstPath+rest] = true
+		}
+	}
+}
+
+// forget removes the recorded location of a key path and every key path within it, as it is being replaced
+func (m *configMerger) forget(path string) {
+	for p := range m.locations {
+		if _, ok := withinPath(p, path); ok {
+			delete(m.locations, p)
+		}
+	}
+	for p := range m.tables {
+		if _, ok := withinPath(p, path); ok {
+			delete(m.tables, p)
+		}
+	}
+}
+
+// decode decodes the merged document into the configuration
+func (m *configMerger) decode(config *Config) error {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(m.doc); err != nil {
+		return fmt.Errorf("failed to encode merged config: %w", err)
+	}
+	if _, err := toml.Decode(buf.String(), config); err != nil {
+		return fmt.Errorf("failed to decode merged config: %w", err)
+	}
+	return nil
+}
+
+// withinPath returns the remainder of path after prefix if path is prefix itself or a key path within it
+func withinPath(path, prefix string) (string, bool) {
+	rest, ok := strings.CutPrefix(path, prefix)
+	if !ok || (rest != "" && !strings.HasPrefix(rest, ".") && !strings.HasPrefix(rest, "[")) {
+		return "", false
+	}
+	return rest, true
+}
+
+// tableArray returns value as an array of tables, whether it was written as [[array]] headers or inline
+func tableArray(value any) ([]map[string]any, bool) {
+	switch v := value.(type) {
+	case []map[string]any:
+		return v, true
+	case []any:
+		tables := make([]map[string]any, 0, len(v))
+		for _, element := range v {
+			table, ok := element.(map[string]any)
+			if !ok {
+				return nil, false
+			}
+			tables = append(tables, table)
+		}
+		return tables, true
+	}
+	return nil, false
+}
+
+// load reads the main configuration file, then merges each of its drop-ins over it in lexical order
+func (c *Config) load() error {
+	dropIns, err := configDropIns(c.meta.file)
+	if err != nil {
+		return err
+	}
+
+	merger := newConfigMerger()
+	for i, file := range append([]string{c.meta.file}, dropIns...) {
+		// Drop-ins were introduced after versioning, so are assumed to be current unless they say otherwise
+		layer, migratedFrom, err := readConfigLayer(file, i == 0)
+		if err != nil {
+			return err
+		}
+
+		if i == 0 {
+			c.meta.version = migratedFrom
+		}
+		if migratedFrom != CurrentConfigVersion {
+			c.meta.warnings = append(c.meta.warnings, fmt.Sprintf("%s uses config version %d and was upgraded in memory, it is saved as version %d the next time it is edited with 'HATray config set'", file, migratedFrom, CurrentConfigVersion))
+		}
+
+		merger.merge(layer)
+		c.meta.unknown = append(c.meta.unknown, layer.unknown...)
+	}
+
+	if err := merger.decode(c); err != nil {
+		return err
+	}
+
+	c.meta.dropIns = dropIns
+	c.meta.locations = merger.locations
+	c.meta.tables = merger.tables
+	return nil
+}
@@ -0,0 +1,161 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeDropIn writes a drop-in file next to the main configuration file, returning its path
+func writeDropIn(t *testing.T, config, name, content string) string {
+	t.Helper()
+	dir := filepath.Join(filepath.Dir(config), dropInDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMergeDropIns(t *testing.T) {
+	path := writeConfig(t, `version = 3
+
+[[server]]
+name = "home"
+url = "https://home.local:8123"
+api_key = "home-token"
+
+[[server]]
+name = "office"
+url = "https://office.local:8123"
+api_key = "office-token"
+
+[[entity]]
+server = "home"
+id = "binary_sensor.front_door"
+label = "Front"
+
+[[aggregate]]
+server = "home"
+name = "Doors"
+domain = "binary_sensor"
+`)
+	// Written out of order, to check that drop-ins are merged in lexical order rather than creation order
+	late := writeDropIn(t, path, "20-laptop.toml", `[[server]]
+name = "home"
+url = "https://laptop.local:8123"
+api_key = "laptop-token"
+`)
+	early := writeDropIn(t, path, "10-shared.toml", `[[server]]
+name = "home"
+url = "https://shared.local:8123"
+api_key = "shared-token"
+
+[[entity]]
+server = "home"
+id = "binary_sensor.front_door"
+label = "Front Door"
+
+[[entity]]
+server = "office"
+id = "binary_sensor.front_door"
+
+[[aggregate]]
+server = "home"
+name = "Doors"
+domain = "cover"
+
+[[aggregate]]
+server = "office"
+name = "Doors"
+domain = "binary_sensor"
+`)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if files := config.Files(); len(files) != 3 || files[1] != early || files[2] != late {
+		t.Errorf("expected drop-ins in lexical order, got %v", files)
+	}
+
+	// Servers are replaced by name, the last drop-in winning
+	if len(config.Servers) != 2 {
+		t.Fatalf("expected 2 servers, got %d", len(config.Servers))
+	}
+	if home := config.Servers[0]; home.Name != "home" || home.URL != "https://laptop.local:8123" || home.APIKey != "laptop-token" {
+		t.Errorf("expected the home server to be replaced by the last drop-in, got %+v", home)
+	}
+	if office := config.Servers[1]; office.URL != "https://office.local:8123" {
+		t.Errorf("expected the office server to be kept, got %+v", office)
+	}
+
+	// Entities are replaced by server and ID, so the same ID on another server is appended
+	if len(config.Entities) != 2 {
+		t.Fatalf("expected 2 entities, got %+v", config.Entities)
+	}
+	if entity := config.Entities[0]; entity.key() != "home/binary_sensor.front_door" || entity.Label != "Front Door" {
+		t.Errorf("expected the home entity to be replaced, got %+v", entity)
+	}
+	if entity := config.Entities[1]; entity.key() != "office/binary_sensor.front_door" {
+		t.Errorf("expected the office entity to be appended, got %+v", entity)
+	}
+
+	// Aggregates are replaced by server and name
+	if len(config.Aggregates) != 2 {
+		t.Fatalf("expected 2 aggregates, got %+v", config.Aggregates)
+	}
+	if aggregate := config.Aggregates[0]; aggregate.key() != "home/Doors" || aggregate.Domain != "cover" {
+		t.Errorf("expected the home aggregate to be replaced, got %+v", aggregate)
+	}
+	if aggregate := config.Aggregates[1]; aggregate.key() != "office/Doors" {
+		t.Errorf("expected the office aggregate to be appended, got %+v", aggregate)
+	}
+
+	// Each value is recorded as coming from the file that last set it
+	sources := []struct {
+		path string
+		want ValueSource
+	}{
+		{"server[0].url", ValueSource{Kind: SourceFile, Name: late, Line: 3}},
+		{"server[1].url", ValueSource{Kind: SourceFile, Name: path, Line: 10}},
+		{"entity[0].label", ValueSource{Kind: SourceFile, Name: early, Line: 9}},
+		{"entity[1].id", ValueSource{Kind: SourceFile, Name: early, Line: 13}},
+		{"aggregate[0].domain", ValueSource{Kind: SourceFile, Name: early, Line: 18}},
+		{"version", ValueSource{Kind: SourceFile, Name: path, Line: 1}},
+	}
+	for _, s := range sources {
+		if got := config.meta.source(s.path); got != s.want {
+			t.Errorf("%s: expected source %v, got %v", s.path, s.want, got)
+		}
+	}
+}
+
+func TestMergeReplacesOtherArrays(t *testing.T) {
+	path := writeConfig(t, `version = 3
+
+[[server]]
+url = "https://home.local:8123"
+api_key = "token"
+
+[[aggregate]]
+name = "Doors"
+entities = ["binary_sensor.front_door", "binary_sensor.back_door"]
+`)
+	writeDropIn(t, path, "10-doors.toml", `[[aggregate]]
+name = "Doors"
+entities = ["binary_sensor.garage_door"]
+`)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entities := config.Aggregates[0].Entities; len(entities) != 1 || entities[0] != "binary_sensor.garage_door" {
+		t.Errorf("expected the entities array to be replaced, got %v", entities)
+	}
+}
@@ -0,0 +1,192 @@
+package app
+
+import (
+	"fmt"
+
+	"github.com/BurntSushi/toml"
+)
+
+// CurrentConfigVersion is the version of the configuration format written by SaveConfig
+const CurrentConfigVersion = 3
+
+// legacyConfigVersion is the version of configuration files without a 'version' key, written before versioning existed
+const legacyConfigVersion = 1
+
+// legacyKeys are the top-level keys of legacy configuration files, holding the single server's API key. Together with
+// a top-level server address, they tell a legacy file apart from a current one written without a 'version' key.
+var legacyKeys = []string{"api_key", "api_key_encrypted", "api_key_file", "api_key_command"}
+
+// configMigration upgrades a configuration document by a single version
+type configMigration struct {
+	description string
+	// migrate edits the document in place through the editor, so that its comments and layout are kept. doc is the
+	// document as decoded before the migration.
+	migrate func(doc map[string]any, editor *configEditor) error
+}
+
+// configMigrations holds every migration, keyed by the version it upgrades from (i.e. 1 upgrades version 1 to 2).
+// Every version below CurrentConfigVersion must have a migration; migrations must never be removed or changed once
+// released, as older configuration files rely on each step.
+var configMigrations = map[int]configMigration{
+	1: {
+		description: "watch the previously hardcoded entity when no entities are configured",
+		migrate: func(doc map[string]any, editor *configEditor) error {
+			if _, ok := doc["entity"]; ok {
+				return nil
+			}
+			return editor.Set(keyPath("entity", 0, "id"), "binary_sensor.bedroom_door_opening")
+		},
+	},
+	2: {
+		description: "move the server address and API key into a [[server]] profile",
+		migrate: func(doc map[string]any, editor *configEditor) error {
+			url, hasURL := doc["server"].(string)
+			var keys []string
+			for _, key := range legacyKeys {
+				if _, ok := doc[key]; ok {
+					keys = append(keys, key)
+				}
+			}
+			if !hasURL && len(keys) == 0 {
+				return nil
+			}
+
+			for _, key := range append([]string{"server"}, keys...) {
+				if _, ok := doc[key]; ok {
+					if err := editor.Unset(keyPath(key)); err != nil {
+						return err
+					}
+				}
+			}
+
+			if err := editor.Set(keyPath("server", 0, "name"), defaultServerName); err != nil {
+				return err
+			}
+			if hasURL {
+				if err := editor.Set(keyPath("server", 0, "url"), url); err != nil {
+					return err
+				}
+			}
+			for _, key := range keys {
+				if err := editor.Set(keyPath("server", 0, key), doc[key]); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+}
+
+// keyPath builds path parts from keys and array indices, e.g. keyPath("server", 0, "url") is server[0].url
+func keyPath(elements ...any) []pathPart {
+	parts := make([]pathPart, 0, len(elements))
+	for _, element := range elements {
+		switch e := element.(type) {
+		case int:
+			parts = append(parts, pathPart{index: e})
+		case string:
+			parts = append(parts, pathPart{key: e, index: -1})
+		}
+	}
+	return parts
+}
+
+// isLegacyLayout returns true if a document has the layout of a legacy configuration file, i.e. a top-level server
+// address or API key rather than [[server]] profiles
+func isLegacyLayout(doc map[string]any) bool {
+	if _, ok := doc["server"].(string); ok {
+		return true
+	}
+	for _, key := range legacyKeys {
+		if _, ok := doc[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// configVersion returns the version of a decoded configuration document. Documents without a 'version' key are
+// legacyConfigVersion if legacy is set and they have the legacy layout, and CurrentConfigVersion otherwise, as a
+// current configuration written by hand may leave the version out.
+func configVersion(doc map[string]any, legacy bool) (int, error) {
+	value, ok := doc["version"]
+	if !ok {
+		if legacy && isLegacyLayout(doc) {
+			return legacyConfigVersion, nil
+		}
+		return CurrentConfigVersion, nil
+	}
+
+	version, ok := value.(int64)
+	if !ok || version < legacyConfigVersion {
+		return 0, fmt.Errorf("invalid config version: %v", value)
+	}
+	return int(version), nil
+}
+
+// migrateConfig upgrades a configuration document to CurrentConfigVersion one version at a time, in memory, keeping
+// its comments and layout. legacy is set for the main configuration file, which may be a legacy file without a
+// 'version' key (see configVersion). The upgraded document is returned along with the version it was upgraded from,
+// which is CurrentConfigVersion if no migration was necessary.
+func migrateConfig(data []byte, legacy bool) ([]byte, int, error) {
+	var doc map[string]any
+	if _, err := toml.Decode(string(data), &doc); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode config file: %w", err)
+	}
+
+	from, err := configVersion(doc, legacy)
+	if err != nil {
+		return nil, 0, err
+	}
+	if from > CurrentConfigVersion {
+		return nil, 0, fmt.Errorf("config version %d is newer than the latest supported version %d, HATray must be upgraded", from, CurrentConfigVersion)
+	}
+	if from == CurrentConfigVersion {
+		return data, from, nil
+	}
+
+	editor := newConfigEditor(string(data))
+	for version := from; version < CurrentConfigVersion; version++ {
+		migration, ok := configMigrations[version]
+		if !ok {
+			return nil, 0, fmt.Errorf("no migration from config version %d", version)
+		}
+
+		// Each migration is given the document as left by the previous one
+		doc = nil
+		if _, err := toml.Decode(editor.String(), &doc); err != nil {
+			return nil, 0, fmt.Errorf("failed to decode config before migrating from version %d: %w", version, err)
+		}
+		if err := migration.migrate(doc, editor); err != nil {
+			return nil, 0, fmt.Errorf("failed to migrate config from version %d (%s): %w", version, migration.description, err)
+		}
+	}
+	if err := editor.Set(keyPath("version"), CurrentConfigVersion); err != nil {
+		return nil, 0, fmt.Errorf("failed to migrate config: %w", err)
+	}
+
+	migrated := editor.String()
+	if _, err := toml.Decode(migrated, &doc); err != nil {
+		return nil, 0, fmt.Errorf("migration produced an invalid config file: %w", err)
+	}
+	return []byte(migrated), from, nil
+}
+
+// migrateConfigFile upgrades a configuration file in place if necessary, keeping the original as <filename>.bak
+// The (possibly upgraded) contents are returned along with the version the file was upgraded from. Files are only
+// upgraded on disk when they are edited, see editConfigFile; loading a configuration upgrades it in memory.
+func migrateConfigFile(filename string, data []byte, legacy bool) ([]byte, int, error) {
+	migrated, from, err := migrateConfig(data, legacy)
+	if err != nil || from == CurrentConfigVersion {
+		return migrated, from, err
+	}
+
+	if err := writeFileAtomic(filename+".bak", data, 0600); err != nil {
+		return nil, 0, fmt.Errorf("failed to back up config file before migrating: %w", err)
+	}
+	if err := writeFileAtomic(filename, migrated, 0600); err != nil {
+		return nil, 0, fmt.Errorf("failed to write migrated config file: %w", err)
+	}
+
+	return migrated, from, nil
+}
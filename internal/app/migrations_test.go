@@ -0,0 +1,179 @@
+package app
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+// legacyConfig is a configuration file written before versioning existed
+const legacyConfig = `# Home Assistant
+server = "https://homeassistant.local:8123"
+api_key = "token" # long-lived access token
+`
+
+func TestMigrationWatchesHardcodedEntity(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{"no entities", `server = "https://ha.local"`, []string{"binary_sensor.bedroom_door_opening"}},
+		{"entities configured", "server = \"https://ha.local\"\n\n[[entity]]\nid = \"light.desk\"\n", []string{"light.desk"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := migrateStep(t, 1, tt.src)
+
+			entities, _ := doc["entity"].([]map[string]any)
+			var ids []string
+			for _, entity := range entities {
+				ids = append(ids, entity["id"].(string))
+			}
+			if strings.Join(ids, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("expected entities %v, got %v", tt.want, ids)
+			}
+		})
+	}
+}
+
+func TestMigrationMovesServerIntoProfile(t *testing.T) {
+	doc := migrateStep(t, 2, legacyConfig)
+
+	if _, ok := doc["api_key"]; ok {
+		t.Error("expected the top-level api_key to be removed")
+	}
+	servers, _ := doc["server"].([]map[string]any)
+	if len(servers) != 1 {
+		t.Fatalf("expected a single [[server]], got %v", doc["server"])
+	}
+	want := map[string]any{"name": defaultServerName, "url": "https://homeassistant.local:8123", "api_key": "token"}
+	for key, value := range want {
+		if servers[0][key] != value {
+			t.Errorf("expected server.%s = %v, got %v", key, value, servers[0][key])
+		}
+	}
+
+	// Documents without a server address or API key are left alone
+	if doc := migrateStep(t, 2, "[[entity]]\nid = \"light.desk\"\n"); doc["server"] != nil {
+		t.Errorf("expected no server to be added, got %v", doc["server"])
+	}
+}
+
+// migrateStep applies a single migration to src, returning the migrated document
+func migrateStep(t *testing.T, version int, src string) map[string]any {
+	t.Helper()
+	var doc map[string]any
+	if _, err := toml.Decode(src, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	editor := newConfigEditor(src)
+	if err := configMigrations[version].migrate(doc, editor); err != nil {
+		t.Fatalf("migration %d failed: %v", version, err)
+	}
+
+	var migrated map[string]any
+	if _, err := toml.Decode(editor.String(), &migrated); err != nil {
+		t.Fatalf("migration %d produced invalid TOML: %v\n%s", version, err, editor.String())
+	}
+	return migrated
+}
+
+func TestMigrateConfigKeepsComments(t *testing.T) {
+	migrated, from, err := migrateConfig([]byte(legacyConfig), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != legacyConfigVersion {
+		t.Errorf("expected to migrate from version %d, got %d", legacyConfigVersion, from)
+	}
+
+	src := string(migrated)
+	for _, want := range []string{"# Home Assistant", "version = 3", "[[server]]", "[[entity]]"} {
+		if !strings.Contains(src, want) {
+			t.Errorf("expected the migrated config to contain %q:\n%s", want, src)
+		}
+	}
+
+	var config Config
+	if _, err := toml.Decode(src, &config); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Servers) != 1 || config.Servers[0].APIKey != "token" || len(config.Entities) != 1 {
+		t.Errorf("unexpected migrated config: %+v", config)
+	}
+}
+
+func TestConfigVersion(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		legacy bool
+		want   int
+	}{
+		{"versioned", "version = 2\nserver = \"https://ha.local\"", true, 2},
+		{"legacy server", `server = "https://ha.local"`, true, legacyConfigVersion},
+		{"legacy api_key", `api_key = "token"`, true, legacyConfigVersion},
+		{"current without version", "[[server]]\nurl = \"https://ha.local\"\n\n[[aggregate]]\nname = \"Doors\"", true, CurrentConfigVersion},
+		{"drop-in with legacy keys", `api_key = "token"`, false, CurrentConfigVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var doc map[string]any
+			if _, err := toml.Decode(tt.src, &doc); err != nil {
+				t.Fatal(err)
+			}
+			got, err := configVersion(doc, tt.legacy)
+			if err != nil || got != tt.want {
+				t.Errorf("expected version %d, got %d (%v)", tt.want, got, err)
+			}
+		})
+	}
+
+	if _, _, err := migrateConfig([]byte("version = 99"), true); err == nil {
+		t.Error("expected a newer version to be rejected")
+	}
+}
+
+func TestLoadConfigDoesNotRewriteFile(t *testing.T) {
+	for name, src := range map[string]string{
+		"legacy":  legacyConfig,
+		"current": "# Doors\n[[server]]\nurl = \"https://ha.local\"\napi_key = \"token\"\n\n[[aggregate]]\nname = \"Doors\"\ndomain = \"binary_sensor\"\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := writeConfig(t, src)
+			config, err := LoadConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if data, _ := os.ReadFile(path); string(data) != src {
+				t.Errorf("expected the file to be left unchanged, got:\n%s", data)
+			}
+			if _, err := os.Stat(path + ".bak"); err == nil {
+				t.Error("expected no backup to be written")
+			}
+			if name == "current" && len(config.Entities) != 0 {
+				t.Errorf("expected no entities to be added, got %v", config.Entities)
+			}
+		})
+	}
+}
+
+func TestEditMigratesFile(t *testing.T) {
+	path := writeConfig(t, legacyConfig)
+	if err := SetConfigValue(path, "entity[0].label", "Bedroom"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if !strings.Contains(string(data), "# Home Assistant") || !strings.Contains(string(data), "label = \"Bedroom\"") {
+		t.Errorf("expected the migrated file to keep its comments and the edit:\n%s", data)
+	}
+	if backup, _ := os.ReadFile(path + ".bak"); string(backup) != legacyConfig {
+		t.Errorf("expected the original to be kept as a backup, got:\n%s", backup)
+	}
+}
@@ -0,0 +1,169 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// probeTimeout is how long ProbeServer may take to connect, authenticate and list entities
+const probeTimeout = 15 * time.Second
+
+// ServerProbe describes a Home Assistant server, as seen by ProbeServer
+type ServerProbe struct {
+	Version  string         // Home Assistant version reported during authentication
+	Entities []ProbedEntity // every entity on the server, ordered by ID
+}
+
+// ProbedEntity is a single entity listed by ProbeServer
+type ProbedEntity struct {
+	ID    string
+	Name  string // friendly name, empty if the entity does not have one
+	State string
+}
+
+// probeMessage is the subset of Home Assistant websocket API messages used by ProbeServer
+type probeMessage struct {
+	ID          int    `json:"id,omitempty"`
+	Type        string `json:"type"`
+	AccessToken string `json:"access_token,omitempty"`
+	Version     string `json:"ha_version,omitempty"`
+	Message     string `json:"message,omitempty"`
+	Success     bool   `json:"success,omitempty"`
+	Result      []struct {
+		EntityID   string `json:"entity_id"`
+		State      string `json:"state"`
+		Attributes struct {
+			FriendlyName string `json:"friendly_name"`
+		} `json:"attributes"`
+	} `json:"result,omitempty"`
+	Error *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// ProbeServer connects to a Home Assistant server, performs the websocket authentication handshake, and lists every
+// entity on it. It is used to verify a server's address, API key and transport options before they are saved.
+func ProbeServer(ctx context.Context, server ServerConfig) (*ServerProbe, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	endpoint, err := websocketURL(server.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	apiKey, err := server.ResolveAPIKey()
+	if err != nil {
+		return nil, err
+	}
+
+	// Connect the same way as the application does, so that the transport options are verified too
+	dial := endpoint
+	if server.customTransport() {
+		gateway, err := newGateway(slog.New(slog.NewTextHandler(io.Discard, nil)), server, apiKey)
+		if err != nil {
+			return nil, err
+		}
+		defer gateway.Close()
+		apiKey = gateway.token
+
+		if dial, err = websocketURL(gateway.url); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, response, err := websocket.DefaultDialer.DialContext(ctx, dial, nil)
+	if err != nil {
+		// The gateway reports why it could not reach the server in the response body
+		if response != nil && response.StatusCode == http.StatusBadGateway {
+			body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+			err = errors.New(strings.TrimSpace(string(body)))
+		}
+		return nil, fmt.Errorf("failed to connect to %s: %w", endpoint, err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+		conn.SetWriteDeadline(deadline)
+	}
+
+	// auth_required -> auth -> auth_ok (or auth_invalid)
+	var message probeMessage
+	if err := conn.ReadJSON(&message); err != nil {
+		return nil, fmt.Errorf("failed to read from %s: %w", endpoint, err)
+	}
+	if message.Type != "auth_required" {
+		return nil, fmt.Errorf("unexpected %q message from %s, is this a Home Assistant server?", message.Type, endpoint)
+	}
+
+	if err := conn.WriteJSON(probeMessage{Type: "auth", AccessToken: apiKey}); err != nil {
+		return nil, fmt.Errorf("failed to authenticate: %w", err)
+	}
+	message = probeMessage{}
+	if err := conn.ReadJSON(&message); err != nil {
+		return nil, fmt.Errorf("failed to authenticate: %w", err)
+	}
+	switch message.Type {
+	case "auth_ok":
+	case "auth_invalid":
+		return nil, fmt.Errorf("authentication failed: %s", message.Message)
+	default:
+		return nil, fmt.Errorf("authentication failed: unexpected %q message", message.Type)
+	}
+
+	probe := &ServerProbe{Version: message.Version}
+
+	if err := conn.WriteJSON(probeMessage{ID: 1, Type: "get_states"}); err != nil {
+		return nil, fmt.Errorf("failed to list entities: %w", err)
+	}
+	message = probeMessage{}
+	if err := conn.ReadJSON(&message); err != nil {
+		return nil, fmt.Errorf("failed to list entities: %w", err)
+	}
+	if !message.Success {
+		if message.Error != nil {
+			return nil, fmt.Errorf("failed to list entities: %s", message.Error.Message)
+		}
+		return nil, errors.New("failed to list entities")
+	}
+
+	for _, state := range message.Result {
+		probe.Entities = append(probe.Entities, ProbedEntity{
+			ID:    state.EntityID,
+			Name:  state.Attributes.FriendlyName,
+			State: state.State,
+		})
+	}
+	sort.Slice(probe.Entities, func(i, j int) bool { return probe.Entities[i].ID < probe.Entities[j].ID })
+
+	return probe, nil
+}
+
+// websocketURL returns the websocket API endpoint of a Home Assistant server, e.g. wss://host:8123/api/websocket
+func websocketURL(server string) (string, error) {
+	if err := ValidateServerURL(server); err != nil {
+		return "", err
+	}
+
+	u, _ := url.Parse(server)
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/websocket"
+
+	return u.String(), nil
+}
@@ -0,0 +1,287 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	// renderSamples is how many samples are taken along each axis of a pixel, anti-aliasing the edges of glyphs
+	renderSamples = 4
+	// maxIconText is how many characters of text fit over a rendered icon
+	maxIconText = 3
+	// maxRenderCache is how many rendered icons are kept, the cache is cleared when it is exceeded
+	maxRenderCache = 256
+)
+
+// renderSizes are the sizes icons are rendered at, see encodeTrayIcon. Text does not fit legibly in fewer than 32px, so
+// smaller sizes are left to the tray to scale down.
+var renderSizes = []int{32, 64}
+
+// Glyph is the base shape of a rendered icon
+type Glyph string
+
+const (
+	GlyphCircle Glyph = "circle"
+	GlyphSquare Glyph = "square" // with rounded corners
+	GlyphRing   Glyph = "ring"   // circle outline, the text is drawn in the fill color
+)
+
+// Valid returns true if the glyph is one of the known glyphs
+func (g Glyph) Valid() bool {
+	switch g {
+	case GlyphCircle, GlyphSquare, GlyphRing:
+		return true
+	default:
+		return false
+	}
+}
+
+// iconColors are the fill colors of rendered icons, matching the embedded icons
+var iconColors = map[IconReference]color.NRGBA{
+	IconOpen:     {0xD8, 0x1E, 0x20, 0xFF},
+	IconClosed:   {0x1E, 0xD8, 0x60, 0xFF},
+	IconUnknown:  {0x5C, 0x5C, 0x5C, 0xFF},
+	IconWarning:  {0xF5, 0x9E, 0x0B, 0xFF},
+	IconCritical: {0xA8, 0x2B, 0xD6, 0xFF},
+}
+
+// namedColors may be used in place of hex colors, e.g. for badges
+var namedColors = map[string]color.NRGBA{
+	"red":    iconColors[IconOpen],
+	"green":  iconColors[IconClosed],
+	"grey":   iconColors[IconUnknown],
+	"gray":   iconColors[IconUnknown],
+	"orange": iconColors[IconWarning],
+	"purple": iconColors[IconCritical],
+	"yellow": {0xFA, 0xCC, 0x15, 0xFF},
+	"blue":   {0x25, 0x63, 0xEB, 0xFF},
+	"white":  {0xFF, 0xFF, 0xFF, 0xFF},
+	"black":  {0x00, 0x00, 0x00, 0xFF},
+}
+
+// parseColor parses a color name (see namedColors) or a hex color, e.g. #f59e0b or #fa0
+func parseColor(value string) (color.NRGBA, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if named, ok := namedColors[value]; ok {
+		return named, nil
+	}
+
+	hex, ok := strings.CutPrefix(value, "#")
+	if ok && len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	rgb, err := strconv.ParseUint(hex, 16, 32)
+	if !ok || len(hex) != 6 || err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q, expected a name (e.g. red) or hex color (e.g. #f59e0b)", value)
+	}
+	return color.NRGBA{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb), A: 0xFF}, nil
+}
+
+// iconSpec describes an icon rendered at runtime
+type iconSpec struct {
+	glyph Glyph
+	fill  color.NRGBA
+	badge color.NRGBA // drawn in the top right corner, none if transparent
+	text  string      // at most maxIconText characters drawn over the glyph, e.g. 21 or 3
+}
+
+// key identifies the rendered icon in the cache
+func (s iconSpec) key() string {
+	return fmt.Sprintf("%s/%02x%02x%02x%02x/%02x%02x%02x%02x/%s", s.glyph,
+		s.fill.R, s.fill.G, s.fill.B, s.fill.A, s.badge.R, s.badge.G, s.badge.B, s.badge.A, s.text)
+}
+
+// iconRenderer renders icons, caching the results so that setting the same icon repeatedly is cheap
+type iconRenderer struct {
+	mu    sync.Mutex
+	cache map[string][]byte // encoded for the platform by iconSpec.key, see encodeTrayIcon
+}
+
+func newIconRenderer() *iconRenderer {
+	return &iconRenderer{cache: make(map[string][]byte)}
+}
+
+// Render returns the icon encoded for the platform, rendering it if it is not cached
+func (r *iconRenderer) Render(spec iconSpec) ([]byte, error) {
+	key := spec.key()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if data, ok := r.cache[key]; ok {
+		return data, nil
+	}
+
+	var set iconSet
+	for _, size := range renderSizes {
+		var b bytes.Buffer
+		if err := png.Encode(&b, renderIcon(spec, size)); err != nil {
+			return nil, fmt.Errorf("failed to encode icon: %w", err)
+		}
+		set.images = append(set.images, iconImage{width: size, height: size, data: b.Bytes()})
+	}
+	data := encodeTrayIcon(set)
+
+	// Values such as temperatures render many distinct icons over time, so the cache is bounded
+	if len(r.cache) >= maxRenderCache {
+		clear(r.cache)
+	}
+	r.cache[key] = data
+	return data, nil
+}
+
+// renderIcon draws the glyph, then the badge, then the text
+func renderIcon(spec iconSpec, size int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	center := float64(size) / 2
+
+	// Each shape is given as a function returning true for points within it, and anti-aliased by sampling
+	var inside func(x, y float64) bool
+	switch spec.glyph {
+	case GlyphSquare:
+		radius := float64(size) / 5
+		inside = func(x, y float64) bool {
+			dx := max(math.Abs(x-center)-(center-radius), 0)
+			dy := max(math.Abs(y-center)-(center-radius), 0)
+			return dx*dx+dy*dy <= radius*radius
+		}
+	case GlyphRing:
+		outer, inner := center, center*0.78
+		inside = func(x, y float64) bool {
+			d := math.Hypot(x-center, y-center)
+			return d <= outer && d >= inner
+		}
+	default:
+		inside = func(x, y float64) bool {
+			return math.Hypot(x-center, y-center) <= center
+		}
+	}
+	fillShape(img, spec.fill, inside)
+
+	if spec.badge.A > 0 {
+		badgeRadius := float64(size) / 5
+		bx, by := float64(size)-badgeRadius, badgeRadius
+		// Outlined in white, so that the badge stands out from a glyph of a similar color
+		fillShape(img, color.NRGBA{0xFF, 0xFF, 0xFF, 0xFF}, func(x, y float64) bool {
+			return math.Hypot(x-bx, y-by) <= badgeRadius
+		})
+		fillShape(img, spec.badge, func(x, y float64) bool {
+			return math.Hypot(x-bx, y-by) <= badgeRadius*0.75
+		})
+	}
+
+	if spec.text != "" {
+		textColor := contrastColor(spec.fill)
+		if spec.glyph == GlyphRing {
+			textColor = spec.fill
+		}
+		drawText(img, spec.text, textColor)
+	}
+
+	return img
+}
+
+// fillShape blends c over every pixel within the shape, weighted by the fraction of the pixel's samples inside it
+func fillShape(img *image.NRGBA, c color.NRGBA, inside func(x, y float64) bool) {
+	bounds := img.Bounds()
+	for py := bounds.Min.Y; py < bounds.Max.Y; py++ {
+		for px := bounds.Min.X; px < bounds.Max.X; px++ {
+			hits := 0
+			for sy := 0; sy < renderSamples; sy++ {
+				for sx := 0; sx < renderSamples; sx++ {
+					x := float64(px) + (float64(sx)+0.5)/renderSamples
+					y := float64(py) + (float64(sy)+0.5)/renderSamples
+					if inside(x, y) {
+						hits++
+					}
+				}
+			}
+			if hits == 0 {
+				continue
+			}
+
+			coverage := float64(hits) / (renderSamples * renderSamples)
+			blend(img, px, py, color.NRGBA{c.R, c.G, c.B, uint8(float64(c.A) * coverage)})
+		}
+	}
+}
+
+// blend draws c over the pixel at x, y
+func blend(img *image.NRGBA, x, y int, c color.NRGBA) {
+	draw.Draw(img, image.Rect(x, y, x+1, y+1), image.NewUniform(c), image.Point{}, draw.Over)
+}
+
+// drawText draws up to maxIconText characters centered over the icon, scaling the bitmap font up by the largest
+// whole factor that fits
+func drawText(img *image.NRGBA, text string, c color.NRGBA) {
+	face := basicfont.Face7x13
+	width := font.MeasureString(face, text).Ceil()
+	height := face.Ascent + face.Descent
+	if width == 0 {
+		return
+	}
+
+	// The text is drawn at its natural size, then scaled, as the bitmap font has a single size
+	small := image.NewNRGBA(image.Rect(0, 0, width, height))
+	drawer := font.Drawer{
+		Dst:  small,
+		Src:  image.NewUniform(c),
+		Face: face,
+		Dot:  fixed.P(0, face.Ascent),
+	}
+	drawer.DrawString(text)
+
+	size := img.Bounds().Dx()
+	scale := max(min(size*4/5/width, size*3/5/height), 1)
+	left := (size - width*scale) / 2
+	top := (size - height*scale) / 2
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			pixel := small.NRGBAAt(x, y)
+			if pixel.A == 0 {
+				continue
+			}
+			for sy := 0; sy < scale; sy++ {
+				for sx := 0; sx < scale; sx++ {
+					blend(img, left+x*scale+sx, top+y*scale+sy, pixel)
+				}
+			}
+		}
+	}
+}
+
+// contrastColor returns white or black, whichever is more legible over c
+func contrastColor(c color.NRGBA) color.NRGBA {
+	// Relative luminance, per ITU-R BT.601
+	luminance := 0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)
+	if luminance > 160 {
+		return color.NRGBA{0x00, 0x00, 0x00, 0xFF}
+	}
+	return color.NRGBA{0xFF, 0xFF, 0xFF, 0xFF}
+}
+
+// truncateIconText shortens text to the characters that fit over a rendered icon. Characters the bitmap font cannot
+// draw (anything but printable ASCII) are left out, e.g. 21°C becomes 21C.
+func truncateIconText(text string) string {
+	var runes []rune
+	for _, r := range strings.TrimSpace(text) {
+		if r >= ' ' && r <= '~' && len(runes) < maxIconText {
+			runes = append(runes, r)
+		}
+	}
+	return string(runes)
+}
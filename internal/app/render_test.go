@@ -0,0 +1,169 @@
+package app
+
+import (
+	"fmt"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+func TestParseColor(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    color.NRGBA
+		wantErr bool
+	}{
+		{value: "#f59e0b", want: color.NRGBA{0xF5, 0x9E, 0x0B, 0xFF}},
+		{value: "#F59E0B", want: color.NRGBA{0xF5, 0x9E, 0x0B, 0xFF}},
+		{value: "#fa0", want: color.NRGBA{0xFF, 0xAA, 0x00, 0xFF}},
+		{value: " #000 ", want: color.NRGBA{0x00, 0x00, 0x00, 0xFF}},
+		{value: "red", want: iconColors[IconOpen]},
+		{value: "Gray", want: iconColors[IconUnknown]},
+		{value: "white", want: color.NRGBA{0xFF, 0xFF, 0xFF, 0xFF}},
+		{value: "", wantErr: true},
+		{value: "f59e0b", wantErr: true},
+		{value: "#f59e0", wantErr: true},
+		{value: "#f59e0b00", wantErr: true},
+		{value: "#ggg", wantErr: true},
+		{value: "#-12345", wantErr: true},
+		{value: "mauve", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseColor(tt.value)
+		if tt.wantErr {
+			if err == nil || !strings.Contains(err.Error(), "invalid color") {
+				t.Errorf("parseColor(%q): expected an invalid color, got %v, %v", tt.value, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseColor(%q): expected %v, got %v, %v", tt.value, tt.want, got, err)
+		}
+	}
+}
+
+func TestTruncateIconText(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"21", "21"},
+		{" 7 ", "7"},
+		{"1234", "123"},
+		{"21°C", "21C"},
+		{"-5.5", "-5."},
+		{"☀️", ""},
+		{"a\tb", "ab"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := truncateIconText(tt.text); got != tt.want {
+			t.Errorf("truncateIconText(%q): expected %q, got %q", tt.text, tt.want, got)
+		}
+	}
+}
+
+func TestContrastColor(t *testing.T) {
+	black, white := color.NRGBA{0x00, 0x00, 0x00, 0xFF}, color.NRGBA{0xFF, 0xFF, 0xFF, 0xFF}
+
+	tests := []struct {
+		fill color.NRGBA
+		want color.NRGBA
+	}{
+		{white, black},
+		{black, white},
+		{namedColors["yellow"], black},
+		{iconColors[IconOpen], white},
+		{iconColors[IconClosed], white},
+		{iconColors[IconUnknown], white},
+		{iconColors[IconCritical], white},
+	}
+
+	for _, tt := range tests {
+		if got := contrastColor(tt.fill); got != tt.want {
+			t.Errorf("contrastColor(%v): expected %v, got %v", tt.fill, tt.want, got)
+		}
+	}
+}
+
+func TestRenderIcon(t *testing.T) {
+	fill := iconColors[IconWarning]
+	badge := namedColors["blue"]
+
+	img := renderIcon(iconSpec{glyph: GlyphCircle, fill: fill, badge: badge}, 32)
+	if got := img.NRGBAAt(16, 16); got != fill {
+		t.Errorf("expected the center to be filled with %v, got %v", fill, got)
+	}
+	if got := img.NRGBAAt(0, 31); got.A != 0 {
+		t.Errorf("expected the corner outside the circle to be transparent, got %v", got)
+	}
+	if got := img.NRGBAAt(32-32/5, 32/5); got != badge {
+		t.Errorf("expected the badge in the top right corner, got %v", got)
+	}
+
+	ring := renderIcon(iconSpec{glyph: GlyphRing, fill: fill}, 32)
+	if got := ring.NRGBAAt(16, 16); got.A != 0 {
+		t.Errorf("expected the center of a ring to be transparent, got %v", got)
+	}
+	if got := ring.NRGBAAt(16, 1); got != fill {
+		t.Errorf("expected the ring to be filled with %v, got %v", fill, got)
+	}
+
+	square := renderIcon(iconSpec{glyph: GlyphSquare, fill: fill}, 32)
+	if got := square.NRGBAAt(4, 16); got != fill {
+		t.Errorf("expected the edge of a square to be filled with %v, got %v", fill, got)
+	}
+
+	// The text is drawn in the contrasting color somewhere over the glyph
+	text := renderIcon(iconSpec{glyph: GlyphCircle, fill: fill, text: "88"}, 32)
+	found := false
+	for y := 0; y < 32 && !found; y++ {
+		for x := 0; x < 32 && !found; x++ {
+			found = text.NRGBAAt(x, y) == contrastColor(fill)
+		}
+	}
+	if !found {
+		t.Error("expected the text to be drawn")
+	}
+}
+
+func TestIconRendererCache(t *testing.T) {
+	r := newIconRenderer()
+	spec := iconSpec{glyph: GlyphCircle, fill: iconColors[IconOpen], text: "21"}
+
+	first, err := r.Render(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := r.Render(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) == 0 || &first[0] != &second[0] {
+		t.Error("expected the cached icon to be returned")
+	}
+
+	other, err := r.Render(iconSpec{glyph: GlyphCircle, fill: iconColors[IconOpen], text: "22"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(other) == string(first) {
+		t.Error("expected a different icon for different text")
+	}
+
+	// Once full, the cache is cleared rather than growing without bound
+	for i := len(r.cache); i < maxRenderCache; i++ {
+		r.cache[fmt.Sprint("filler/", i)] = first
+	}
+	if _, err := r.Render(iconSpec{glyph: GlyphSquare, fill: iconColors[IconClosed]}); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.cache) != 1 {
+		t.Errorf("expected the cache to be cleared when full, has %d icons", len(r.cache))
+	}
+	if third, _ := r.Render(spec); &third[0] == &first[0] {
+		t.Error("expected evicted icons to be rendered again")
+	}
+}
@@ -0,0 +1,160 @@
+package app
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RuleConfig maps an entity's states matching every condition set to an icon and tooltip. A rule without any
+// conditions matches every state, so can be used as a catch-all after more specific rules.
+// The conditions follow Home Assistant's own state and numeric_state conditions.
+type RuleConfig struct {
+	State     string   `toml:"state,omitempty"`     // exact state
+	Regex     string   `toml:"regex,omitempty"`     // regular expression matching the state, e.g. ^(open|opening)$
+	Above     *float64 `toml:"above,omitempty"`     // numeric state greater than this
+	Below     *float64 `toml:"below,omitempty"`     // numeric state less than this
+	Attribute string   `toml:"attribute,omitempty"` // match this attribute's value instead of the state, e.g. battery_level
+
+	Icon    IconReference `toml:"icon"`
+	Tooltip string        `toml:"tooltip,omitempty"` // shown in place of the state, e.g. "Door open"
+}
+
+// unavailableStates are reported by Home Assistant when it cannot determine an entity's state. These display the
+// unknown icon unless a rule matches them first.
+var unavailableStates = map[string]bool{
+	"unavailable": true,
+	"unknown":     true,
+}
+
+// entitySnapshot is the last known state of an entity
+type entitySnapshot struct {
+	State       string
+	Attributes  map[string]any
+	LastChanged time.Time
+}
+
+// rule is a compiled RuleConfig
+type rule struct {
+	config RuleConfig
+	regex  *regexp.Regexp // nil if the rule has no regex condition
+}
+
+// compileRules compiles the rules of an entity, in order
+func compileRules(configs []RuleConfig) ([]rule, error) {
+	rules := make([]rule, 0, len(configs))
+	for i, config := range configs {
+		compiled, err := config.compile()
+		if err != nil {
+			return nil, fmt.Errorf("rule[%d]: %w", i, err)
+		}
+		rules = append(rules, compiled)
+	}
+	return rules, nil
+}
+
+// compile checks the rule and compiles its regex
+func (r RuleConfig) compile() (rule, error) {
+	compiled := rule{config: r}
+
+	if !r.Icon.Valid() {
+		return rule{}, unknownIconError(r.Icon)
+	}
+
+	if r.Regex != "" {
+		regex, err := regexp.Compile(r.Regex)
+		if err != nil {
+			return rule{}, fmt.Errorf("invalid regex: %w", err)
+		}
+		compiled.regex = regex
+	}
+
+	if r.Above != nil && r.Below != nil && *r.Above >= *r.Below {
+		return rule{}, fmt.Errorf("above (%v) must be less than below (%v), or no state can match", *r.Above, *r.Below)
+	}
+
+	return compiled, nil
+}
+
+// matches returns true if the snapshot satisfies every condition of the rule
+func (r rule) matches(snapshot entitySnapshot) bool {
+	value := snapshot.State
+	if r.config.Attribute != "" {
+		attribute, ok := snapshot.Attributes[r.config.Attribute]
+		if !ok || attribute == nil {
+			return false
+		}
+		value = formatAttribute(attribute)
+	}
+
+	if r.config.State != "" && value != r.config.State {
+		return false
+	}
+	if r.regex != nil && !r.regex.MatchString(value) {
+		return false
+	}
+
+	if r.config.Above != nil || r.config.Below != nil {
+		number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return false
+		}
+		if r.config.Above != nil && number <= *r.config.Above {
+			return false
+		}
+		if r.config.Below != nil && number >= *r.config.Below {
+			return false
+		}
+	}
+
+	return true
+}
+
+// formatAttribute formats an attribute value for matching, e.g. 42.0 -> "42", true -> "true"
+func formatAttribute(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// evaluate returns the icon and tooltip for an entity's state: the first matching rule, then the level of its reading
+// if the entity has thresholds, then the entity's icons, then the built-in defaults. A nil snapshot (no state received
+// yet) is unknown.
+//
+// The built-in defaults display unavailable and unknown states as unknown, 'on' as open, and anything else as closed.
+func (e EntityConfig) evaluate(rules []rule, snapshot *entitySnapshot, reading *thresholdReading) (IconReference, string) {
+	if snapshot == nil {
+		return IconUnknown, "unknown"
+	}
+
+	for _, r := range rules {
+		if r.matches(*snapshot) {
+			return r.config.Icon, cmp.Or(r.config.Tooltip, snapshot.State)
+		}
+	}
+
+	if reading != nil {
+		return reading.display(snapshot.State)
+	}
+
+	if icon, ok := e.Icons[snapshot.State]; ok {
+		return icon, snapshot.State
+	}
+
+	switch {
+	case unavailableStates[snapshot.State]:
+		return IconUnknown, snapshot.State
+	case snapshot.State == "on":
+		return IconOpen, snapshot.State
+	default:
+		return IconClosed, snapshot.State
+	}
+}
@@ -0,0 +1,237 @@
+package app
+
+import (
+	"strings"
+	"testing"
+)
+
+// number returns a pointer to a number, for optional numeric configuration
+func number(v float64) *float64 {
+	return &v
+}
+
+func TestEvaluate(t *testing.T) {
+	entity := EntityConfig{
+		ID: "sensor.door",
+		Icons: map[string]IconReference{
+			"jammed": IconWarning,
+			"on":     IconClosed, // overrides the built-in default
+		},
+	}
+
+	tests := []struct {
+		name        string
+		rules       []RuleConfig
+		snapshot    *entitySnapshot
+		wantIcon    IconReference
+		wantTooltip string
+	}{
+		{
+			name:     "nil snapshot",
+			rules:    []RuleConfig{{Icon: IconOpen}},
+			wantIcon: IconUnknown, wantTooltip: "unknown",
+		},
+		{
+			name:     "exact state",
+			rules:    []RuleConfig{{State: "open", Icon: IconOpen, Tooltip: "Door open"}},
+			snapshot: &entitySnapshot{State: "open"},
+			wantIcon: IconOpen, wantTooltip: "Door open",
+		},
+		{
+			name:     "exact state is case sensitive",
+			rules:    []RuleConfig{{State: "open", Icon: IconOpen}},
+			snapshot: &entitySnapshot{State: "Open"},
+			wantIcon: IconClosed, wantTooltip: "Open",
+		},
+		{
+			name:     "regex",
+			rules:    []RuleConfig{{Regex: "^(open|opening)$", Icon: IconOpen}},
+			snapshot: &entitySnapshot{State: "opening"},
+			wantIcon: IconOpen, wantTooltip: "opening",
+		},
+		{
+			name:     "regex not matching",
+			rules:    []RuleConfig{{Regex: "^(open|opening)$", Icon: IconOpen}},
+			snapshot: &entitySnapshot{State: "reopening"},
+			wantIcon: IconClosed, wantTooltip: "reopening",
+		},
+		{
+			name:     "above",
+			rules:    []RuleConfig{{Above: number(25), Icon: IconCritical}},
+			snapshot: &entitySnapshot{State: "25.1"},
+			wantIcon: IconCritical, wantTooltip: "25.1",
+		},
+		{
+			name:     "above is exclusive",
+			rules:    []RuleConfig{{Above: number(25), Icon: IconCritical}},
+			snapshot: &entitySnapshot{State: "25"},
+			wantIcon: IconClosed, wantTooltip: "25",
+		},
+		{
+			name:     "below",
+			rules:    []RuleConfig{{Below: number(10), Icon: IconWarning}},
+			snapshot: &entitySnapshot{State: " 9.5 "},
+			wantIcon: IconWarning, wantTooltip: " 9.5 ",
+		},
+		{
+			name:     "between",
+			rules:    []RuleConfig{{Above: number(10), Below: number(20), Icon: IconOpen}},
+			snapshot: &entitySnapshot{State: "15"},
+			wantIcon: IconOpen, wantTooltip: "15",
+		},
+		{
+			name:     "numeric condition on a non-numeric state",
+			rules:    []RuleConfig{{Below: number(10), Icon: IconWarning}},
+			snapshot: &entitySnapshot{State: "low"},
+			wantIcon: IconClosed, wantTooltip: "low",
+		},
+		{
+			name:     "numeric attribute",
+			rules:    []RuleConfig{{Attribute: "battery_level", Below: number(20), Icon: IconWarning, Tooltip: "Battery low"}},
+			snapshot: &entitySnapshot{State: "off", Attributes: map[string]any{"battery_level": 15.0}},
+			wantIcon: IconWarning, wantTooltip: "Battery low",
+		},
+		{
+			name:     "attribute formatted without a fraction",
+			rules:    []RuleConfig{{Attribute: "battery_level", State: "42", Icon: IconWarning}},
+			snapshot: &entitySnapshot{State: "off", Attributes: map[string]any{"battery_level": 42.0}},
+			wantIcon: IconWarning, wantTooltip: "off",
+		},
+		{
+			name:     "boolean attribute",
+			rules:    []RuleConfig{{Attribute: "locked", State: "true", Icon: IconClosed, Tooltip: "Locked"}},
+			snapshot: &entitySnapshot{State: "on", Attributes: map[string]any{"locked": true}},
+			wantIcon: IconClosed, wantTooltip: "Locked",
+		},
+		{
+			name:     "attribute matched instead of the state",
+			rules:    []RuleConfig{{Attribute: "mode", State: "open", Icon: IconOpen}},
+			snapshot: &entitySnapshot{State: "open", Attributes: map[string]any{"mode": "closed"}},
+			wantIcon: IconClosed, wantTooltip: "open",
+		},
+		{
+			name:     "missing attribute",
+			rules:    []RuleConfig{{Attribute: "battery_level", Below: number(20), Icon: IconWarning}},
+			snapshot: &entitySnapshot{State: "off"},
+			wantIcon: IconClosed, wantTooltip: "off",
+		},
+		{
+			name:     "null attribute",
+			rules:    []RuleConfig{{Attribute: "battery_level", Regex: ".*", Icon: IconWarning}},
+			snapshot: &entitySnapshot{State: "off", Attributes: map[string]any{"battery_level": nil}},
+			wantIcon: IconClosed, wantTooltip: "off",
+		},
+		{
+			name: "every condition must match",
+			rules: []RuleConfig{
+				{State: "open", Attribute: "current_position", Icon: IconWarning},
+				{State: "open", Regex: "^o", Icon: IconOpen},
+			},
+			snapshot: &entitySnapshot{State: "open", Attributes: map[string]any{"current_position": 50.0}},
+			wantIcon: IconOpen, wantTooltip: "open",
+		},
+		{
+			name: "first matching rule wins",
+			rules: []RuleConfig{
+				{Above: number(30), Icon: IconCritical, Tooltip: "Too hot"},
+				{Above: number(20), Icon: IconWarning, Tooltip: "Warm"},
+				{Icon: IconClosed, Tooltip: "Fine"},
+			},
+			snapshot: &entitySnapshot{State: "31"},
+			wantIcon: IconCritical, wantTooltip: "Too hot",
+		},
+		{
+			name: "later rule matches",
+			rules: []RuleConfig{
+				{Above: number(30), Icon: IconCritical, Tooltip: "Too hot"},
+				{Above: number(20), Icon: IconWarning, Tooltip: "Warm"},
+				{Icon: IconClosed, Tooltip: "Fine"},
+			},
+			snapshot: &entitySnapshot{State: "25"},
+			wantIcon: IconWarning, wantTooltip: "Warm",
+		},
+		{
+			name:     "catch-all rule",
+			rules:    []RuleConfig{{State: "open", Icon: IconOpen}, {Icon: IconCritical, Tooltip: "Unexpected"}},
+			snapshot: &entitySnapshot{State: "unavailable"},
+			wantIcon: IconCritical, wantTooltip: "Unexpected",
+		},
+		{
+			name:     "falls through to the icons map",
+			rules:    []RuleConfig{{State: "open", Icon: IconOpen}},
+			snapshot: &entitySnapshot{State: "jammed"},
+			wantIcon: IconWarning, wantTooltip: "jammed",
+		},
+		{
+			name:     "icons map overrides the default",
+			snapshot: &entitySnapshot{State: "on"},
+			wantIcon: IconClosed, wantTooltip: "on",
+		},
+		{
+			name:     "default closed",
+			rules:    []RuleConfig{{State: "open", Icon: IconOpen}},
+			snapshot: &entitySnapshot{State: "off"},
+			wantIcon: IconClosed, wantTooltip: "off",
+		},
+		{
+			name:     "unavailable",
+			rules:    []RuleConfig{{Below: number(10), Icon: IconWarning}},
+			snapshot: &entitySnapshot{State: "unavailable"},
+			wantIcon: IconUnknown, wantTooltip: "unavailable",
+		},
+		{
+			name:     "unknown",
+			snapshot: &entitySnapshot{State: "unknown"},
+			wantIcon: IconUnknown, wantTooltip: "unknown",
+		},
+		{
+			name:     "rule matching unavailable",
+			rules:    []RuleConfig{{State: "unavailable", Icon: IconWarning, Tooltip: "Offline"}},
+			snapshot: &entitySnapshot{State: "unavailable"},
+			wantIcon: IconWarning, wantTooltip: "Offline",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := compileRules(tt.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			icon, tooltip := entity.evaluate(rules, tt.snapshot, nil)
+			if icon != tt.wantIcon || tooltip != tt.wantTooltip {
+				t.Errorf("expected %s (%q), got %s (%q)", tt.wantIcon, tt.wantTooltip, icon, tooltip)
+			}
+		})
+	}
+}
+
+func TestCompileRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []RuleConfig
+		wantErr string
+	}{
+		{"valid", []RuleConfig{{State: "on", Icon: IconOpen}, {Icon: IconClosed}}, ""},
+		{"invalid regex", []RuleConfig{{Icon: IconOpen}, {Regex: "(", Icon: IconOpen}}, "rule[1]: invalid regex"},
+		{"empty range", []RuleConfig{{Above: number(20), Below: number(10), Icon: IconOpen}}, "rule[0]: above (20) must be less than below (10)"},
+		{"equal bounds", []RuleConfig{{Above: number(10), Below: number(10), Icon: IconOpen}}, "rule[0]: above (10) must be less than below (10)"},
+		{"missing icon", []RuleConfig{{State: "on"}}, "rule[0]: "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := compileRules(tt.rules)
+			if tt.wantErr == "" {
+				if err != nil || len(rules) != len(tt.rules) {
+					t.Errorf("expected %d rules, got %d: %v", len(tt.rules), len(rules), err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("expected an error starting with %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
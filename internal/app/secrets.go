@@ -0,0 +1,163 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// credentialName is the name of the systemd credential holding the API key of the default server,
+// i.e. LoadCredential=api_key:/path/to/token. Other servers use api_key_<name>, see ServerConfig.credentialName.
+const credentialName = "api_key"
+
+// apiKeyCommandTimeout is how long api_key_command may run before it is killed
+// Password managers may prompt to be unlocked, so this is fairly generous.
+var apiKeyCommandTimeout = 30 * time.Second
+
+// ResolveAPIKey returns the API key from the first configured source, in order of precedence:
+//  1. api_key (or its environment variable, e.g. HATRAY_SERVER_0_API_KEY)
+//  2. api_key_encrypted, decrypted with the per-user encryption key (see EncryptSecret)
+//  3. api_key_file, a file containing only the key
+//  4. api_key_command, a command printing the key to stdout (e.g. a password manager CLI)
+//  5. The 'api_key' (or 'api_key_<name>') systemd credential, found in $CREDENTIALS_DIRECTORY
+//
+// Sources are resolved lazily, each time a connection is made. The resolved key must never be logged.
+func (s ServerConfig) ResolveAPIKey() (string, error) {
+	var (
+		key    string
+		err    error
+		source = s.apiKeySource()
+	)
+
+	switch source {
+	case "api_key":
+		return s.APIKey, nil
+	case "api_key_encrypted":
+		key, err = DecryptSecret(s.APIKeyEncrypted)
+	case "api_key_file":
+		key, err = readSecretFile(s.APIKeyFile)
+	case "api_key_command":
+		key, err = runSecretCommand(s.APIKeyCommand)
+	case "credential":
+		key, err = readSecretFile(filepath.Join(os.Getenv("CREDENTIALS_DIRECTORY"), s.credentialName()))
+	default:
+		return "", errors.New("no API key configured")
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve API key from %s: %w", source, err)
+	}
+	if key == "" {
+		return "", fmt.Errorf("API key from %s is empty", source)
+	}
+
+	return key, nil
+}
+
+// apiKeySources returns the API key sources set in the configuration, in order of precedence
+func (s ServerConfig) apiKeySources() []string {
+	var sources []string
+	for _, source := range []struct{ name, value string }{
+		{"api_key", s.APIKey},
+		{"api_key_encrypted", s.APIKeyEncrypted},
+		{"api_key_file", s.APIKeyFile},
+		{"api_key_command", s.APIKeyCommand},
+	} {
+		if source.value != "" {
+			sources = append(sources, source.name)
+		}
+	}
+	return sources
+}
+
+// apiKeySource returns the name of the source ResolveAPIKey will use, or an empty string if there is none
+func (s ServerConfig) apiKeySource() string {
+	if sources := s.apiKeySources(); len(sources) > 0 {
+		return sources[0]
+	}
+
+	if dir := os.Getenv("CREDENTIALS_DIRECTORY"); dir != "" {
+		if _, err := os.Stat(filepath.Join(dir, s.credentialName())); err == nil {
+			return "credential"
+		}
+	}
+
+	return ""
+}
+
+// credentialName returns the name of the systemd credential holding the server's API key
+func (s ServerConfig) credentialName() string {
+	if s.Name == defaultServerName {
+		return credentialName
+	}
+	return credentialName + "_" + s.Name
+}
+
+// readSecretFile reads a secret from a file, trimming surrounding whitespace (e.g. a trailing newline)
+func readSecretFile(path string) (string, error) {
+	data, err := readConfigFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// readConfigFile reads a file referenced by the configuration, see expandConfigPath
+func readConfigFile(path string) ([]byte, error) {
+	path, err := expandConfigPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+// expandConfigPath expands a leading ~/ in a path referenced by the configuration to the home directory
+func expandConfigPath(path string) (string, error) {
+	rest, ok := strings.CutPrefix(path, "~/")
+	if !ok {
+		return path, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to expand home directory: %w", err)
+	}
+	return filepath.Join(home, rest), nil
+}
+
+// runSecretCommand runs a command through the platform's shell, returning its trimmed stdout
+// stdout is never included in errors, as it may contain a partial secret.
+func runSecretCommand(command string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), apiKeyCommandTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Only the shell is killed on timeout, so processes it started may keep stdout open
+	cmd.WaitDelay = time.Second
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("command timed out after %s", apiKeyCommandTimeout)
+		}
+		return "", fmt.Errorf("command failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
@@ -0,0 +1,128 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveAPIKey(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	if err := os.WriteFile(filepath.Join(home, "token"), []byte("file-key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	credentials := t.TempDir()
+	for name, key := range map[string]string{"api_key": "default-credential\n", "api_key_office": "office-credential"} {
+		if err := os.WriteFile(filepath.Join(credentials, name), []byte(key), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		server      ServerConfig
+		credentials string // $CREDENTIALS_DIRECTORY, if set
+		want        string
+		wantErr     string
+	}{
+		{name: "api_key", server: ServerConfig{APIKey: "plain-key"}, want: "plain-key"},
+		{name: "api_key_file", server: ServerConfig{APIKeyFile: filepath.Join(home, "token")}, want: "file-key"},
+		{name: "api_key_file in the home directory", server: ServerConfig{APIKeyFile: "~/token"}, want: "file-key"},
+		{name: "missing api_key_file", server: ServerConfig{APIKeyFile: "~/missing"}, wantErr: "failed to resolve API key from api_key_file"},
+		{name: "api_key_command", server: ServerConfig{APIKeyCommand: "echo command-key"}, want: "command-key"},
+		{
+			name:    "failing api_key_command",
+			server:  ServerConfig{APIKeyCommand: "echo partial-key; echo locked >&2; exit 3"},
+			wantErr: "command failed: exit status 3: locked",
+		},
+		{name: "empty api_key_command output", server: ServerConfig{APIKeyCommand: "true"}, wantErr: "API key from api_key_command is empty"},
+		{
+			name:   "api_key takes precedence",
+			server: ServerConfig{APIKey: "plain-key", APIKeyFile: "~/token", APIKeyCommand: "echo command-key"},
+			want:   "plain-key",
+		},
+		{name: "api_key_file takes precedence", server: ServerConfig{APIKeyFile: "~/token", APIKeyCommand: "echo command-key"}, want: "file-key"},
+		{name: "configured source before credential", server: ServerConfig{Name: "default", APIKeyFile: "~/token"}, credentials: credentials, want: "file-key"},
+		{name: "default server credential", server: ServerConfig{Name: "default"}, credentials: credentials, want: "default-credential"},
+		{name: "named server credential", server: ServerConfig{Name: "office"}, credentials: credentials, want: "office-credential"},
+		{name: "missing credential", server: ServerConfig{Name: "cabin"}, credentials: credentials, wantErr: "no API key configured"},
+		{name: "no source", server: ServerConfig{Name: "default"}, wantErr: "no API key configured"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if runtime.GOOS == "windows" && tt.server.APIKeyCommand != "" {
+				t.Skip("commands are written for sh")
+			}
+			t.Setenv("CREDENTIALS_DIRECTORY", tt.credentials)
+
+			key, err := tt.server.ResolveAPIKey()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				if strings.Contains(err.Error(), "partial-key") {
+					t.Errorf("expected the command's stdout to be left out of the error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, key)
+			}
+		})
+	}
+}
+
+func TestAPIKeyCommandTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("commands are written for sh")
+	}
+
+	timeout := apiKeyCommandTimeout
+	apiKeyCommandTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { apiKeyCommandTimeout = timeout })
+
+	// The shell's child keeps stdout open after the shell is killed
+	started := time.Now()
+	_, err := ServerConfig{APIKeyCommand: "sleep 10; echo late-key"}.ResolveAPIKey()
+	if err == nil || !strings.Contains(err.Error(), "command timed out") {
+		t.Errorf("expected the command to time out, got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("expected the command to be abandoned soon after timing out, took %s", elapsed)
+	}
+}
+
+func TestValidateAPIKeySources(t *testing.T) {
+	const config = `version = 3
+
+[[server]]
+url = "https://ha.example.com"
+api_key_file = "~/token"
+api_key_command = "pass show home-assistant"
+
+[[entity]]
+id = "binary_sensor.door"
+`
+
+	problems := validationErrors(t, loadTestConfig(t, config))
+	if len(problems) != 1 || problems[0].Path != "server[0].api_key_command" ||
+		problems[0].Message != "only one of api_key_file, api_key_command may be set" {
+		t.Errorf("expected both sources to be rejected, got %v", problems)
+	}
+
+	// A key set by an environment variable replaces those in the file
+	t.Setenv("HATRAY_SERVER_0_API_KEY", "override")
+	if err := loadTestConfig(t, config).Validate(); err != nil {
+		t.Errorf("expected the environment variable to take precedence, got %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package app
+
+import (
+	"cmp"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Kinds of configuration value sources, in increasing order of precedence
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+)
+
+// ValueSource describes where a configuration value came from
+type ValueSource struct {
+	Kind string // SourceDefault, SourceFile, SourceEnv or SourceFlag
+	Name string // file path, environment variable name or flag, empty for defaults
+	Line int    // line within the file, 0 if unknown or not from a file
+}
+
+func (s ValueSource) String() string {
+	switch {
+	case s.Line > 0:
+		return fmt.Sprintf("%s %s:%d", s.Kind, s.Name, s.Line)
+	case s.Name != "":
+		return fmt.Sprintf("%s %s", s.Kind, s.Name)
+	default:
+		return s.Kind
+	}
+}
+
+// configMeta holds information about where a configuration's values came from
+type configMeta struct {
+	file      string                 // path of the main configuration file
+	dropIns   []string               // paths of the drop-in files merged over the main file, in order
+	locations map[string]ValueSource // file and line of each key path in the merged configuration, see configMerger
+	tables    map[string]bool        // key paths defined by [table] or [[array]] headers in any file
+	unknown   []unknownKey           // keys present in any file that do not match any configuration field
+	version   int                    // version of the main file before migrating, CurrentConfigVersion if it was not migrated
+	overrides map[string]ValueSource // values overridden after the files were merged (environment variables and flags), by path
+	warnings  []string               // non-fatal problems found while loading, e.g. deprecated environment variables
+}
+
+// unknownKey is a key that does not match any configuration field, along with where it was found
+type unknownKey struct {
+	key  toml.Key
+	file string
+	line int
+}
+
+// newConfigMeta creates metadata for a configuration loaded from filename, with no values from any file yet
+func newConfigMeta(filename string) *configMeta {
+	return &configMeta{
+		file:      filename,
+		locations: make(map[string]ValueSource),
+		tables:    make(map[string]bool),
+		version:   CurrentConfigVersion,
+		overrides: make(map[string]ValueSource),
+	}
+}
+
+// source returns where the value at path came from.
+// Values within inline tables (e.g. entity[0].icons.on) belong to the nearest key defined in a file, whereas values
+// that are absent from a [table] or [[array]] defined in a file are defaults.
+func (m *configMeta) source(path string) ValueSource {
+	for p := path; p != ""; p = parentPath(p) {
+		if source, ok := m.overrides[p]; ok {
+			return source
+		}
+	}
+
+	for p := path; p != "" && !m.tables[p]; p = parentPath(p) {
+		if source, ok := m.locations[p]; ok {
+			return source
+		}
+	}
+
+	return ValueSource{Kind: SourceDefault}
+}
+
+// location returns the file and line most relevant to path, or an empty file and 0 if the value did not come from a
+// file. The file is also empty for the main configuration file, as it is implied.
+func (m *configMeta) location(path string) (string, int) {
+	if kind := m.source(path).Kind; kind != SourceFile && kind != SourceDefault {
+		return "", 0
+	}
+
+	for p := path; p != ""; p = parentPath(p) {
+		if source, ok := m.locations[p]; ok {
+			if source.Name == m.file {
+				return "", source.Line
+			}
+			return source.Name, source.Line
+		}
+	}
+	return "", 0
+}
+
+// redactedValue replaces secret values, see Redacted
+const redactedValue = "REDACTED"
+
+// EffectiveValue is a single configuration value along with where it came from
+type EffectiveValue struct {
+	Path   string
+	Value  any
+	Source ValueSource
+
+	secret string // secret tag of the value's field, or of the nearest field containing it
+}
+
+// Redacted is Effective with secret values masked, so that the result can be shared, e.g. in bug reports
+// Empty secrets are left empty, showing that they are not set.
+func (c *Config) Redacted() []EffectiveValue {
+	values := c.Effective()
+	for i, value := range values {
+		s, ok := value.Value.(string)
+		if !ok || s == "" {
+			continue
+		}
+
+		switch value.secret {
+		case "true":
+			values[i].Value = redactedValue
+		case "url":
+			// Only the password is secret, the rest of the URL is useful when reporting problems
+			if u, err := url.Parse(s); err != nil {
+				values[i].Value = redactedValue
+			} else {
+				values[i].Value = u.Redacted()
+			}
+		case "command":
+			values[i].Value = redactCommand(s)
+		}
+	}
+	return values
+}
+
+// redactCommand masks the arguments of a command, e.g. the name of a password manager entry, keeping the program
+// run. Commands starting with an environment variable assignment are masked entirely.
+func redactCommand(command string) string {
+	program, args, _ := strings.Cut(strings.TrimSpace(command), " ")
+	switch {
+	case strings.Contains(program, "="):
+		return redactedValue
+	case strings.TrimSpace(args) == "":
+		return program
+	}
+	return program + " " + redactedValue
+}
+
+// Effective lists every configuration value in the order of the Config struct, along with where each came from
+func (c *Config) Effective() []EffectiveValue {
+	meta := c.meta
+	if meta == nil {
+		meta = newConfigMeta("")
+	}
+
+	var values []EffectiveValue
+	var walk func(v reflect.Value, path, secret string)
+	walk = func(v reflect.Value, path, secret string) {
+		switch v.Kind() {
+		case reflect.Pointer:
+			if !v.IsNil() {
+				walk(v.Elem(), path, secret)
+			}
+		case reflect.Struct:
+			for i := 0; i < v.NumField(); i++ {
+				field := v.Type().Field(i)
+				if name := tomlName(field); name != "" {
+					walk(v.Field(i), joinPath(path, formatKey(name)), cmp.Or(field.Tag.Get("secret"), secret))
+				}
+			}
+		case reflect.Slice:
+			if v.Type().Elem().Kind() != reflect.Struct {
+				values = append(values, EffectiveValue{Path: path, Value: v.Interface(), Source: meta.source(path), secret: secret})
+				return
+			}
+			for i := 0; i < v.Len(); i++ {
+				walk(v.Index(i), fmt.Sprintf("%s[%d]", path, i), secret)
+			}
+		case reflect.Map:
+			keys := v.MapKeys()
+			sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+			for _, key := range keys {
+				walk(v.MapIndex(key), joinPath(path, formatKey(key.String())), secret)
+			}
+		default:
+			values = append(values, EffectiveValue{Path: path, Value: v.Interface(), Source: meta.source(path), secret: secret})
+		}
+	}
+	walk(reflect.ValueOf(c).Elem(), "", "")
+
+	return values
+}
+
+// Files returns the configuration files that were merged, the main file first followed by any drop-ins
+func (c *Config) Files() []string {
+	if c.meta == nil {
+		return nil
+	}
+	return append([]string{c.meta.file}, c.meta.dropIns...)
+}
+
+// Warnings returns non-fatal problems found while loading the configuration, e.g. deprecated environment variables
+func (c *Config) Warnings() []string {
+	if c.meta == nil {
+		return nil
+	}
+	return c.meta.warnings
+}
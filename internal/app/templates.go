@@ -0,0 +1,291 @@
+package app
+
+import (
+	"cmp"
+	"fmt"
+	"image/color"
+	"maps"
+	"math"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateRefresh is how often the tray templates are rendered without any state changing, so that relative times
+// (e.g. "opened 5m ago") stay current
+const templateRefresh = 30 * time.Second
+
+// TrayConfig holds text/template templates for the tray's text, see templateData for the values available to them
+type TrayConfig struct {
+	Title   string `toml:"title,omitempty"`   // shown next to the icon, on platforms that support it
+	Tooltip string `toml:"tooltip,omitempty"` // shown in place of the state of each entity, below the status line
+
+	// The icon is rendered at runtime instead of using the icon files if any of these are set, see iconRenderer
+	IconText   string                   `toml:"icon_text,omitempty"`   // up to 3 characters drawn over the icon, e.g. a temperature
+	IconBadge  string                   `toml:"icon_badge,omitempty"`  // color of a badge drawn in the corner, empty for none
+	IconGlyph  Glyph                    `toml:"icon_glyph,omitempty"`  // shape of the icon, defaults to circle
+	IconColors map[IconReference]string `toml:"icon_colors,omitempty"` // fill color by icon, defaults to the colors of the icon files
+}
+
+// rendered returns true if the tray icon is rendered at runtime
+func (c TrayConfig) rendered() bool {
+	return c.IconText != "" || c.IconBadge != "" || c.IconGlyph != "" || len(c.IconColors) > 0
+}
+
+// trayTemplates are the parsed templates of a TrayConfig, nil if not configured
+type trayTemplates struct {
+	title     *template.Template
+	tooltip   *template.Template
+	iconText  *template.Template
+	iconBadge *template.Template
+
+	glyph  Glyph                         // empty if the icon is not rendered
+	colors map[IconReference]color.NRGBA // fill color by icon, see iconColors
+
+	lastErr string // last rendering error, so that a broken template is not logged on every refresh
+}
+
+// trayText is the result of rendering the tray templates, each empty if its template is not configured
+type trayText struct {
+	title     string
+	tooltip   string
+	iconText  string
+	iconBadge string
+}
+
+// parseTrayTemplates parses the configured templates and icon colors. An error is returned for the first that does not
+// parse.
+func parseTrayTemplates(c TrayConfig) (*trayTemplates, error) {
+	var (
+		templates trayTemplates
+		err       error
+	)
+	if templates.title, err = parseTemplate("tray.title", c.Title); err != nil {
+		return nil, err
+	}
+	if templates.tooltip, err = parseTemplate("tray.tooltip", c.Tooltip); err != nil {
+		return nil, err
+	}
+	if templates.iconText, err = parseTemplate("tray.icon_text", c.IconText); err != nil {
+		return nil, err
+	}
+	if templates.iconBadge, err = parseTemplate("tray.icon_badge", c.IconBadge); err != nil {
+		return nil, err
+	}
+
+	if c.rendered() {
+		templates.glyph = cmp.Or(c.IconGlyph, GlyphCircle)
+		templates.colors = maps.Clone(iconColors)
+		for icon, value := range c.IconColors {
+			if templates.colors[icon], err = parseColor(value); err != nil {
+				return nil, fmt.Errorf("tray.icon_colors.%s: %w", icon, err)
+			}
+		}
+	}
+	return &templates, nil
+}
+
+// parseTemplate parses a template with the helper functions available, returning nil if the text is empty
+func parseTemplate(name, text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	t, err := template.New(name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %w", err)
+	}
+	return t, nil
+}
+
+// empty returns true if no templates are configured, and the icon is not rendered
+func (t *trayTemplates) empty() bool {
+	return t == nil || (t.title == nil && t.tooltip == nil && t.iconText == nil && t.iconBadge == nil && t.glyph == "")
+}
+
+// iconSpec returns the rendered icon for the tray's icon and the rendered icon templates. An invalid badge color is
+// returned as an error, along with the icon without its badge.
+func (t *trayTemplates) iconSpec(icon IconReference, text trayText) (iconSpec, error) {
+	spec := iconSpec{
+		glyph: t.glyph,
+		fill:  t.colors[icon],
+		text:  truncateIconText(text.iconText),
+	}
+	if text.iconBadge == "" {
+		return spec, nil
+	}
+
+	badge, err := parseColor(text.iconBadge)
+	if err != nil {
+		return spec, fmt.Errorf("tray.icon_badge: %w", err)
+	}
+	spec.badge = badge
+	return spec, nil
+}
+
+// templateData is available to the tray templates as dot, e.g. {{ .Icon }} or {{ (.Entity "sensor.outside").Value }}
+type templateData struct {
+	Icon       IconReference // icon shown by the tray, e.g. open, closed or unknown
+	Entities   []templateEntity
+	Aggregates []templateAggregate
+	Now        time.Time
+}
+
+// templateEntity is an entity's last known state, as available to the tray templates
+type templateEntity struct {
+	ID           string
+	Server       string
+	Name         string // label, falling back to the ID
+	FriendlyName string // friendly_name attribute, falling back to the name
+	State        string // empty if no state has been received yet
+	Attributes   map[string]any
+	LastChanged  time.Time // zero if no state has been received yet
+	Icon         IconReference
+	Tooltip      string // the entity's rule tooltip, or its state
+}
+
+// Unit returns the entity's unit of measurement, e.g. °C
+func (e templateEntity) Unit() string {
+	unit, _ := e.Attributes["unit_of_measurement"].(string)
+	return unit
+}
+
+// Value returns the entity's state with its unit of measurement, e.g. 21.5 °C
+func (e templateEntity) Value() string {
+	return withUnit(e.State, e.Unit())
+}
+
+// templateAggregate is an aggregate's status, as available to the tray templates
+type templateAggregate struct {
+	Name    string
+	Server  string
+	Icon    IconReference
+	Tooltip string // e.g. 2 of 5 active (Front Door, Garage)
+}
+
+// Entity returns the entity with the given ID, or server/ID if the same ID is watched on several servers. An entity
+// that is not watched is returned without a state.
+func (d templateData) Entity(id string) templateEntity {
+	for _, entity := range d.Entities {
+		if entity.ID == id || entity.Server+"/"+entity.ID == id {
+			return entity
+		}
+	}
+	return templateEntity{ID: id, Name: id, FriendlyName: id}
+}
+
+// Aggregate returns the aggregate with the given name. An aggregate that is not configured is returned without a status.
+func (d templateData) Aggregate(name string) templateAggregate {
+	for _, aggregate := range d.Aggregates {
+		if aggregate.Name == name {
+			return aggregate
+		}
+	}
+	return templateAggregate{Name: name}
+}
+
+// templateFuncs are the helper functions available to the tray templates, in addition to the text/template built-ins
+var templateFuncs = template.FuncMap{
+	"since":    func(t time.Time) time.Duration { return time.Since(t) },
+	"humanize": humanizeDuration,
+	"ago": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		if since := time.Since(t); since >= time.Minute {
+			return humanizeDuration(since) + " ago"
+		}
+		return "just now"
+	},
+	"unit":  withUnit,
+	"round": roundValue,
+}
+
+// render renders the templates, returning an empty string for a template that is not configured
+func (t *trayTemplates) render(data templateData) (trayText, error) {
+	var (
+		text trayText
+		err  error
+	)
+	for _, rendered := range []struct {
+		template *template.Template
+		text     *string
+	}{
+		{t.title, &text.title},
+		{t.tooltip, &text.tooltip},
+		{t.iconText, &text.iconText},
+		{t.iconBadge, &text.iconBadge},
+	} {
+		if *rendered.text, err = execute(rendered.template, data); err != nil {
+			return trayText{}, err
+		}
+	}
+	return text, nil
+}
+
+// execute renders a template, trimming the whitespace left around it by multi-line TOML strings
+func execute(t *template.Template, data templateData) (string, error) {
+	if t == nil {
+		return "", nil
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// humanizeDuration formats a duration to its two most significant units, e.g. 3d 4h, 2h 5m or 45s
+func humanizeDuration(d time.Duration) string {
+	d = d.Abs().Round(time.Second)
+
+	days := d / (24 * time.Hour)
+	hours := (d % (24 * time.Hour)) / time.Hour
+	minutes := (d % time.Hour) / time.Minute
+	seconds := (d % time.Minute) / time.Second
+
+	switch {
+	case days > 0 && hours > 0:
+		return fmt.Sprintf("%dd %dh", days, hours)
+	case days > 0:
+		return fmt.Sprintf("%dd", days)
+	case hours > 0 && minutes > 0:
+		return fmt.Sprintf("%dh %dm", hours, minutes)
+	case hours > 0:
+		return fmt.Sprintf("%dh", hours)
+	case minutes > 0:
+		return fmt.Sprintf("%dm", minutes)
+	default:
+		return fmt.Sprintf("%ds", seconds)
+	}
+}
+
+// withUnit formats a value with a unit of measurement as Home Assistant does, e.g. 21.5 °C or 45%. Numeric values
+// lose any trailing zeros.
+func withUnit(value any, unit string) string {
+	formatted := formatAttribute(value)
+	if number, err := strconv.ParseFloat(formatted, 64); err == nil {
+		formatted = strconv.FormatFloat(number, 'f', -1, 64)
+	}
+
+	switch unit {
+	case "":
+		return formatted
+	case "%", "°":
+		return formatted + unit
+	default:
+		return formatted + " " + unit
+	}
+}
+
+// roundValue rounds a numeric value (or numeric state) to the given number of decimal places, returning other values
+// unchanged, e.g. {{ round 1 .State }}
+func roundValue(places int, value any) string {
+	formatted := formatAttribute(value)
+	number, err := strconv.ParseFloat(formatted, 64)
+	if err != nil {
+		return formatted
+	}
+	scale := math.Pow(10, float64(places))
+	return strconv.FormatFloat(math.Round(number*scale)/scale, 'f', -1, 64)
+}
@@ -0,0 +1,194 @@
+package app
+
+import (
+	"image/color"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHumanizeDuration(t *testing.T) {
+	tests := []struct {
+		duration time.Duration
+		want     string
+	}{
+		{0, "0s"},
+		{400 * time.Millisecond, "0s"},
+		{1500 * time.Millisecond, "2s"},
+		{45 * time.Second, "45s"},
+		{5*time.Minute + 30*time.Second, "5m"},
+		{time.Hour, "1h"},
+		{2*time.Hour + 5*time.Minute + 59*time.Second, "2h 5m"},
+		{24 * time.Hour, "1d"},
+		{3*24*time.Hour + 4*time.Hour + 30*time.Minute, "3d 4h"},
+		{-90 * time.Second, "1m"},
+	}
+
+	for _, tt := range tests {
+		if got := humanizeDuration(tt.duration); got != tt.want {
+			t.Errorf("humanizeDuration(%s): expected %q, got %q", tt.duration, tt.want, got)
+		}
+	}
+}
+
+func TestWithUnit(t *testing.T) {
+	tests := []struct {
+		value any
+		unit  string
+		want  string
+	}{
+		{"21.50", "°C", "21.5 °C"},
+		{21.5, "°C", "21.5 °C"},
+		{"45.0", "%", "45%"},
+		{90, "°", "90°"},
+		{"1200", "W", "1200 W"},
+		{"on", "", "on"},
+		{"0.000", "", "0"},
+	}
+
+	for _, tt := range tests {
+		if got := withUnit(tt.value, tt.unit); got != tt.want {
+			t.Errorf("withUnit(%v, %q): expected %q, got %q", tt.value, tt.unit, tt.want, got)
+		}
+	}
+}
+
+func TestRoundValue(t *testing.T) {
+	tests := []struct {
+		places int
+		value  any
+		want   string
+	}{
+		{1, "21.46", "21.5"},
+		{1, 21.44, "21.4"},
+		{0, "21.5", "22"},
+		{2, "20.0", "20"},
+		{-1, "1234", "1230"},
+		{1, "unavailable", "unavailable"},
+		{1, true, "true"},
+	}
+
+	for _, tt := range tests {
+		if got := roundValue(tt.places, tt.value); got != tt.want {
+			t.Errorf("roundValue(%d, %v): expected %q, got %q", tt.places, tt.value, tt.want, got)
+		}
+	}
+}
+
+func TestTemplateDataEntity(t *testing.T) {
+	data := templateData{Entities: []templateEntity{
+		{ID: "sensor.temperature", Server: "home", State: "21.5", Attributes: map[string]any{"unit_of_measurement": "°C"}},
+		{ID: "sensor.temperature", Server: "office", State: "19"},
+		{ID: "binary_sensor.door", Server: "home", State: "on"},
+	}}
+
+	tests := []struct {
+		id         string
+		wantServer string
+		wantValue  string
+	}{
+		{"binary_sensor.door", "home", "on"},
+		{"sensor.temperature", "home", "21.5 °C"}, // the first server watching the ID
+		{"home/sensor.temperature", "home", "21.5 °C"},
+		{"office/sensor.temperature", "office", "19"},
+	}
+	for _, tt := range tests {
+		entity := data.Entity(tt.id)
+		if entity.Server != tt.wantServer || entity.Value() != tt.wantValue {
+			t.Errorf("Entity(%q): expected %s with %q, got %s with %q", tt.id, tt.wantServer, tt.wantValue, entity.Server, entity.Value())
+		}
+	}
+
+	for _, id := range []string{"light.desk", "cabin/sensor.temperature"} {
+		entity := data.Entity(id)
+		if entity.ID != id || entity.Name != id || entity.FriendlyName != id || entity.State != "" || entity.Unit() != "" {
+			t.Errorf("Entity(%q): expected an entity without a state, got %+v", id, entity)
+		}
+	}
+}
+
+func TestParseTrayTemplates(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  TrayConfig
+		wantErr string
+	}{
+		{name: "unterminated action", config: TrayConfig{Title: "{{ .Icon"}, wantErr: "invalid template"},
+		{name: "unknown function", config: TrayConfig{Tooltip: "{{ fahrenheit .Icon }}"}, wantErr: `function "fahrenheit" not defined`},
+		{name: "invalid icon text", config: TrayConfig{IconText: "{{ end }}"}, wantErr: "invalid template"},
+		{name: "invalid icon badge", config: TrayConfig{IconBadge: "{{ if .Icon }}"}, wantErr: "invalid template"},
+		{name: "invalid icon color", config: TrayConfig{IconColors: map[IconReference]string{IconOpen: "#12345"}}, wantErr: "tray.icon_colors.open:"},
+		{name: "unknown icon color", config: TrayConfig{IconColors: map[IconReference]string{IconOpen: "mauve-ish"}}, wantErr: "tray.icon_colors.open:"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			templates, err := parseTrayTemplates(tt.config)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+			if templates != nil {
+				t.Error("expected no templates alongside the error")
+			}
+		})
+	}
+
+	t.Run("not configured", func(t *testing.T) {
+		templates, err := parseTrayTemplates(TrayConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !templates.empty() {
+			t.Error("expected no templates")
+		}
+		if text, err := templates.render(templateData{}); err != nil || text != (trayText{}) {
+			t.Errorf("expected nothing to be rendered, got %+v, %v", text, err)
+		}
+	})
+
+	t.Run("rendered icon", func(t *testing.T) {
+		templates, err := parseTrayTemplates(TrayConfig{IconColors: map[IconReference]string{IconOpen: "#ff8800"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if templates.empty() || templates.glyph != GlyphCircle {
+			t.Errorf("expected the icon to be rendered as a circle by default, got %q", templates.glyph)
+		}
+		if got := templates.colors[IconOpen]; got != (color.NRGBA{0xFF, 0x88, 0x00, 0xFF}) {
+			t.Errorf("expected the configured color, got %v", got)
+		}
+		if got := templates.colors[IconClosed]; got != iconColors[IconClosed] {
+			t.Errorf("expected the default color of other icons, got %v", got)
+		}
+	})
+
+	t.Run("execution error", func(t *testing.T) {
+		templates, err := parseTrayTemplates(TrayConfig{Title: "ok", Tooltip: "{{ .Missing }}"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if text, err := templates.render(templateData{}); err == nil || text != (trayText{}) {
+			t.Errorf("expected rendering to fail without any text, got %+v, %v", text, err)
+		}
+	})
+
+	t.Run("rendered text", func(t *testing.T) {
+		templates, err := parseTrayTemplates(TrayConfig{
+			Title:    "\n  {{ round 0 (.Entity \"sensor.temperature\").State }}°\n",
+			Tooltip:  "{{ range .Entities }}{{ .Name }} {{ ago .LastChanged }}{{ end }}",
+			IconText: "{{ (.Entity \"sensor.temperature\").Value }}",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		text, err := templates.render(templateData{Entities: []templateEntity{{ID: "sensor.temperature", Name: "Outside", State: "21.5"}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := trayText{title: "22°", tooltip: "Outside never", iconText: "21.5"}
+		if text != want {
+			t.Errorf("expected %+v, got %+v", want, text)
+		}
+	})
+}
@@ -0,0 +1,228 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ThresholdConfig sets warning and critical levels for a numeric entity, e.g. a temperature, CO2 or humidity sensor.
+// A level is reached when the value is above its above bound or below its below bound, and shows the warning or
+// critical icon; values within every level show the closed icon, and non-numeric states the unknown icon.
+// The level reached is held while the state is not numeric, e.g. unavailable, so that the hysteresis still applies once
+// the entity reports a value again.
+type ThresholdConfig struct {
+	Unit          string   `toml:"unit,omitempty"`           // unit of the levels, e.g. °F, states in another unit are converted
+	WarnAbove     *float64 `toml:"warn_above,omitempty"`     // warn when the value is greater than this
+	WarnBelow     *float64 `toml:"warn_below,omitempty"`     // warn when the value is less than this
+	CriticalAbove *float64 `toml:"critical_above,omitempty"` // critical when the value is greater than this
+	CriticalBelow *float64 `toml:"critical_below,omitempty"` // critical when the value is less than this
+	Hysteresis    float64  `toml:"hysteresis,omitempty"`     // how far a value must return past a level before it clears
+}
+
+// thresholdLevel is the level a numeric entity has reached, in increasing severity
+type thresholdLevel int
+
+const (
+	levelNormal thresholdLevel = iota
+	levelWarning
+	levelCritical
+)
+
+func (l thresholdLevel) String() string {
+	switch l {
+	case levelWarning:
+		return "warning"
+	case levelCritical:
+		return "critical"
+	default:
+		return "normal"
+	}
+}
+
+// icon returns the icon shown for the level
+func (l thresholdLevel) icon() IconReference {
+	switch l {
+	case levelWarning:
+		return IconWarning
+	case levelCritical:
+		return IconCritical
+	default:
+		return IconClosed
+	}
+}
+
+// thresholdReading is a numeric entity's value in the threshold's unit, and the level it has reached
+type thresholdReading struct {
+	value float64
+	unit  string
+	level thresholdLevel // the level previously reached if the state could not be read, so that it is held after e.g. unavailable
+	err   error          // why the state could not be read, e.g. it is not numeric
+}
+
+// configured returns true if any level is set
+func (c ThresholdConfig) configured() bool {
+	return c.WarnAbove != nil || c.WarnBelow != nil || c.CriticalAbove != nil || c.CriticalBelow != nil
+}
+
+// read reads a state, converting it to the threshold's unit, and determines the level it has reached given the level
+// previously reached
+func (c ThresholdConfig) read(snapshot entitySnapshot, previous thresholdLevel) *thresholdReading {
+	unit, _ := snapshot.Attributes["unit_of_measurement"].(string)
+	value, unit, err := parseMeasurement(snapshot.State, unit)
+	if err != nil {
+		return &thresholdReading{level: previous, err: err}
+	}
+
+	if c.Unit != "" && unit != "" && unit != c.Unit {
+		if value, err = convertUnit(value, unit, c.Unit); err != nil {
+			return &thresholdReading{level: previous, err: err}
+		}
+		unit = c.Unit
+	}
+
+	return &thresholdReading{value: value, unit: unit, level: c.level(value, previous)}
+}
+
+// level returns the level a value has reached. A level previously reached is kept until the value returns past it by
+// the hysteresis, so that a value hovering around a level does not flap between icons.
+func (c ThresholdConfig) level(value float64, previous thresholdLevel) thresholdLevel {
+	level := levelNormal
+	switch {
+	case c.reached(levelCritical, value, 0):
+		level = levelCritical
+	case c.reached(levelWarning, value, 0):
+		level = levelWarning
+	}
+
+	for held := previous; held > level; held-- {
+		if c.reached(held, value, c.Hysteresis) {
+			return held
+		}
+	}
+	return level
+}
+
+// reached returns true if a value is past either bound of a level, with the bounds moved back by margin
+func (c ThresholdConfig) reached(level thresholdLevel, value, margin float64) bool {
+	above, below := c.WarnAbove, c.WarnBelow
+	if level == levelCritical {
+		above, below = c.CriticalAbove, c.CriticalBelow
+	}
+	return (above != nil && value > *above-margin) || (below != nil && value < *below+margin)
+}
+
+// display returns the icon and tooltip for the reading, e.g. 1250 ppm (warning)
+func (r *thresholdReading) display(state string) (IconReference, string) {
+	if r.err != nil {
+		if unavailableStates[state] {
+			return IconUnknown, state
+		}
+		return IconUnknown, fmt.Sprintf("%s (%v)", state, r.err)
+	}
+
+	// Converted values are rounded, e.g. 71.6 °F is 21.999999999999996 °C
+	tooltip := withUnit(roundValue(2, r.value), r.unit)
+	if r.level != levelNormal {
+		tooltip += fmt.Sprintf(" (%s)", r.level)
+	}
+	return r.level.icon(), tooltip
+}
+
+// parseMeasurement parses a numeric state, e.g. 21.5, along with its unit of measurement. States including their unit,
+// e.g. "21.5 °C", are also accepted.
+func parseMeasurement(state, unit string) (float64, string, error) {
+	state = strings.TrimSpace(state)
+	if number, suffix, ok := strings.Cut(state, " "); ok {
+		state = number
+		if unit == "" {
+			unit = strings.TrimSpace(suffix)
+		}
+	}
+
+	value, err := strconv.ParseFloat(state, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, "", errors.New("state is not numeric")
+	}
+	return value, unit, nil
+}
+
+// unitScale is a unit's factor to the base unit of its quantity, e.g. hPa is 100 Pa
+type unitScale struct {
+	quantity string
+	factor   float64
+}
+
+// unitScales are the units converted by multiplying to a base unit, as used by Home Assistant's sensor device classes
+var unitScales = map[string]unitScale{
+	"ppm": {"concentration", 1},
+	"ppb": {"concentration", 0.001},
+
+	"Pa":   {"pressure", 1},
+	"hPa":  {"pressure", 100},
+	"kPa":  {"pressure", 1000},
+	"mbar": {"pressure", 100},
+	"bar":  {"pressure", 100000},
+	"psi":  {"pressure", 6894.757},
+	"inHg": {"pressure", 3386.389},
+	"mmHg": {"pressure", 133.322},
+
+	"W":  {"power", 1},
+	"kW": {"power", 1000},
+	"MW": {"power", 1000000},
+
+	"Wh":  {"energy", 1},
+	"kWh": {"energy", 1000},
+	"MWh": {"energy", 1000000},
+
+	"m/s":  {"speed", 1},
+	"km/h": {"speed", 1 / 3.6},
+	"mph":  {"speed", 0.44704},
+	"kn":   {"speed", 0.514444},
+}
+
+// convertUnit converts a value between units of the same quantity, e.g. °F to °C or hPa to inHg
+func convertUnit(value float64, from, to string) (float64, error) {
+	if celsius, ok := toCelsius(value, from); ok {
+		if converted, ok := fromCelsius(celsius, to); ok {
+			return converted, nil
+		}
+	}
+
+	source, sourceOK := unitScales[from]
+	target, targetOK := unitScales[to]
+	if !sourceOK || !targetOK || source.quantity != target.quantity {
+		return 0, fmt.Errorf("cannot convert %s to %s", from, to)
+	}
+	return value * source.factor / target.factor, nil
+}
+
+// toCelsius converts a temperature to °C, returning false if the unit is not a temperature
+func toCelsius(value float64, unit string) (float64, bool) {
+	switch unit {
+	case "°C":
+		return value, true
+	case "°F":
+		return (value - 32) * 5 / 9, true
+	case "K":
+		return value - 273.15, true
+	default:
+		return 0, false
+	}
+}
+
+// fromCelsius converts a temperature from °C, returning false if the unit is not a temperature
+func fromCelsius(value float64, unit string) (float64, bool) {
+	switch unit {
+	case "°C":
+		return value, true
+	case "°F":
+		return value*9/5 + 32, true
+	case "K":
+		return value + 273.15, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,106 @@
+package app
+
+import "testing"
+
+// thresholdStep is a state received by a thresholded entity, and what the tray is expected to show after it
+type thresholdStep struct {
+	state       string
+	unit        string // unit_of_measurement attribute, if any
+	wantIcon    IconReference
+	wantTooltip string
+	wantLevel   thresholdLevel
+}
+
+// runThresholdSteps feeds states to an entity in order, carrying the level reached over like setSnapshot's callers do
+func runThresholdSteps(t *testing.T, threshold ThresholdConfig, steps []thresholdStep) {
+	t.Helper()
+
+	entity := &trackedEntity{config: EntityConfig{ID: "sensor.test", Threshold: threshold}}
+	for i, step := range steps {
+		snapshot := &entitySnapshot{State: step.state}
+		if step.unit != "" {
+			snapshot.Attributes = map[string]any{"unit_of_measurement": step.unit}
+		}
+		entity.setSnapshot(snapshot, entity.reading)
+
+		icon, tooltip := entity.display()
+		if icon != step.wantIcon || tooltip != step.wantTooltip {
+			t.Errorf("step %d (%s): expected %s (%q), got %s (%q)", i, step.state, step.wantIcon, step.wantTooltip, icon, tooltip)
+		}
+		if entity.reading.level != step.wantLevel {
+			t.Errorf("step %d (%s): expected level %s, got %s", i, step.state, step.wantLevel, entity.reading.level)
+		}
+	}
+}
+
+func TestThresholdHysteresis(t *testing.T) {
+	threshold := ThresholdConfig{
+		Unit:          "°C",
+		WarnAbove:     number(25),
+		CriticalAbove: number(30),
+		Hysteresis:    1,
+	}
+
+	runThresholdSteps(t, threshold, []thresholdStep{
+		{"24", "°C", IconClosed, "24 °C", levelNormal},
+		{"25.5", "°C", IconWarning, "25.5 °C (warning)", levelWarning},
+		{"24.5", "°C", IconWarning, "24.5 °C (warning)", levelWarning}, // held within the hysteresis
+		{"23.9", "°C", IconClosed, "23.9 °C", levelNormal},
+		{"30.5", "°C", IconCritical, "30.5 °C (critical)", levelCritical},
+		{"29.5", "°C", IconCritical, "29.5 °C (critical)", levelCritical},
+		{"28.9", "°C", IconWarning, "28.9 °C (warning)", levelWarning}, // critical clears to warning, not normal
+		{"23", "°C", IconClosed, "23 °C", levelNormal},
+	})
+}
+
+func TestThresholdBelow(t *testing.T) {
+	threshold := ThresholdConfig{
+		WarnBelow:     number(5),
+		CriticalBelow: number(0),
+		Hysteresis:    1,
+	}
+
+	runThresholdSteps(t, threshold, []thresholdStep{
+		{"-1", "°C", IconCritical, "-1 °C (critical)", levelCritical},
+		{"0.5", "°C", IconCritical, "0.5 °C (critical)", levelCritical},
+		{"1.5", "°C", IconWarning, "1.5 °C (warning)", levelWarning},
+		{"5.5", "°C", IconWarning, "5.5 °C (warning)", levelWarning},
+		{"6", "°C", IconClosed, "6 °C", levelNormal},
+	})
+}
+
+func TestThresholdUnitConversion(t *testing.T) {
+	threshold := ThresholdConfig{
+		Unit:          "°C",
+		WarnAbove:     number(25),
+		CriticalAbove: number(30),
+	}
+
+	runThresholdSteps(t, threshold, []thresholdStep{
+		{"90", "°F", IconCritical, "32.22 °C (critical)", levelCritical},
+		{"80", "°F", IconWarning, "26.67 °C (warning)", levelWarning},
+		{"71.6", "°F", IconClosed, "22 °C", levelNormal},
+		{"300 K", "", IconWarning, "26.85 °C (warning)", levelWarning}, // unit included in the state
+		{"21.5", "", IconClosed, "21.5", levelNormal},                  // no unit, assumed to be the threshold's
+		{"400", "ppm", IconUnknown, "400 (cannot convert ppm to °C)", levelNormal},
+	})
+}
+
+// The level reached is held while the state cannot be read, so that the hysteresis still applies once the sensor
+// reports a value again, while the icon shows that the state is unknown
+func TestThresholdHeldWhileUnreadable(t *testing.T) {
+	threshold := ThresholdConfig{
+		WarnAbove:  number(25),
+		Hysteresis: 1,
+	}
+
+	runThresholdSteps(t, threshold, []thresholdStep{
+		{"25.5", "", IconWarning, "25.5 (warning)", levelWarning},
+		{"unavailable", "", IconUnknown, "unavailable", levelWarning},
+		{"unknown", "", IconUnknown, "unknown", levelWarning},
+		{"error", "", IconUnknown, "error (state is not numeric)", levelWarning},
+		{"24.5", "", IconWarning, "24.5 (warning)", levelWarning},
+		{"unavailable", "", IconUnknown, "unavailable", levelWarning},
+		{"23.9", "", IconClosed, "23.9", levelNormal},
+	})
+}
@@ -0,0 +1,265 @@
+package app
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// tomlLine describes a key or table header found while scanning a TOML document
+type tomlLine struct {
+	Path   string // indexed path, e.g. entity[1].id
+	Line   int    // 1-indexed line number
+	End    int    // last line of the key's value, which may span several lines (e.g. multi-line arrays)
+	Header bool   // true for [table] and [[array]] headers
+}
+
+// tomlScanner is a lightweight, line-oriented TOML scanner that locates keys and table headers without decoding values.
+// It is not a full parser: documents are expected to be valid TOML, i.e. already decoded successfully.
+type tomlScanner struct {
+	table  string         // indexed path of the current table, empty for the root table
+	arrays map[string]int // current index of each array of tables, by indexed path (without the final index)
+
+	// Multi-line value state, carried across lines
+	depth     int    // nesting depth of arrays and inline tables
+	multiline string // closing delimiter of an open multi-line string, if any
+}
+
+// scanTOML returns every key and table header in the document, in order of appearance
+func scanTOML(src string) []tomlLine {
+	s := &tomlScanner{arrays: make(map[string]int)}
+
+	var lines []tomlLine
+	for i, line := range strings.Split(src, "\n") {
+		continuation := s.depth > 0 || s.multiline != ""
+		if found, ok := s.scanLine(line); ok {
+			found.Line, found.End = i+1, i+1
+			lines = append(lines, found)
+		} else if continuation && len(lines) > 0 {
+			lines[len(lines)-1].End = i + 1
+		}
+	}
+
+	return lines
+}
+
+// tomlKeyLines maps each key and table path in a TOML document to the line it is defined on.
+// Arrays of tables are recorded both with indices (entity[1].id) and, at their first occurrence, without them (entity.id),
+// which matches the paths reported by toml.MetaData.
+func tomlKeyLines(src string) map[string]int {
+	lines := make(map[string]int)
+	for _, found := range scanTOML(src) {
+		lines[found.Path] = found.Line
+		if plain := stripIndices(found.Path); plain != found.Path {
+			if _, ok := lines[plain]; !ok {
+				lines[plain] = found.Line
+			}
+		}
+	}
+	return lines
+}
+
+// lookupLine returns the line of the closest defined ancestor of path, or 0 if none are defined
+// e.g. keys within inline tables resolve to the line of the inline table itself.
+func lookupLine(lines map[string]int, path string) int {
+	for path != "" {
+		if line, ok := lines[path]; ok {
+			return line
+		}
+		path = parentPath(path)
+	}
+	return 0
+}
+
+// scanLine processes a single line, returning the key or header defined on it, if any
+func (s *tomlScanner) scanLine(line string) (tomlLine, bool) {
+	// Continuation of a multi-line array, inline table or string
+	if s.depth > 0 || s.multiline != "" {
+		s.scanValue(line)
+		return tomlLine{}, false
+	}
+
+	trimmed := strings.TrimSpace(line)
+	switch {
+	case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+		return tomlLine{}, false
+	case strings.HasPrefix(trimmed, "[["):
+		keys, _ := parseTOMLKey(trimmed[2:])
+		s.table = s.resolve(keys, true)
+		return tomlLine{Path: s.table, Header: true}, true
+	case strings.HasPrefix(trimmed, "["):
+		keys, _ := parseTOMLKey(trimmed[1:])
+		s.table = s.resolve(keys, false)
+		return tomlLine{Path: s.table, Header: true}, true
+	}
+
+	keys, rest := parseTOMLKey(trimmed)
+	if len(keys) == 0 || !strings.HasPrefix(rest, "=") {
+		return tomlLine{}, false
+	}
+	s.scanValue(rest[1:])
+
+	return tomlLine{Path: joinPath(s.table, formatKeys(keys)), Header: false}, true
+}
+
+// resolve converts the keys of a table header into an indexed path, advancing the index if it is an array of tables
+func (s *tomlScanner) resolve(keys []string, array bool) string {
+	path := ""
+	for i, key := range keys {
+		path = joinPath(path, formatKey(key))
+
+		last := i == len(keys)-1
+		if last && array {
+			index, ok := s.arrays[path]
+			if !ok {
+				index = -1
+			}
+			s.arrays[path] = index + 1
+		}
+
+		if index, ok := s.arrays[path]; ok {
+			path += "[" + strconv.Itoa(index) + "]"
+		}
+	}
+	return path
+}
+
+// scanValue tracks strings, arrays and inline tables so that multi-line values are not mistaken for keys.
+// The offset of a trailing comment is returned, or -1 if the line does not have one.
+func (s *tomlScanner) scanValue(value string) int {
+	for i := 0; i < len(value); i++ {
+		if s.multiline != "" {
+			if strings.HasPrefix(value[i:], s.multiline) {
+				i += len(s.multiline) - 1
+				s.multiline = ""
+			} else if value[i] == '\\' && s.multiline == `"""` {
+				i++
+			}
+			continue
+		}
+
+		switch c := value[i]; c {
+		case '#':
+			return i
+		case '[', '{':
+			s.depth++
+		case ']', '}':
+			s.depth--
+		case '"', '\'':
+			delimiter := string(c)
+			if strings.HasPrefix(value[i:], strings.Repeat(delimiter, 3)) {
+				s.multiline = strings.Repeat(delimiter, 3)
+				i += 2
+				continue
+			}
+
+			// Single-line strings must close on the same line
+			for i++; i < len(value) && value[i] != c; i++ {
+				if c == '"' && value[i] == '\\' {
+					i++
+				}
+			}
+		}
+	}
+	return -1
+}
+
+// parseTOMLKey parses a (possibly dotted and quoted) key from the start of s, returning its parts and the remainder
+func parseTOMLKey(s string) ([]string, string) {
+	var keys []string
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return keys, s
+		}
+
+		var key string
+		switch s[0] {
+		case '"', '\'':
+			end := 1
+			for end < len(s) && s[end] != s[0] {
+				if s[0] == '"' && s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return keys, ""
+			}
+			key = s[1:end]
+			if s[0] == '"' {
+				if unquoted, err := strconv.Unquote(s[:end+1]); err == nil {
+					key = unquoted
+				}
+			}
+			s = s[end+1:]
+		default:
+			end := strings.IndexFunc(s, func(r rune) bool { return !isBareKeyRune(r) })
+			if end == -1 {
+				end = len(s)
+			}
+			if end == 0 {
+				return keys, s
+			}
+			key, s = s[:end], s[end:]
+		}
+		keys = append(keys, key)
+
+		s = strings.TrimLeft(s, " \t")
+		if !strings.HasPrefix(s, ".") {
+			return keys, s
+		}
+		s = s[1:]
+	}
+}
+
+// isBareKeyRune returns true if the rune may appear in an unquoted TOML key
+func isBareKeyRune(r rune) bool {
+	return r == '-' || r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+}
+
+// formatKey quotes a key for use in a path if it is not a bare key
+func formatKey(key string) string {
+	if key != "" && strings.IndexFunc(key, func(r rune) bool { return !isBareKeyRune(r) }) == -1 {
+		return key
+	}
+	return strconv.Quote(key)
+}
+
+// formatKeys joins dotted key parts into a path
+func formatKeys(keys []string) string {
+	formatted := make([]string, len(keys))
+	for i, key := range keys {
+		formatted[i] = formatKey(key)
+	}
+	return strings.Join(formatted, ".")
+}
+
+// joinPath appends a key to a path
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// parentPath removes the last key (or index) from a path, e.g. entity[0].id -> entity[0] -> entity
+func parentPath(path string) string {
+	if strings.HasSuffix(path, "]") {
+		if i := strings.LastIndex(path, "["); i != -1 {
+			return path[:i]
+		}
+	}
+	if i := strings.LastIndex(path, "."); i != -1 {
+		return path[:i]
+	}
+	return ""
+}
+
+// indexPattern matches array indices within a path
+var indexPattern = regexp.MustCompile(`\[\d+\]`)
+
+// stripIndices removes array indices from a path, e.g. entity[1].id -> entity.id
+func stripIndices(path string) string {
+	return indexPattern.ReplaceAllString(path, "")
+}
@@ -0,0 +1,323 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testProxy is a proxy forwarding every connection to a single target, whichever host was requested, and recording
+// the hosts requested through it
+type testProxy struct {
+	target string // host:port every connection is forwarded to
+
+	mu        sync.Mutex
+	requested []string
+}
+
+// dial records a host requested through the proxy, then connects to the target
+func (p *testProxy) dial(host string) (net.Conn, error) {
+	p.mu.Lock()
+	p.requested = append(p.requested, host)
+	p.mu.Unlock()
+	return net.Dial("tcp", p.target)
+}
+
+// hosts returns the hosts requested through the proxy
+func (p *testProxy) hosts() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.requested...)
+}
+
+// serveConnect serves an HTTP proxy, supporting only CONNECT
+func (p *testProxy) serveConnect(t *testing.T) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		upstream, err := p.dial(r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		client, buffered, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		pipe(client, buffered.Reader, upstream)
+	}))
+	t.Cleanup(server.Close)
+	return "http://" + server.Listener.Addr().String()
+}
+
+// serveSOCKS5 serves a SOCKS5 proxy without authentication, supporting only CONNECT
+func (p *testProxy) serveSOCKS5(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				reader := bufio.NewReader(client)
+				host, err := socks5Handshake(reader, client)
+				if err != nil {
+					client.Close()
+					return
+				}
+				upstream, err := p.dial(host)
+				if err != nil {
+					client.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0}) // connection refused
+					client.Close()
+					return
+				}
+				client.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				pipe(client, reader, upstream)
+			}()
+		}
+	}()
+	return "socks5://" + listener.Addr().String()
+}
+
+// socks5Handshake negotiates no authentication, and reads a CONNECT request, returning the host:port requested
+func socks5Handshake(r *bufio.Reader, w io.Writer) (string, error) {
+	var greeting [2]byte
+	if _, err := io.ReadFull(r, greeting[:]); err != nil {
+		return "", err
+	}
+	if _, err := r.Discard(int(greeting[1])); err != nil {
+		return "", err
+	}
+	if _, err := w.Write([]byte{5, 0}); err != nil {
+		return "", err
+	}
+
+	var request [4]byte
+	if _, err := io.ReadFull(r, request[:]); err != nil {
+		return "", err
+	}
+	if request[1] != 1 {
+		return "", fmt.Errorf("unsupported command %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case 1, 4: // IPv4, IPv6
+		ip := make(net.IP, 4+12*int(request[3]/4))
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case 3: // domain name
+		length, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		name := make([]byte, length)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unsupported address type %d", request[3])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// pipe copies between a proxy's client and upstream connection until either side is closed
+func pipe(client net.Conn, reader io.Reader, upstream net.Conn) {
+	go func() {
+		io.Copy(upstream, reader)
+		upstream.Close()
+	}()
+	io.Copy(client, upstream)
+	client.Close()
+}
+
+// checkGatewayTraffic sends a REST request through a gateway to the server, then probes it over a websocket
+func checkGatewayTraffic(t *testing.T, server ServerConfig) {
+	t.Helper()
+
+	g, err := newGateway(slog.New(slog.NewTextHandler(io.Discard, nil)), server, testAPIKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	request, _ := http.NewRequest(http.MethodGet, g.url+"/api/states", nil)
+	request.Header.Set("Authorization", "Bearer "+g.token)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("expected REST request to succeed, got status %d", response.StatusCode)
+	}
+
+	server.APIKey = testAPIKey
+	probe, err := ProbeServer(context.Background(), server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(probe.Entities) != 1 {
+		t.Errorf("expected 1 entity over the websocket, got %+v", probe.Entities)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	upstream := httptest.NewTLSServer(testHomeAssistant())
+	defer upstream.Close()
+
+	tests := []struct {
+		name  string
+		serve func(p *testProxy, t *testing.T) string
+	}{
+		{"http", (*testProxy).serveConnect},
+		{"socks5", (*testProxy).serveSOCKS5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := &testProxy{target: upstream.Listener.Addr().String()}
+			server := ServerConfig{
+				URL:   "https://homeassistant.test:8123", // only resolved by the proxy
+				Proxy: tt.serve(proxy, t),
+				TLS:   TLSConfig{Insecure: true},
+			}
+
+			checkGatewayTraffic(t, server)
+
+			// REST traffic through the gateway, and the websocket through ProbeServer's
+			hosts := proxy.hosts()
+			if len(hosts) != 2 {
+				t.Errorf("expected 2 connections through the proxy, got %v", hosts)
+			}
+			for _, host := range hosts {
+				if host != "homeassistant.test:8123" {
+					t.Errorf("expected the proxy to connect to the server, got %s", host)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	upstream := httptest.NewTLSServer(testHomeAssistant())
+	defer upstream.Close()
+
+	proxy := &testProxy{target: upstream.Listener.Addr().String()}
+	t.Setenv("HTTPS_PROXY", proxy.serveConnect(t))
+	t.Setenv("NO_PROXY", "bypassed.test,.internal")
+
+	t.Run("proxied", func(t *testing.T) {
+		server := ServerConfig{URL: "https://homeassistant.test:8123", TLS: TLSConfig{Insecure: true}}
+		checkGatewayTraffic(t, server)
+		if len(proxy.hosts()) == 0 {
+			t.Error("expected the proxy from the environment to be used")
+		}
+	})
+
+	for _, url := range []string{"https://bypassed.test:8123", "https://homeassistant.internal:8123", "https://127.0.0.1:8123"} {
+		t.Run("bypassed "+url, func(t *testing.T) {
+			server := ServerConfig{URL: url}
+			if server.customTransport() {
+				t.Error("expected a bypassed server to be connected to directly, without a gateway")
+			}
+
+			proxyFunc, err := server.proxyFunc()
+			if err != nil {
+				t.Fatal(err)
+			}
+			request, _ := http.NewRequest(http.MethodGet, url+"/api/websocket", nil)
+			if proxied, err := proxyFunc(request); err != nil || proxied != nil {
+				t.Errorf("expected no proxy, got %v, %v", proxied, err)
+			}
+		})
+	}
+
+	t.Run("direct", func(t *testing.T) {
+		server := ServerConfig{URL: "https://homeassistant.test:8123", Proxy: directProxy}
+		proxyFunc, err := server.proxyFunc()
+		if err != nil || proxyFunc != nil {
+			t.Errorf("expected proxy = %q to ignore the environment, got %v", directProxy, err)
+		}
+	})
+}
+
+// A fingerprint combined with ca_file requires the certificate to both match and be issued by one of the CAs
+func TestTLSFingerprintWithCAFile(t *testing.T) {
+	server := httptest.NewUnstartedServer(testHomeAssistant())
+	server.Config.ErrorLog = log.New(io.Discard, "", 0) // rejected handshakes are expected
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	writePEM(t, caFile, "CERTIFICATE", server.Certificate().Raw)
+	otherCA, _ := writeCertificate(t, "other")
+
+	sum := sha256.Sum256(server.Certificate().Raw)
+	fingerprint := formatFingerprint(sum[:])
+	mismatch := strings.Repeat("00", sha256.Size)
+
+	tests := []struct {
+		name    string
+		tls     TLSConfig
+		wantErr string
+	}{
+		{"matching fingerprint issued by ca_file", TLSConfig{CAFile: caFile, Fingerprint: fingerprint}, ""},
+		{"matching fingerprint not issued by ca_file", TLSConfig{CAFile: otherCA, Fingerprint: fingerprint}, "not trusted by tls.ca_file"},
+		{"fingerprint mismatch issued by ca_file", TLSConfig{CAFile: caFile, Fingerprint: mismatch}, "does not match the pinned tls.fingerprint"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := tt.tls.build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+			defer client.CloseIdleConnections()
+
+			response, err := client.Get(server.URL + "/api/states")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+		})
+	}
+}
@@ -2,8 +2,9 @@ package app
 
 import (
 	"fmt"
-	"ha-tray/internal"
 	"log/slog"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/getlantern/systray"
@@ -12,59 +13,243 @@ import (
 type IconReference string
 
 const (
-	IconOpen    IconReference = "open"
-	IconClosed  IconReference = "closed"
-	IconUnknown IconReference = "unknown"
+	IconOpen     IconReference = "open"
+	IconClosed   IconReference = "closed"
+	IconUnknown  IconReference = "unknown"
+	IconWarning  IconReference = "warning"  // numeric entity past its warning level, see ThresholdConfig
+	IconCritical IconReference = "critical" // numeric entity past its critical level
 )
 
-// Path returns the path to the icon file
-func (i IconReference) Path() string {
-	switch i {
-	case IconOpen:
-		return "resources/open.ico"
-	case IconClosed:
-		return "resources/closed.ico"
-	default:
-		return "resources/unknown.ico"
+// iconPriority lists every icon, lowest priority first. When several entities are shown, the tray shows the icon with
+// the highest priority among them.
+var iconPriority = []IconReference{IconClosed, IconUnknown, IconWarning, IconOpen, IconCritical}
+
+// Valid returns true if the icon reference is one of the known icons
+func (i IconReference) Valid() bool {
+	return slices.Contains(iconPriority, i)
+}
+
+// priority returns the priority of the icon when combining entities, see iconPriority
+func (i IconReference) priority() int {
+	return slices.Index(iconPriority, i)
+}
+
+// unknownIconError describes an icon reference that is not one of the known icons
+func unknownIconError(icon IconReference) error {
+	return fmt.Errorf("unknown icon %q, expected one of %q, %q, %q, %q or %q", icon, IconOpen, IconClosed, IconUnknown, IconWarning, IconCritical)
+}
+
+// Path returns the path to the icon's embedded source image at the given size, see iconSizes
+func (i IconReference) Path(size int) string {
+	if !i.Valid() {
+		i = IconUnknown
 	}
+	return fmt.Sprintf("resources/%s-%d.png", i, size)
 }
 
+// trayDriver shows the tray's icon, title and tooltip, see systrayDriver
+type trayDriver interface {
+	SetIcon(iconBytes []byte)
+	SetTitle(title string)
+	SetTooltip(tooltip string)
+}
+
+// systrayDriver drives the system tray
+type systrayDriver struct{}
+
+func (systrayDriver) SetIcon(iconBytes []byte)  { systray.SetIcon(iconBytes) }
+func (systrayDriver) SetTitle(title string)     { systray.SetTitle(title) }
+func (systrayDriver) SetTooltip(tooltip string) { systray.SetTooltip(tooltip) }
+
 type Tray struct {
+	logger *slog.Logger
+	driver trayDriver
+
+	// Icons are set from the lifecycle, entity listeners and the icon watcher concurrently
+	mu          sync.Mutex
 	active      bool
+	title       string
 	currentIcon *IconReference
-	logger      *slog.Logger
+	rendered    bool // true if the current icon was rendered at runtime, see SetRenderedIcon
+
+	iconsMu  sync.Mutex
+	embedded map[IconReference][]byte // embedded icons encoded for the platform, see encodeTrayIcon
+	custom   map[IconReference][]byte // icons loaded from files, replacing the embedded icons, see SetCustomIcons
+
+	tooltipMu sync.Mutex
+	status    string // first line of the tooltip, e.g. the title and application state
+	details   string // remainder of the tooltip, e.g. the state of each entity
 }
 
 func NewTray(logger *slog.Logger) *Tray {
 	return &Tray{
 		logger:      logger,
+		driver:      systrayDriver{},
 		currentIcon: nil,
 		active:      false,
 	}
 }
 
+// Active returns true if the tray has started and not stopped since
+func (t *Tray) Active() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.active
+}
+
+// Title returns the title the tray was started with
+func (t *Tray) Title() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.title
+}
+
 func (t *Tray) SetIcon(icon IconReference) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.setIcon(icon)
+}
+
+// setIcon shows the icon file for the given icon. The caller must hold t.mu.
+func (t *Tray) setIcon(icon IconReference) error {
 	if !t.active {
 		return fmt.Errorf("tray is not active")
 	}
 
-	iconBytes, err := internal.Icons.ReadFile(icon.Path())
+	iconBytes, err := t.iconBytes(icon)
+	if err != nil {
+		return err
+	}
+	t.driver.SetIcon(iconBytes)
+	t.currentIcon = &icon
+	t.rendered = false
+
+	return nil
+}
+
+// iconBytes returns the custom icon if loaded, or the embedded icon, encoding it on first use
+func (t *Tray) iconBytes(icon IconReference) ([]byte, error) {
+	t.iconsMu.Lock()
+	defer t.iconsMu.Unlock()
+
+	if iconBytes, ok := t.custom[icon]; ok {
+		return iconBytes, nil
+	}
+	if iconBytes, ok := t.embedded[icon]; ok {
+		return iconBytes, nil
+	}
+
+	set, err := embeddedIconSet(icon)
 	if err != nil {
-		return fmt.Errorf("failed to read icon: %w", err)
+		return nil, err
+	}
+	if t.embedded == nil {
+		t.embedded = make(map[IconReference][]byte)
+	}
+	t.embedded[icon] = encodeTrayIcon(set)
+	return t.embedded[icon], nil
+}
+
+// SetRenderedIcon shows an icon rendered at runtime, encoded for the platform, in place of the icon file for the given
+// icon
+func (t *Tray) SetRenderedIcon(icon IconReference, data []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.active {
+		return fmt.Errorf("tray is not active")
 	}
-	systray.SetIcon(iconBytes)
+
+	t.driver.SetIcon(data)
 	t.currentIcon = &icon
+	t.rendered = true
 
 	return nil
 }
 
+// SetCustomIcons replaces the embedded icons with icons loaded from files, encoded for the platform, and shows the new version of
+// the current icon, unless it was rendered at runtime. Icons not in custom use the embedded icon.
+func (t *Tray) SetCustomIcons(custom map[IconReference][]byte) error {
+	t.iconsMu.Lock()
+	t.custom = custom
+	t.iconsMu.Unlock()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.active || t.currentIcon == nil || t.rendered {
+		return nil
+	}
+	return t.setIcon(*t.currentIcon)
+}
+
+func (t *Tray) SetTooltip(tooltip string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.active {
+		return fmt.Errorf("tray is not active")
+	}
+
+	t.driver.SetTooltip(tooltip)
+
+	return nil
+}
+
+// SetTitle sets the text shown next to the icon, on platforms that support it
+func (t *Tray) SetTitle(title string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.active {
+		return fmt.Errorf("tray is not active")
+	}
+
+	t.driver.SetTitle(title)
+
+	return nil
+}
+
+// SetStatus sets the first line of the tooltip, keeping the details below it. t.tooltipMu is held before t.mu.
+func (t *Tray) SetStatus(status string) error {
+	t.tooltipMu.Lock()
+	defer t.tooltipMu.Unlock()
+
+	t.status = status
+	return t.SetTooltip(t.tooltip())
+}
+
+// SetDetails sets the tooltip below the status line
+func (t *Tray) SetDetails(details string) error {
+	t.tooltipMu.Lock()
+	defer t.tooltipMu.Unlock()
+
+	t.details = details
+	return t.SetTooltip(t.tooltip())
+}
+
+// tooltip joins the status and details. The caller must hold t.tooltipMu.
+func (t *Tray) tooltip() string {
+	if t.details == "" {
+		return t.status
+	}
+	return t.status + "\n" + t.details
+}
+
 func (t *Tray) Start(title string) error {
+	t.mu.Lock()
 	if t.active {
+		t.mu.Unlock()
 		t.logger.Warn("tray is already active")
 		return nil
 	}
+	t.title = title
+	t.mu.Unlock()
 
 	t.logger.Info("attempting to start systray", "title", title)
+	t.tooltipMu.Lock()
+	t.status = title
+	t.tooltipMu.Unlock()
 	readyTimeout := make(chan struct{}, 1)
 	go systray.Run(func() {
 		systray.SetTitle(title)
@@ -74,13 +259,17 @@ func (t *Tray) Start(title string) error {
 		readyTimeout <- struct{}{}
 		close(readyTimeout)
 	}, func() {
+		t.mu.Lock()
 		t.active = false
+		t.mu.Unlock()
 	})
 
 	select {
 	case <-readyTimeout:
 		t.logger.Info("systray start confirmed")
+		t.mu.Lock()
 		t.active = true
+		t.mu.Unlock()
 		return nil
 	case <-time.After(5 * time.Second):
 		close(readyTimeout)
@@ -90,12 +279,16 @@ func (t *Tray) Start(title string) error {
 }
 
 func (t *Tray) Stop() error {
+	t.mu.Lock()
 	if !t.active {
+		t.mu.Unlock()
 		return fmt.Errorf("tray is not active")
 	}
+	t.active = false
+	t.mu.Unlock()
 
+	// Not holding t.mu, as the exit callback given to systray.Run takes it
 	systray.Quit()
-	t.active = false
 
 	return nil
 }
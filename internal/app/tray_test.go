@@ -0,0 +1,214 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	ga "github.com/Xevion/go-ha"
+)
+
+// testTrayDriver records what the tray shows instead of driving the system tray
+type testTrayDriver struct {
+	mu      sync.Mutex
+	icon    []byte
+	title   string
+	tooltip string
+}
+
+func (d *testTrayDriver) SetIcon(iconBytes []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.icon = iconBytes
+}
+
+func (d *testTrayDriver) SetTitle(title string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.title = title
+}
+
+func (d *testTrayDriver) SetTooltip(tooltip string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tooltip = tooltip
+}
+
+// shown returns the icon and tooltip last shown
+func (d *testTrayDriver) shown() ([]byte, string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.icon, d.tooltip
+}
+
+// newTestApp returns an application with an active tray recorded by the returned driver, watching the given entities
+func newTestApp(t *testing.T, entities ...EntityConfig) (*App, *testTrayDriver) {
+	t.Helper()
+
+	a := NewApp(slog.New(slog.NewTextHandler(io.Discard, nil)), "", nil)
+	driver := &testTrayDriver{}
+	a.tray.driver = driver
+	a.tray.active = true
+	a.tray.title = "HA Tray"
+	a.config = &Config{}
+	a.trackEntities(entities)
+	return a, driver
+}
+
+// iconBytesFor returns the bytes the tray shows for an icon file
+func iconBytesFor(t *testing.T, a *App, icon IconReference) []byte {
+	t.Helper()
+
+	data, err := a.tray.iconBytes(icon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// The tray is updated by lifecycle transitions, entity listeners and the icon watcher at the same time, see Tray.mu
+func TestTrayConcurrentUpdates(t *testing.T) {
+	a, driver := newTestApp(t,
+		EntityConfig{ID: "binary_sensor.door"},
+		EntityConfig{ID: "binary_sensor.window"},
+	)
+
+	a.mu.Lock()
+	a.transition(StateStarting, nil)
+	a.transition(StateConnecting, nil)
+	a.mu.Unlock()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			a.mu.Lock()
+			if i%2 == 0 {
+				a.transition(StateDegraded, nil)
+			} else {
+				a.transition(StateRunning, nil)
+			}
+			a.mu.Unlock()
+		}
+	}()
+	for _, id := range []string{"binary_sensor.door", "binary_sensor.window"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				state := "off"
+				if i%3 == 0 {
+					state = "on"
+				}
+				a.setEntityState("", id, ga.EntityState{EntityID: id, State: state})
+				a.refreshTray()
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			a.tray.SetCustomIcons(nil)
+		}
+	}()
+	wg.Wait()
+
+	a.setEntityState("", "binary_sensor.door", ga.EntityState{EntityID: "binary_sensor.door", State: "on"})
+	a.refreshTray()
+	icon, tooltip := driver.shown()
+	if !bytes.Equal(icon, iconBytesFor(t, a, IconOpen)) {
+		t.Error("expected the open icon once every update was applied")
+	}
+	if want := "binary_sensor.door: on"; !strings.Contains(tooltip, want) {
+		t.Errorf("expected the tooltip to list %q, got %q", want, tooltip)
+	}
+}
+
+// Icon files are reloaded by the icon watcher while entity updates set the icon, see App.onIconChange
+func TestTrayCustomIconsDuringUpdates(t *testing.T) {
+	a, driver := newTestApp(t, EntityConfig{ID: "binary_sensor.door"})
+
+	custom := testIconSet(t, 32)
+	path := filepath.Join(t.TempDir(), "closed.png")
+	if err := os.WriteFile(path, custom.images[0].data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	a.config = &Config{Icons: map[IconReference]string{IconClosed: path}}
+
+	a.mu.Lock()
+	a.transition(StateStarting, nil)
+	a.transition(StateConnecting, nil)
+	a.transition(StateRunning, nil)
+	a.mu.Unlock()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			a.onIconChange()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			a.setEntityState("", "binary_sensor.door", ga.EntityState{EntityID: "binary_sensor.door", State: "off"})
+			a.refreshTray()
+		}
+	}()
+	wg.Wait()
+
+	if icon, _ := driver.shown(); !bytes.Equal(icon, encodeTrayIcon(custom)) {
+		t.Error("expected the custom closed icon to be shown")
+	}
+
+	// A rendered icon is kept when the icon files are reloaded
+	rendered := []byte("rendered")
+	if err := a.tray.SetRenderedIcon(IconClosed, rendered); err != nil {
+		t.Fatal(err)
+	}
+	a.onIconChange()
+	if icon, _ := driver.shown(); !bytes.Equal(icon, rendered) {
+		t.Error("expected the rendered icon to be kept when the icon files are reloaded")
+	}
+}
+
+func TestTrayReflectsTransitions(t *testing.T) {
+	a, driver := newTestApp(t, EntityConfig{ID: "binary_sensor.door"})
+	a.setEntityState("", "binary_sensor.door", ga.EntityState{EntityID: "binary_sensor.door", State: "on"})
+
+	tests := []struct {
+		to          AppState
+		cause       error
+		wantIcon    IconReference
+		wantTooltip string
+	}{
+		{StateConnecting, nil, IconUnknown, "HA Tray (connecting)"},
+		{StateRunning, nil, IconOpen, "HA Tray\nbinary_sensor.door: on"},
+		// The entities of the servers still connected keep their icons while degraded
+		{StateDegraded, errors.New("office: EOF"), IconOpen, "HA Tray (degraded): office: EOF\nbinary_sensor.door: on"},
+	}
+
+	for _, tt := range tests {
+		a.mu.Lock()
+		a.state = tt.to
+		a.mu.Unlock()
+		a.reflectTransition(Transition{To: tt.to, Err: tt.cause})
+
+		icon, tooltip := driver.shown()
+		if !bytes.Equal(icon, iconBytesFor(t, a, tt.wantIcon)) {
+			t.Errorf("%s: expected the %s icon", tt.to, tt.wantIcon)
+		}
+		if !strings.HasPrefix(tooltip, tt.wantTooltip) {
+			t.Errorf("%s: expected the tooltip to start with %q, got %q", tt.to, tt.wantTooltip, tooltip)
+		}
+	}
+}
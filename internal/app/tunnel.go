@@ -0,0 +1,322 @@
+package app
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	// defaultKnownHosts is used to verify the SSH server's host key when tunnel.known_hosts is not set
+	defaultKnownHosts = "~/.ssh/known_hosts"
+	// tunnelTimeout is how long connecting and authenticating to the SSH server may take
+	tunnelTimeout = 15 * time.Second
+	// tunnelKeepalive is how often the SSH server is checked, a tunnel not answering within this is reconnected
+	tunnelKeepalive = 30 * time.Second
+)
+
+// tunnel forwards connections through an SSH server, like 'ssh -L'. The SSH connection is established when the tunnel
+// is created, supervised with keepalives, and re-established by the next connection forwarded after it is lost.
+type tunnel struct {
+	logger  *slog.Logger
+	address string // host:port of the SSH server
+	config  *ssh.ClientConfig
+
+	mu     sync.Mutex
+	client *ssh.Client // nil while disconnected
+	closed bool
+
+	done chan struct{} // closed by Close, stopping supervision
+}
+
+// newTunnel connects to the SSH server, authenticating with the identity file and SSH agent, and verifying its host key
+// against known_hosts
+func newTunnel(logger *slog.Logger, c TunnelConfig) (*tunnel, error) {
+	config, err := c.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tunnel{
+		logger:  logger,
+		address: c.address(),
+		config:  config,
+		done:    make(chan struct{}),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), tunnelTimeout)
+	defer cancel()
+	if _, err := t.connected(ctx); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// DialContext opens a connection to addr from the SSH server, reconnecting to it if the connection was lost
+func (t *tunnel) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, err := t.connected(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := client.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s through SSH tunnel: %w", addr, err)
+	}
+	return conn, nil
+}
+
+// Close closes the SSH connection, and every connection forwarded through it
+func (t *tunnel) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	close(t.done)
+
+	if t.client == nil {
+		return nil
+	}
+	err := t.client.Close()
+	t.client = nil
+	return err
+}
+
+// connected returns the SSH connection, connecting if there is none
+func (t *tunnel) connected(ctx context.Context) (*ssh.Client, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil, errors.New("SSH tunnel closed")
+	}
+	if t.client != nil {
+		return t.client, nil
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", t.address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SSH server %s: %w", t.address, err)
+	}
+
+	// ssh.NewClientConn does not accept a context, so the handshake is bounded by a deadline instead
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(tunnelTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, t.address, t.config)
+	if err != nil {
+		conn.Close()
+
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+			return nil, fmt.Errorf("host key of SSH server %s is not in known_hosts, connect to it once with ssh to verify and add it", t.address)
+		}
+		return nil, fmt.Errorf("failed to connect to SSH server %s: %w", t.address, err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	t.client = ssh.NewClient(sshConn, channels, requests)
+	t.logger.Info("SSH tunnel connected", "address", t.address, "user", t.config.User)
+
+	go t.supervise(t.client)
+	return t.client, nil
+}
+
+// supervise sends keepalives over an SSH connection until it is lost or the tunnel is closed, then forgets it so that
+// the next connection forwarded reconnects
+func (t *tunnel) supervise(client *ssh.Client) {
+	lost := make(chan error, 1)
+	go func() {
+		lost <- client.Wait()
+	}()
+
+	ticker := time.NewTicker(tunnelKeepalive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.done:
+			return
+		case err := <-lost:
+			t.disconnected(client, err)
+			return
+		case <-ticker.C:
+		}
+
+		// A dead connection may not fail the request until TCP gives up, so the reply is given a deadline too
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+
+		select {
+		case <-t.done:
+			return
+		case err := <-reply:
+			if err == nil {
+				continue
+			}
+			t.disconnected(client, err)
+		case <-time.After(tunnelKeepalive):
+			t.disconnected(client, errors.New("keepalive timed out"))
+		}
+		client.Close()
+		return
+	}
+}
+
+// disconnected forgets a lost SSH connection, unless it was already replaced or the tunnel closed
+func (t *tunnel) disconnected(client *ssh.Client, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.client != client {
+		return
+	}
+	t.client = nil
+	t.logger.Warn("SSH tunnel lost, it will reconnect when next used", "address", t.address, "error", err)
+}
+
+// address returns the host:port of the SSH server, defaulting to port 22
+func (c TunnelConfig) address() string {
+	if _, _, err := net.SplitHostPort(c.Host); err == nil {
+		return c.Host
+	}
+	return net.JoinHostPort(c.Host, "22")
+}
+
+// username returns the user to authenticate as, defaulting to the current user
+func (c TunnelConfig) username() (string, error) {
+	if c.User != "" {
+		return c.User, nil
+	}
+
+	current, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine the current user, set tunnel.user: %w", err)
+	}
+	// Windows usernames include the domain, e.g. DOMAIN\user
+	name := current.Username
+	if i := strings.LastIndex(name, `\`); i >= 0 {
+		name = name[i+1:]
+	}
+	return name, nil
+}
+
+// clientConfig creates the SSH client configuration
+func (c TunnelConfig) clientConfig() (*ssh.ClientConfig, error) {
+	username, err := c.username()
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := c.authMethods()
+	if err != nil {
+		return nil, err
+	}
+
+	knownHosts := c.KnownHosts
+	if knownHosts == "" {
+		knownHosts = defaultKnownHosts
+	}
+	knownHosts, err = expandConfigPath(knownHosts)
+	if err != nil {
+		return nil, err
+	}
+	callback, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tunnel.known_hosts: %w", err)
+	}
+
+	return &ssh.ClientConfig{
+		User:              username,
+		Auth:              auth,
+		HostKeyCallback:   callback,
+		HostKeyAlgorithms: hostKeyAlgorithms(callback, c.address()),
+		Timeout:           tunnelTimeout,
+	}, nil
+}
+
+// authMethods returns the identity file, if configured, followed by the keys in the SSH agent, if running
+func (c TunnelConfig) authMethods() ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+
+	if c.IdentityFile != "" {
+		pem, err := readConfigFile(c.IdentityFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tunnel.identity_file: %w", err)
+		}
+
+		signer, err := ssh.ParsePrivateKey(pem)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			return nil, errors.New("tunnel.identity_file is encrypted, add it to your SSH agent and remove identity_file instead")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid tunnel.identity_file: %w", err)
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		// The agent is connected to on each authentication, so that a restarted agent is picked up when reconnecting
+		methods = append(methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			conn, err := net.Dial("unix", socket)
+			if err != nil {
+				return nil, fmt.Errorf("failed to connect to SSH agent: %w", err)
+			}
+			defer conn.Close()
+			return agent.NewClient(conn).Signers()
+		}))
+	}
+
+	if len(methods) == 0 {
+		return nil, errors.New("no SSH credentials, set tunnel.identity_file or start an SSH agent (SSH_AUTH_SOCK)")
+	}
+	return methods, nil
+}
+
+// hostKeyAlgorithms returns the algorithms of the host keys known for address, so that the SSH server is asked for a
+// key that can be verified, rather than its preferred one. Returns nil (any algorithm) if no keys are known.
+func hostKeyAlgorithms(callback ssh.HostKeyCallback, address string) []string {
+	// A placeholder key never matches, so the error lists the keys known for the host
+	placeholder, _ := ssh.NewPublicKey(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)).Public())
+
+	var keyErr *knownhosts.KeyError
+	if !errors.As(callback(address, &net.TCPAddr{IP: net.IPv4zero}, placeholder), &keyErr) {
+		return nil
+	}
+
+	var algorithms []string
+	for _, known := range keyErr.Want {
+		switch keyType := known.Key.Type(); keyType {
+		case ssh.KeyAlgoRSA:
+			// RSA keys are verified with SHA-2 signatures, SHA-1 is disabled by modern servers
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algorithms = append(algorithms, keyType)
+		}
+	}
+	return algorithms
+}
@@ -0,0 +1,271 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSSHServer is an SSH server forwarding connections like 'ssh -L', accepting a single client key
+type testSSHServer struct {
+	address string
+	hostKey ssh.PublicKey
+	config  *ssh.ServerConfig
+
+	mu    sync.Mutex
+	conns []*ssh.ServerConn // every connection accepted, including closed ones
+}
+
+// newTestSSHServer starts an SSH server, returning it and the path of the client's identity file
+func newTestSSHServer(t *testing.T) (*testSSHServer, string) {
+	t.Helper()
+
+	_, hostPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, err := ssh.NewSignerFromKey(hostPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientPublic, clientPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	authorized, err := ssh.NewPublicKey(clientPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(clientPrivate, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(identityFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, errors.New("unauthorized key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	s := &testSSHServer{address: listener.Addr().String(), hostKey: hostSigner.PublicKey(), config: config}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(s.drop)
+
+	return s, identityFile
+}
+
+// serve serves a single SSH connection, forwarding its direct-tcpip channels
+func (s *testSSHServer) serve(conn net.Conn) {
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	s.mu.Lock()
+	s.conns = append(s.conns, serverConn)
+	s.mu.Unlock()
+
+	go ssh.DiscardRequests(requests)
+	for channel := range channels {
+		if channel.ChannelType() != "direct-tcpip" {
+			channel.Reject(ssh.UnknownChannelType, "only direct-tcpip is supported")
+			continue
+		}
+
+		var target struct {
+			Host       string
+			Port       uint32
+			OriginHost string
+			OriginPort uint32
+		}
+		if err := ssh.Unmarshal(channel.ExtraData(), &target); err != nil {
+			channel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		upstream, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+		if err != nil {
+			channel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		forwarded, forwardedRequests, err := channel.Accept()
+		if err != nil {
+			upstream.Close()
+			continue
+		}
+		go ssh.DiscardRequests(forwardedRequests)
+		go func() {
+			io.Copy(upstream, forwarded)
+			upstream.Close()
+		}()
+		go func() {
+			io.Copy(forwarded, upstream)
+			forwarded.Close()
+		}()
+	}
+}
+
+// connections returns how many SSH connections were accepted
+func (s *testSSHServer) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// drop closes every SSH connection, as if the server restarted
+func (s *testSSHServer) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// writeKnownHosts writes a known_hosts file listing the given keys for address
+func writeKnownHosts(t *testing.T, address string, keys ...ssh.PublicKey) string {
+	t.Helper()
+
+	var lines []string
+	for _, key := range keys {
+		lines = append(lines, knownhosts.Line([]string{address}, key))
+	}
+	filename := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestTunnelKnownHosts(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	server, identityFile := newTestSSHServer(t)
+
+	otherPublic, _, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _ := ssh.NewPublicKey(otherPublic)
+
+	tests := []struct {
+		name    string
+		keys    []ssh.PublicKey
+		wantErr string
+	}{
+		{"known host", []ssh.PublicKey{server.hostKey}, ""},
+		{"unknown host", nil, "is not in known_hosts"},
+		{"changed host key", []ssh.PublicKey{otherKey}, "key mismatch"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := TunnelConfig{
+				Host:         server.address,
+				User:         "hatray",
+				IdentityFile: identityFile,
+				KnownHosts:   writeKnownHosts(t, server.address, tt.keys...),
+			}
+
+			tunnel, err := newTunnel(slog.New(slog.NewTextHandler(io.Discard, nil)), config)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tunnel.Close()
+		})
+	}
+}
+
+func TestTunnelReconnects(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	server, identityFile := newTestSSHServer(t)
+
+	upstream := httptest.NewServer(testHomeAssistant())
+	defer upstream.Close()
+
+	config := ServerConfig{
+		URL: upstream.URL,
+		Tunnel: TunnelConfig{
+			Host:         server.address,
+			User:         "hatray",
+			IdentityFile: identityFile,
+			KnownHosts:   writeKnownHosts(t, server.address, server.hostKey),
+		},
+	}
+	g, err := newGateway(slog.New(slog.NewTextHandler(io.Discard, nil)), config, testAPIKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	get := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		request, _ := http.NewRequestWithContext(ctx, http.MethodGet, g.url+"/api/states", nil)
+		request.Header.Set("Authorization", "Bearer "+g.token)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return fmt.Errorf("status %d", response.StatusCode)
+		}
+		return nil
+	}
+
+	if err := get(); err != nil {
+		t.Fatalf("expected the request through the tunnel to succeed: %v", err)
+	}
+
+	server.drop()
+
+	// Requests fail until the tunnel notices the connection was lost, then reconnect it
+	deadline := time.Now().Add(10 * time.Second)
+	for get() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the tunnel to reconnect after the SSH server dropped it")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if connections := server.connections(); connections != 2 {
+		t.Errorf("expected the tunnel to reconnect once, got %d connections", connections)
+	}
+}
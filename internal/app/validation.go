@@ -0,0 +1,521 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// ValidationError describes a single problem with a configuration value
+type ValidationError struct {
+	Path    string // TOML key path, e.g. entity[1].id
+	File    string // drop-in file the value was defined in, empty for the main configuration file
+	Line    int    // line in the configuration file, 0 if unknown (e.g. set by an environment variable)
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	switch {
+	case e.Line > 0 && e.File != "":
+		return fmt.Sprintf("%s:%d: %s: %s", e.File, e.Line, e.Path, e.Message)
+	case e.Line > 0:
+		return fmt.Sprintf("line %d: %s: %s", e.Line, e.Path, e.Message)
+	default:
+		return fmt.Sprintf("%s: %s", e.Path, e.Message)
+	}
+}
+
+// ValidationErrors is every problem found while validating a configuration, ordered by file and line
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d configuration problem(s) found", len(e))
+	for _, problem := range e {
+		b.WriteString("\n  ")
+		b.WriteString(problem.Error())
+	}
+	return b.String()
+}
+
+// validator collects validation errors for a configuration
+type validator struct {
+	meta   *configMeta
+	errors ValidationErrors
+}
+
+// add records a problem with the value at path
+func (v *validator) add(path string, format string, args ...any) {
+	problem := ValidationError{Path: path, Message: fmt.Sprintf(format, args...)}
+	if v.meta != nil {
+		problem.File, problem.Line = v.meta.location(path)
+		if v.overridden(path) {
+			problem.Message += fmt.Sprintf(" (set by %s)", v.meta.source(path).Name)
+		}
+	}
+	v.errors = append(v.errors, problem)
+}
+
+// overridden returns true if the value at path was set by an environment variable or --set flag
+func (v *validator) overridden(path string) bool {
+	if v.meta == nil {
+		return false
+	}
+	kind := v.meta.source(path).Kind
+	return kind == SourceEnv || kind == SourceFlag
+}
+
+// err returns the collected problems ordered by file and line (the main file first, problems without a line last),
+// or nil if there are none
+func (v *validator) err() error {
+	if len(v.errors) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(v.errors, func(i, j int) bool {
+		a, b := v.errors[i], v.errors[j]
+		if a.Line == 0 || b.Line == 0 {
+			return a.Line != 0 && b.Line == 0
+		}
+		if a.File != b.File {
+			return a.File < b.File // drop-ins are merged in lexical order
+		}
+		return a.Line < b.Line
+	})
+	return v.errors
+}
+
+// Validate checks if the configuration is valid
+// Every problem is collected rather than stopping at the first, any returned error is ValidationErrors.
+func (c *Config) Validate() error {
+	v := &validator{meta: c.meta}
+
+	if len(c.Servers) == 0 {
+		v.add("server", "at least one server is required")
+	}
+
+	servers := make(map[string]bool, len(c.Servers))
+	for i, server := range c.Servers {
+		path := fmt.Sprintf("server[%d]", i)
+
+		switch {
+		case server.Name == "":
+			v.add(path+".name", "name is required when multiple servers are configured")
+		case !serverNamePattern.MatchString(server.Name):
+			v.add(path+".name", "invalid server name %q, expected lowercase letters, digits, '-' or '_'", server.Name)
+		case servers[server.Name]:
+			v.add(path+".name", "server %q is defined more than once", server.Name)
+		}
+		servers[server.Name] = true
+
+		if server.URL == "" {
+			v.add(path+".url", "server address is required")
+		} else if err := ValidateServerURL(server.URL); err != nil {
+			v.add(path+".url", "%v", err)
+		}
+
+		if server.apiKeySource() == "" {
+			v.add(path+".api_key", "API key is required (api_key, api_key_encrypted, api_key_file, api_key_command or the %q systemd credential)", server.credentialName())
+		}
+		// A source set by an environment variable or flag takes precedence over those in the files, e.g.
+		// HATRAY_SERVER_0_API_KEY in place of api_key_file, but several sources in the files are ambiguous
+		if sources := server.apiKeySources(); len(sources) > 1 && !v.overridden(path+"."+sources[0]) {
+			v.add(path+"."+sources[1], "only one of %s may be set", strings.Join(sources, ", "))
+		}
+
+		if server.Proxy != "" && server.Proxy != directProxy {
+			if _, err := parseProxyURL(server.Proxy); err != nil {
+				v.add(path+".proxy", "%v", err)
+			}
+		}
+
+		v.validateTLS(path+".tls", server.TLS)
+
+		if server.Tunnel != (TunnelConfig{}) {
+			if server.Proxy != "" && server.Proxy != directProxy {
+				v.add(path+".proxy", "proxy cannot be combined with tunnel, the server is connected to from the SSH server")
+			}
+			v.validateTunnel(path+".tunnel", server.Tunnel)
+		}
+	}
+
+	if len(c.Entities) == 0 && len(c.Aggregates) == 0 {
+		v.add("entity", "at least one entity or aggregate is required")
+	}
+
+	seen := make(map[string]bool, len(c.Entities))
+	for i, entity := range c.Entities {
+		path := fmt.Sprintf("entity[%d]", i)
+
+		switch {
+		case entity.Server == "":
+			v.add(path+".server", "server is required when multiple servers are configured")
+		case !servers[entity.Server]:
+			v.add(path+".server", "unknown server %q", entity.Server)
+		}
+
+		if !entityIdPattern.MatchString(entity.ID) {
+			v.add(path+".id", "invalid entity id %q, expected <domain>.<object_id> (e.g. binary_sensor.front_door)", entity.ID)
+		} else if seen[entity.key()] {
+			v.add(path+".id", "entity %q is defined more than once for server %q", entity.ID, entity.Server)
+		}
+		seen[entity.key()] = true
+
+		for state, icon := range entity.Icons {
+			if !icon.Valid() {
+				v.add(path+".icons."+formatKey(state), "%v", unknownIconError(icon))
+			}
+		}
+
+		for j, rule := range entity.Rules {
+			v.validateRule(fmt.Sprintf("%s.rule[%d]", path, j), rule)
+		}
+
+		if entity.Threshold != (ThresholdConfig{}) {
+			v.validateThreshold(path+".threshold", entity.Threshold)
+		}
+	}
+
+	aggregates := make(map[string]bool, len(c.Aggregates))
+	for i, aggregate := range c.Aggregates {
+		path := fmt.Sprintf("aggregate[%d]", i)
+
+		switch {
+		case aggregate.Name == "":
+			v.add(path+".name", "name is required")
+		case aggregates[aggregate.key()]:
+			v.add(path+".name", "aggregate %q is defined more than once for server %q", aggregate.Name, aggregate.Server)
+		}
+		aggregates[aggregate.key()] = true
+
+		switch {
+		case aggregate.Server == "":
+			v.add(path+".server", "server is required when multiple servers are configured")
+		case !servers[aggregate.Server]:
+			v.add(path+".server", "unknown server %q", aggregate.Server)
+		}
+
+		v.validateAggregate(path, aggregate)
+	}
+
+	for icon, file := range c.Icons {
+		path := "icons." + formatKey(string(icon))
+		switch {
+		case !icon.Valid():
+			v.add(path, "%v", unknownIconError(icon))
+		case file == "":
+			v.add(path, "icon file is required")
+		}
+	}
+
+	for key, text := range map[string]string{
+		"title":      c.Tray.Title,
+		"tooltip":    c.Tray.Tooltip,
+		"icon_text":  c.Tray.IconText,
+		"icon_badge": c.Tray.IconBadge,
+	} {
+		if _, err := parseTemplate("tray."+key, text); err != nil {
+			v.add("tray."+key, "%v", err)
+		}
+	}
+	v.validateTrayIcon(c.Tray)
+
+	if c.meta != nil {
+		unknown := make(map[string]bool, len(c.meta.unknown))
+		for _, found := range c.meta.unknown {
+			// Keys within an unknown table are implied by the table itself
+			key := found.key
+			unknown[found.file+":"+key.String()] = true
+			if len(key) > 1 && unknown[found.file+":"+key[:len(key)-1].String()] {
+				continue
+			}
+
+			message := "unknown key"
+			if suggestion := suggestKey(key); suggestion != "" {
+				message = fmt.Sprintf("unknown key, did you mean %q?", suggestion)
+			}
+
+			problem := ValidationError{Path: formatKeys(key), File: found.file, Line: found.line, Message: message}
+			if found.file == c.meta.file {
+				problem.File = ""
+			}
+			v.errors = append(v.errors, problem)
+		}
+	}
+
+	return v.err()
+}
+
+// validateTrayIcon checks the glyph and colors of the rendered tray icon. A badge given as a template is checked when
+// it is rendered instead.
+func (v *validator) validateTrayIcon(c TrayConfig) {
+	if c.IconGlyph != "" && !c.IconGlyph.Valid() {
+		v.add("tray.icon_glyph", "unknown glyph %q, expected one of %q, %q or %q", c.IconGlyph, GlyphCircle, GlyphSquare, GlyphRing)
+	}
+
+	if c.IconBadge != "" && !strings.Contains(c.IconBadge, "{{") {
+		if _, err := parseColor(c.IconBadge); err != nil {
+			v.add("tray.icon_badge", "%v", err)
+		}
+	}
+
+	for icon, value := range c.IconColors {
+		path := "tray.icon_colors." + formatKey(string(icon))
+		if !icon.Valid() {
+			v.add(path, "%v", unknownIconError(icon))
+			continue
+		}
+		if _, err := parseColor(value); err != nil {
+			v.add(path, "%v", err)
+		}
+	}
+}
+
+// validateRule checks that a rule has a valid icon, and conditions that can match
+func (v *validator) validateRule(path string, r RuleConfig) {
+	switch {
+	case r.Icon == "":
+		v.add(path+".icon", "icon is required")
+	case !r.Icon.Valid():
+		v.add(path+".icon", "%v", unknownIconError(r.Icon))
+	}
+
+	if r.Regex != "" {
+		if _, err := regexp.Compile(r.Regex); err != nil {
+			v.add(path+".regex", "invalid regex: %v", err)
+		}
+	}
+
+	if r.Above != nil && r.Below != nil && *r.Above >= *r.Below {
+		v.add(path+".below", "below (%v) must be greater than above (%v), or no state can match", *r.Below, *r.Above)
+	}
+}
+
+// validateThreshold checks that a threshold has levels, and that they are ordered so that each can be reached
+func (v *validator) validateThreshold(path string, c ThresholdConfig) {
+	if !c.configured() {
+		v.add(path, "at least one of warn_above, warn_below, critical_above or critical_below is required")
+		return
+	}
+
+	if c.WarnAbove != nil && c.CriticalAbove != nil && *c.CriticalAbove <= *c.WarnAbove {
+		v.add(path+".critical_above", "critical_above (%v) must be greater than warn_above (%v)", *c.CriticalAbove, *c.WarnAbove)
+	}
+	if c.WarnBelow != nil && c.CriticalBelow != nil && *c.CriticalBelow >= *c.WarnBelow {
+		v.add(path+".critical_below", "critical_below (%v) must be less than warn_below (%v)", *c.CriticalBelow, *c.WarnBelow)
+	}
+
+	// Every value would be past a level if the highest below bound were above the lowest above bound
+	below, above := math.Inf(-1), math.Inf(1)
+	for _, bound := range []*float64{c.WarnBelow, c.CriticalBelow} {
+		if bound != nil {
+			below = max(below, *bound)
+		}
+	}
+	for _, bound := range []*float64{c.WarnAbove, c.CriticalAbove} {
+		if bound != nil {
+			above = min(above, *bound)
+		}
+	}
+	if below >= above {
+		v.add(path, "below levels (%v) must be less than above levels (%v), or every value is past a level", below, above)
+	}
+
+	if c.Hysteresis < 0 {
+		v.add(path+".hysteresis", "hysteresis cannot be negative")
+	}
+}
+
+// validateAggregate checks that an aggregate has members, and a mode and icons that are known
+func (v *validator) validateAggregate(path string, c AggregateConfig) {
+	if len(c.Entities) == 0 && c.Domain == "" {
+		v.add(path+".entities", "entities or domain is required")
+	}
+	for j, entity := range c.Entities {
+		switch {
+		case isGlob(entity):
+			if _, err := matchMember(entity, ""); err != nil {
+				v.add(fmt.Sprintf("%s.entities[%d]", path, j), "invalid pattern %q: %v", entity, err)
+			}
+		case !entityIdPattern.MatchString(entity):
+			v.add(fmt.Sprintf("%s.entities[%d]", path, j), "invalid entity id %q, expected <domain>.<object_id> (e.g. binary_sensor.front_door) or a pattern (e.g. binary_sensor.*_door)", entity)
+		}
+	}
+	if c.Domain != "" && !domainPattern.MatchString(c.Domain) {
+		v.add(path+".domain", "invalid domain %q, expected e.g. binary_sensor", c.Domain)
+	}
+
+	if c.Mode != "" && !c.Mode.Valid() {
+		v.add(path+".mode", "unknown mode %q, expected one of %q, %q or %q", c.Mode, AggregateAny, AggregateAll, AggregateCount)
+	}
+	switch {
+	case c.Threshold < 0:
+		v.add(path+".threshold", "threshold must be at least 1")
+	case c.Threshold > 0 && c.mode() != AggregateCount:
+		v.add(path+".threshold", "threshold only applies to mode %q", AggregateCount)
+	}
+
+	for key, icon := range map[string]IconReference{"icon": c.Icon, "idle_icon": c.IdleIcon} {
+		if icon != "" && !icon.Valid() {
+			v.add(path+"."+key, "%v", unknownIconError(icon))
+		}
+	}
+}
+
+// validateTLS checks that TLS options are complete and consistent, and that the files they reference exist
+func (v *validator) validateTLS(path string, c TLSConfig) {
+	for key, file := range map[string]string{"ca_file": c.CAFile, "client_cert": c.ClientCert, "client_key": c.ClientKey} {
+		if file == "" {
+			continue
+		}
+		if _, err := readConfigFile(file); err != nil {
+			v.add(path+"."+key, "%v", err)
+		}
+	}
+
+	if (c.ClientCert == "") != (c.ClientKey == "") {
+		v.add(path, "client_cert and client_key must be set together")
+	}
+
+	if c.Fingerprint != "" {
+		if _, err := parseFingerprint(c.Fingerprint); err != nil {
+			v.add(path+".fingerprint", "%v", err)
+		}
+	}
+
+	if c.Insecure && (c.CAFile != "" || c.Fingerprint != "") {
+		v.add(path+".insecure", "insecure disables certificate verification, so cannot be combined with ca_file or fingerprint")
+	}
+}
+
+// validateTunnel checks that the SSH server is set, and that the files used to connect to it exist
+func (v *validator) validateTunnel(path string, c TunnelConfig) {
+	if c.Host == "" {
+		v.add(path+".host", "SSH server is required")
+	}
+
+	if c.IdentityFile != "" {
+		if _, err := readConfigFile(c.IdentityFile); err != nil {
+			v.add(path+".identity_file", "%v", err)
+		}
+	}
+
+	knownHosts := c.KnownHosts
+	if knownHosts == "" {
+		knownHosts = defaultKnownHosts
+	}
+	if _, err := readConfigFile(knownHosts); err != nil {
+		v.add(path+".known_hosts", "%v, connect to the SSH server once with ssh to verify and add its host key", err)
+	}
+}
+
+// ValidateServerURL checks that the server is an absolute http(s) URL
+func ValidateServerURL(server string) error {
+	u, err := url.Parse(server)
+	if err != nil {
+		return fmt.Errorf("invalid server URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("server URL must use http or https, e.g. https://homeassistant.local:8123")
+	}
+	if u.Host == "" {
+		return fmt.Errorf("server URL is missing a host, e.g. https://homeassistant.local:8123")
+	}
+	return nil
+}
+
+// suggestKey returns the known key closest to an unknown key, or an empty string if none are close enough to be a typo
+func suggestKey(key toml.Key) string {
+	if len(key) == 0 {
+		return ""
+	}
+	name := key[len(key)-1]
+
+	best, bestDistance := "", 3 // suggestions must be within two edits
+	for _, known := range knownKeys(key[:len(key)-1]) {
+		if distance := levenshtein(name, known); distance < bestDistance {
+			best, bestDistance = known, distance
+		}
+	}
+	return best
+}
+
+// knownKeys returns the TOML keys of the configuration table found at path, or nil if path is not a table
+func knownKeys(path []string) []string {
+	t := reflect.TypeOf(Config{})
+	for _, key := range path {
+		field, ok := fieldByTOMLKey(t, key)
+		if !ok {
+			return nil
+		}
+		t = field.Type
+		for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return nil
+		}
+	}
+
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		if name := tomlName(t.Field(i)); name != "" {
+			keys = append(keys, name)
+		}
+	}
+	return keys
+}
+
+// fieldByTOMLKey finds the struct field decoded from the given TOML key
+func fieldByTOMLKey(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if tomlName(t.Field(i)) == key {
+			return t.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// tomlName returns the TOML key of a struct field, or an empty string if the field is not encoded
+func tomlName(field reflect.StructField) string {
+	if !field.IsExported() {
+		return ""
+	}
+	name, _, _ := strings.Cut(field.Tag.Get("toml"), ",")
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// levenshtein returns the edit distance between two strings
+func levenshtein(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
@@ -0,0 +1,157 @@
+package app
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a configuration file to a temporary directory, returning its path
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// loadTestConfig writes and loads a configuration file, failing the test if it cannot be loaded
+func loadTestConfig(t *testing.T, content string) *Config {
+	t.Helper()
+	config, err := LoadConfig(writeConfig(t, content))
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	return config
+}
+
+// validationErrors validates the configuration, failing the test unless it is invalid
+func validationErrors(t *testing.T, config *Config) ValidationErrors {
+	t.Helper()
+	var problems ValidationErrors
+	if err := config.Validate(); !errors.As(err, &problems) {
+		t.Fatalf("expected ValidationErrors, got %v", err)
+	}
+	return problems
+}
+
+func TestValidateValid(t *testing.T) {
+	config := loadTestConfig(t, `version = 3
+
+[[server]]
+url = "https://homeassistant.local:8123"
+api_key = "token"
+
+[[entity]]
+id = "binary_sensor.front_door"
+`)
+	if err := config.Validate(); err != nil {
+		t.Fatalf("expected a valid config, got %v", err)
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	config := loadTestConfig(t, `version = 3
+
+[[server]]
+url = "ftp://homeassistant.local"
+
+[[entity]]
+id = "front door"
+
+[[entity]]
+id = "binary_sensor.window"
+icons = { on = "ajar" }
+`)
+
+	problems := validationErrors(t, config)
+	want := []struct {
+		path string
+		line int
+		text string
+	}{
+		{"server[0].api_key", 3, "API key is required"}, // missing keys are reported at their table
+		{"server[0].url", 4, "must use http or https"},
+		{"entity[0].id", 7, "invalid entity id"},
+		{"entity[1].icons.on", 11, `unknown icon "ajar"`},
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("expected %d problems, got %d: %v", len(want), len(problems), problems)
+	}
+	for i, w := range want {
+		problem := problems[i]
+		if problem.Path != w.path || problem.Line != w.line || !strings.Contains(problem.Message, w.text) {
+			t.Errorf("problem %d: expected %s at line %d containing %q, got %+v", i, w.path, w.line, w.text, problem)
+		}
+	}
+}
+
+func TestValidateSuggestsKeys(t *testing.T) {
+	config := loadTestConfig(t, `version = 3
+
+[[server]]
+url = "https://homeassistant.local:8123"
+api_key = "token"
+
+[[entity]]
+id = "binary_sensor.front_door"
+lable = "Front Door"
+colour = "red"
+`)
+
+	problems := validationErrors(t, config)
+	if len(problems) != 2 {
+		t.Fatalf("expected 2 problems, got %v", problems)
+	}
+	if got := problems[0].Error(); got != `line 9: entity.lable: unknown key, did you mean "label"?` {
+		t.Errorf("unexpected problem: %s", got)
+	}
+	if got := problems[1].Error(); got != `line 10: entity.colour: unknown key` {
+		t.Errorf("unexpected problem: %s", got)
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"label", "label", 0},
+		{"lable", "label", 2},
+		{"labels", "label", 1},
+		{"", "icon", 4},
+		{"kitten", "sitting", 3},
+	}
+	for _, tt := range tests {
+		if got := levenshtein(tt.a, tt.b); got != tt.want {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestMissingIconFileIsWarning(t *testing.T) {
+	config := loadTestConfig(t, `version = 3
+
+[[server]]
+url = "https://homeassistant.local:8123"
+api_key = "token"
+
+[[entity]]
+id = "binary_sensor.front_door"
+
+[icons]
+open = "/nonexistent/door-open.png"
+`)
+
+	if err := config.Validate(); err != nil {
+		t.Fatalf("expected a missing icon file to be valid, got %v", err)
+	}
+	warnings := config.Warnings()
+	if len(warnings) != 1 || !strings.HasPrefix(warnings[0], "line 11: icons.open: ") {
+		t.Fatalf("expected a warning for icons.open, got %q", warnings)
+	}
+}
@@ -0,0 +1,164 @@
+package app
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long watched files must remain unchanged before the change is reported
+// Editors often write a file in several steps (truncate, write, chmod, rename), each producing an event.
+const watchDebounce = 500 * time.Millisecond
+
+// fileWatcher reports changes to a set of files, coalescing bursts of events into a single call to onChange.
+// The parent directories are watched rather than the files themselves, as many editors save by renaming a new file over
+// the old one, which would otherwise silently end a watch on the original file.
+type fileWatcher struct {
+	logger   *slog.Logger
+	watcher  *fsnotify.Watcher
+	onChange func()
+	debounce time.Duration // see watchDebounce
+
+	mu       sync.Mutex
+	files    map[string]bool // cleaned absolute paths of watched files
+	patterns map[string]bool // cleaned absolute glob patterns of watched files, see filepath.Match
+	timer    *time.Timer     // pending debounced change, nil if none
+}
+
+// newFileWatcher creates a watcher that calls onChange (in its own goroutine) once changes to watched files settle
+func newFileWatcher(logger *slog.Logger, onChange func()) (*fileWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file watcher: %w", err)
+	}
+
+	w := &fileWatcher{
+		logger:   logger,
+		watcher:  watcher,
+		onChange: onChange,
+		debounce: watchDebounce,
+		files:    make(map[string]bool),
+		patterns: make(map[string]bool),
+	}
+	go w.run()
+
+	return w, nil
+}
+
+// Watch adds files to the watcher, the files themselves do not need to exist yet but their directories do
+func (w *fileWatcher) Watch(paths ...string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, path := range paths {
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", path, err)
+		}
+
+		// Adding a directory twice is a no-op for fsnotify
+		if err := w.watcher.Add(filepath.Dir(path)); err != nil {
+			return fmt.Errorf("failed to watch %s: %w", filepath.Dir(path), err)
+		}
+		w.files[path] = true
+	}
+
+	return nil
+}
+
+// WatchPattern adds every file matching a glob pattern to the watcher, including files created later
+// Only the final element of the pattern may contain wildcards, and the directory must exist.
+func (w *fileWatcher) WatchPattern(pattern string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	pattern, err := filepath.Abs(pattern)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", pattern, err)
+	}
+
+	if err := w.watcher.Add(filepath.Dir(pattern)); err != nil {
+		return fmt.Errorf("failed to watch %s: %w", filepath.Dir(pattern), err)
+	}
+	w.patterns[pattern] = true
+
+	return nil
+}
+
+// watching returns true if the path is a watched file, or matches a watched pattern. The caller must hold w.mu.
+func (w *fileWatcher) watching(path string) bool {
+	if w.files[path] {
+		return true
+	}
+	for pattern := range w.patterns {
+		if matched, _ := filepath.Match(pattern, path); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Close stops watching, discarding any pending change. It does not wait for an in-flight onChange call to return.
+func (w *fileWatcher) Close() error {
+	w.mu.Lock()
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	w.mu.Unlock()
+
+	return w.watcher.Close()
+}
+
+// run processes events until the underlying watcher is closed
+func (w *fileWatcher) run() {
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			w.handle(event)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			w.logger.Warn("file watcher error", "error", err)
+		}
+	}
+}
+
+// handle (re)starts the debounce timer if the event concerns a watched file
+func (w *fileWatcher) handle(event fsnotify.Event) {
+	if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) && !event.Has(fsnotify.Rename) && !event.Has(fsnotify.Remove) {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.watching(filepath.Clean(event.Name)) {
+		return
+	}
+
+	w.logger.Debug("watched file changed", "path", event.Name, "op", event.Op.String())
+
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(w.debounce, func() {
+		w.mu.Lock()
+		if w.timer == timer {
+			w.timer = nil
+		}
+		w.mu.Unlock()
+
+		w.onChange()
+	})
+	w.timer = timer
+}
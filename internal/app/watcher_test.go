@@ -0,0 +1,153 @@
+package app
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// watchTestDebounce is the debounce used by tests, short enough to keep them quick
+const watchTestDebounce = 50 * time.Millisecond
+
+// newTestWatcher returns a watcher with a short debounce, and a channel receiving its changes
+func newTestWatcher(t *testing.T) (*fileWatcher, <-chan struct{}) {
+	t.Helper()
+
+	changes := make(chan struct{}, 16)
+	w, err := newFileWatcher(slog.New(slog.NewTextHandler(io.Discard, nil)), func() { changes <- struct{}{} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.mu.Lock()
+	w.debounce = watchTestDebounce
+	w.mu.Unlock()
+	t.Cleanup(func() { w.Close() })
+
+	return w, changes
+}
+
+// expectChanges waits for changes to settle, then checks the number reported
+func expectChanges(t *testing.T, changes <-chan struct{}, want int) {
+	t.Helper()
+
+	got := 0
+	timeout := time.After(2 * time.Second)
+	for got < want {
+		select {
+		case <-changes:
+			got++
+		case <-timeout:
+			t.Fatalf("expected %d changes, got %d", want, got)
+		}
+	}
+
+	select {
+	case <-changes:
+		t.Errorf("expected %d changes, got more", want)
+	case <-time.After(4 * watchTestDebounce):
+	}
+}
+
+func writeWatchedFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatcherDebounce(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.toml")
+	writeWatchedFile(t, path, "version = 3\n")
+
+	w, changes := newTestWatcher(t)
+	if err := w.Watch(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// A burst of writes, each within the debounce of the previous, is reported once
+	for i := 0; i < 5; i++ {
+		writeWatchedFile(t, path, "version = 3\n# edited\n")
+		time.Sleep(watchTestDebounce / 5)
+	}
+	expectChanges(t, changes, 1)
+
+	// Other files in the directory are ignored
+	writeWatchedFile(t, filepath.Join(dir, "other.toml"), "")
+	expectChanges(t, changes, 0)
+
+	writeWatchedFile(t, path, "version = 3\n")
+	expectChanges(t, changes, 1)
+}
+
+func TestWatcherAtomicSave(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.toml")
+	writeWatchedFile(t, path, "version = 3\n")
+
+	w, changes := newTestWatcher(t)
+	if err := w.Watch(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Saved by renaming a new file over the old one, which must not end the watch
+	for i := 0; i < 2; i++ {
+		temp := filepath.Join(dir, ".config.toml.swp")
+		writeWatchedFile(t, temp, "version = 3\n# saved\n")
+		if err := os.Rename(temp, path); err != nil {
+			t.Fatal(err)
+		}
+		expectChanges(t, changes, 1)
+	}
+
+	// Files may be watched before they exist, and removed
+	missing := filepath.Join(dir, "config.d.toml")
+	if err := w.Watch(missing); err != nil {
+		t.Fatal(err)
+	}
+	writeWatchedFile(t, missing, "")
+	expectChanges(t, changes, 1)
+	os.Remove(missing)
+	expectChanges(t, changes, 1)
+}
+
+func TestWatcherPattern(t *testing.T) {
+	dir := t.TempDir()
+
+	w, changes := newTestWatcher(t)
+	if err := w.WatchPattern(filepath.Join(dir, "*.toml")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files created after the pattern was added are watched
+	writeWatchedFile(t, filepath.Join(dir, "10-office.toml"), "")
+	expectChanges(t, changes, 1)
+
+	writeWatchedFile(t, filepath.Join(dir, "notes.txt"), "")
+	expectChanges(t, changes, 0)
+
+	if err := w.WatchPattern(filepath.Join(dir, "missing", "*.toml")); err == nil {
+		t.Error("expected a pattern in a missing directory to be rejected")
+	}
+}
+
+func TestWatcherClose(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.toml")
+
+	w, changes := newTestWatcher(t)
+	if err := w.Watch(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// A change pending when the watcher is closed is discarded
+	writeWatchedFile(t, path, "version = 3\n")
+	time.Sleep(watchTestDebounce / 5)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expectChanges(t, changes, 0)
+}
@@ -0,0 +1,161 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"text/tabwriter"
+
+	"ha-tray/internal/app"
+)
+
+// This package implements the command-line subcommands. When any arguments remain after flags are parsed, the command
+// layer runs them here instead of starting the service. Subcommands print to stdout/stderr rather than the log file.
+
+// Run executes the subcommand described by args, returning the process exit code
+// configPath is the value of the --config flag, empty to auto-discover, and configFlags the values of any --set flags.
+func Run(args []string, configPath string, configFlags []string) int {
+	if err := run(os.Stdout, args, configPath, configFlags); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// Usage prints the available subcommands
+func Usage(w io.Writer) {
+	fmt.Fprintln(w, "Subcommands:")
+	fmt.Fprintln(w, "  config init           interactively create the configuration file, verifying the connection")
+	fmt.Fprintln(w, "  config show [--redacted]")
+	fmt.Fprintln(w, "                        print the effective (merged) configuration, and where each value came from,")
+	fmt.Fprintln(w, "                        with --redacted masking API keys and other secrets, e.g. for bug reports")
+	fmt.Fprintln(w, "  config validate       check the configuration file, reporting every problem found")
+	fmt.Fprintln(w, "  config get <key>      print an effective configuration value, e.g. server[0].url")
+	fmt.Fprintln(w, "  config set <key> <value>")
+	fmt.Fprintln(w, "                        set a value in the configuration file, preserving its comments and layout")
+	fmt.Fprintln(w, "  config unset <key>    remove a value or table (e.g. entity[1]) from the configuration file")
+	fmt.Fprintln(w, "  config encrypt-key    encrypt the plaintext api_key in the configuration file, in place")
+}
+
+func run(w io.Writer, args []string, configPath string, configFlags []string) error {
+	switch args[0] {
+	case "config":
+		return runConfig(w, args[1:], configPath, configFlags)
+	default:
+		Usage(os.Stderr)
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+}
+
+// runConfig executes 'config' subcommands, which operate on the resolved configuration file
+func runConfig(w io.Writer, args []string, configPath string, configFlags []string) error {
+	if len(args) == 0 {
+		Usage(os.Stderr)
+		return fmt.Errorf("missing config subcommand")
+	}
+
+	path, err := app.ResolveConfigPath(configPath)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "init":
+		return runInit(w, args[1:], path)
+	case "show":
+		return runShow(w, args[1:], path, configFlags)
+	case "validate":
+		config, err := loadConfig(path, configFlags)
+		if err != nil {
+			return err
+		}
+		if err := config.Validate(); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		fmt.Fprintf(w, "%s is valid\n", path)
+		return nil
+	case "get":
+		return runGet(w, args[1:], path, configFlags)
+	case "set":
+		return runSet(w, args[1:], path, configFlags)
+	case "unset":
+		return runUnset(w, args[1:], path, configFlags)
+	case "encrypt-key":
+		if err := app.EncryptConfigAPIKey(path); err != nil {
+			return err
+		}
+
+		keyPath, err := app.EncryptionKeyPath()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "encrypted api_key in %s\nthe encryption key is stored in %s\n", path, keyPath)
+		return nil
+	default:
+		Usage(os.Stderr)
+		return fmt.Errorf("unknown config subcommand: %s", args[0])
+	}
+}
+
+// runShow prints every effective configuration value along with its source, optionally with secrets masked
+func runShow(w io.Writer, args []string, path string, configFlags []string) error {
+	flags := flag.NewFlagSet("config show", flag.ContinueOnError)
+	redacted := flags.Bool("redacted", false, "mask API keys and other secrets")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := loadConfig(path, configFlags)
+	if err != nil {
+		return err
+	}
+
+	if files := config.Files(); len(files) > 1 {
+		for _, file := range files {
+			fmt.Fprintf(w, "# merged %s\n", file)
+		}
+	}
+
+	values := config.Effective()
+	if *redacted {
+		values = config.Redacted()
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, value := range values {
+		fmt.Fprintf(tw, "%s = %s\t# %s\n", value.Path, formatValue(value.Value), value.Source)
+	}
+	return tw.Flush()
+}
+
+// loadConfig loads the configuration file, printing any warnings to stderr
+func loadConfig(path string, configFlags []string) (*app.Config, error) {
+	config, err := app.LoadConfig(path, configFlags...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, warning := range config.Warnings() {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+	}
+	return config, nil
+}
+
+// formatValue formats a configuration value similarly to TOML
+func formatValue(value any) string {
+	switch v := value.(type) {
+	case string:
+		return strconv.Quote(v)
+	case fmt.Stringer:
+		return strconv.Quote(v.String())
+	default:
+		if s := reflect.ValueOf(value); s.Kind() == reflect.String {
+			return strconv.Quote(s.String())
+		}
+		return fmt.Sprintf("%v", value)
+	}
+}
@@ -0,0 +1,101 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"ha-tray/internal/app"
+)
+
+// runGet prints the effective value at a key, or every value within it if the key is a table
+// A single string value is printed unquoted, so that it can be used by scripts.
+func runGet(w io.Writer, args []string, path string, configFlags []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: config get <key>")
+	}
+	key := args[0]
+
+	config, err := loadConfig(path, configFlags)
+	if err != nil {
+		return err
+	}
+
+	var values []app.EffectiveValue
+	for _, value := range config.Effective() {
+		if value.Path == key || strings.HasPrefix(value.Path, key+".") || strings.HasPrefix(value.Path, key+"[") {
+			values = append(values, value)
+		}
+	}
+
+	switch {
+	case len(values) == 0:
+		return fmt.Errorf("%s is not set", key)
+	case len(values) == 1 && values[0].Path == key:
+		if s, ok := values[0].Value.(string); ok {
+			fmt.Fprintln(w, s)
+		} else {
+			fmt.Fprintln(w, formatValue(values[0].Value))
+		}
+	default:
+		for _, value := range values {
+			fmt.Fprintf(w, "%s = %s\n", value.Path, formatValue(value.Value))
+		}
+	}
+	return nil
+}
+
+// runSet sets a value in the configuration file, then reports whether it is overridden or leaves the file invalid
+func runSet(w io.Writer, args []string, path string, configFlags []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: config set <key> <value>")
+	}
+
+	if err := app.SetConfigValue(path, args[0], args[1]); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "set %s in %s\n", args[0], path)
+
+	checkEdit(path, args[0], configFlags)
+	return nil
+}
+
+// runUnset removes a value or table from the configuration file
+func runUnset(w io.Writer, args []string, path string, configFlags []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: config unset <key>")
+	}
+
+	if err := app.UnsetConfigValue(path, args[0]); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "removed %s from %s\n", args[0], path)
+
+	checkEdit(path, "", configFlags)
+	return nil
+}
+
+// checkEdit warns if an edited key is overridden by a drop-in, environment variable or flag, or if the configuration is
+// no longer valid. Edits are kept regardless, as a configuration is often built up over several edits.
+func checkEdit(path, key string, configFlags []string) {
+	config, err := app.LoadConfig(path, configFlags...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		return
+	}
+
+	for _, value := range config.Effective() {
+		if value.Path != key {
+			continue
+		}
+		if value.Source.Kind == app.SourceEnv || value.Source.Kind == app.SourceFlag || (value.Source.Kind == app.SourceFile && value.Source.Name != path) {
+			fmt.Fprintf(os.Stderr, "warning: %s is overridden by %s\n", key, value.Source)
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+}
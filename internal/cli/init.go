@@ -0,0 +1,205 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/term"
+
+	"ha-tray/internal/app"
+)
+
+// defaultServerURL is suggested by the init wizard, as it is the address of a default Home Assistant installation
+const defaultServerURL = "http://homeassistant.local:8123"
+
+// defaultEntityFilter is suggested by the init wizard, as binary sensors (doors, windows, motion) suit the tray best
+const defaultEntityFilter = "binary_sensor."
+
+// runInit interactively creates a configuration file, verifying the server and API key before anything is written
+func runInit(w io.Writer, args []string, path string) error {
+	flags := flag.NewFlagSet("config init", flag.ContinueOnError)
+	force := flags.Bool("force", false, "overwrite an existing configuration file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path); err == nil && !*force {
+		return fmt.Errorf("%s already exists, use --force to overwrite it", path)
+	}
+
+	p := &prompter{in: bufio.NewReader(os.Stdin), out: w}
+	fmt.Fprintf(w, "Creating %s\n\n", path)
+
+	var (
+		server, apiKey string
+		probe          *app.ServerProbe
+	)
+	for {
+		var err error
+		if server, err = p.ask("Home Assistant URL", defaultServerURL); err != nil {
+			return err
+		}
+		if err := app.ValidateServerURL(server); err != nil {
+			fmt.Fprintf(w, "%v\n\n", err)
+			continue
+		}
+
+		if apiKey, err = p.askSecret("Long-lived access token (create one from your Home Assistant profile)"); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "Connecting to %s...\n", server)
+		probe, err = app.ProbeServer(context.Background(), app.ServerConfig{Name: "default", URL: server, APIKey: apiKey})
+		if err == nil {
+			break
+		}
+		fmt.Fprintf(w, "%v\n\n", err)
+	}
+	fmt.Fprintf(w, "Connected to Home Assistant %s, found %d entities\n\n", probe.Version, len(probe.Entities))
+
+	entities, err := chooseEntities(p, probe.Entities)
+	if err != nil {
+		return err
+	}
+
+	config := app.DefaultConfig()
+	config.Servers = []app.ServerConfig{{Name: "default", URL: server, APIKey: apiKey}}
+	for _, entity := range entities {
+		config.Entities = append(config.Entities, app.EntityConfig{ID: entity.ID, Label: entity.Name})
+	}
+
+	if err := app.SaveConfig(path, config); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\nWrote %s\nRun 'HATray config encrypt-key' to avoid storing the access token in plaintext.\n", path)
+	return nil
+}
+
+// chooseEntities asks the user to filter, then pick from, the server's entities until at least one is chosen
+func chooseEntities(p *prompter, available []app.ProbedEntity) ([]app.ProbedEntity, error) {
+	for {
+		filter, err := p.ask("Show entities matching", defaultEntityFilter)
+		if err != nil {
+			return nil, err
+		}
+
+		var matches []app.ProbedEntity
+		for _, entity := range available {
+			if strings.Contains(entity.ID, filter) || strings.Contains(strings.ToLower(entity.Name), strings.ToLower(filter)) {
+				matches = append(matches, entity)
+			}
+		}
+		if len(matches) == 0 {
+			fmt.Fprintf(p.out, "No entities match %q\n\n", filter)
+			continue
+		}
+
+		for i, entity := range matches {
+			fmt.Fprintf(p.out, "  %3d) %s", i+1, entity.ID)
+			if entity.Name != "" {
+				fmt.Fprintf(p.out, " (%s)", entity.Name)
+			}
+			fmt.Fprintf(p.out, " [%s]\n", entity.State)
+		}
+
+		answer, err := p.ask("Entities to show (numbers separated by spaces or commas, 'all', or empty to search again)", "")
+		if err != nil {
+			return nil, err
+		}
+		if answer == "" {
+			continue
+		}
+		if answer == "all" {
+			return matches, nil
+		}
+
+		chosen, err := parseChoices(answer, len(matches))
+		if err != nil {
+			fmt.Fprintf(p.out, "%v\n\n", err)
+			continue
+		}
+
+		entities := make([]app.ProbedEntity, 0, len(chosen))
+		for _, choice := range chosen {
+			entities = append(entities, matches[choice-1])
+		}
+		return entities, nil
+	}
+}
+
+// parseChoices parses a list of 1-indexed choices, ignoring duplicates
+func parseChoices(answer string, count int) ([]int, error) {
+	var (
+		choices []int
+		seen    = make(map[int]bool)
+	)
+	for _, field := range strings.FieldsFunc(answer, func(r rune) bool { return r == ',' || r == ' ' }) {
+		choice, err := strconv.Atoi(field)
+		if err != nil || choice < 1 || choice > count {
+			return nil, fmt.Errorf("invalid choice %q, expected a number from 1 to %d", field, count)
+		}
+		if !seen[choice] {
+			choices = append(choices, choice)
+			seen[choice] = true
+		}
+	}
+	return choices, nil
+}
+
+// prompter asks the user questions on the terminal
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// ask prints a question and reads a line, returning fallback if the answer is empty
+func (p *prompter) ask(question, fallback string) (string, error) {
+	if fallback != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, fallback)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", question)
+	}
+
+	line, err := p.in.ReadString('\n')
+	if err != nil && (!errors.Is(err, io.EOF) || line == "") {
+		return "", fmt.Errorf("failed to read answer: %w", err)
+	}
+
+	if answer := strings.TrimSpace(line); answer != "" {
+		return answer, nil
+	}
+	return fallback, nil
+}
+
+// askSecret asks for a value without echoing it, if stdin is a terminal. Empty answers are asked again.
+func (p *prompter) askSecret(question string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		for {
+			answer, err := p.ask(question, "")
+			if err != nil || answer != "" {
+				return answer, err
+			}
+		}
+	}
+
+	for {
+		fmt.Fprintf(p.out, "%s: ", question)
+		secret, err := term.ReadPassword(fd)
+		fmt.Fprintln(p.out)
+		if err != nil {
+			return "", fmt.Errorf("failed to read answer: %w", err)
+		}
+		if answer := strings.TrimSpace(string(secret)); answer != "" {
+			return answer, nil
+		}
+	}
+}
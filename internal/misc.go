@@ -3,3 +3,12 @@ package internal
 func Ptr[T any](value T) *T {
 	return &value
 }
+
+// Deref returns the value pointed to, or the zero value if the pointer is nil
+func Deref[T any](value *T) T {
+	if value == nil {
+		var zero T
+		return zero
+	}
+	return *value
+}
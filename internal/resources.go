@@ -3,6 +3,6 @@ package internal
 import "embed"
 
 var (
-	//go:embed resources/*.ico
+	//go:embed resources/*.png
 	Icons embed.FS
 )
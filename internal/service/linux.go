@@ -24,10 +24,10 @@ type linuxService struct {
 }
 
 // NewService creates a new Linux service instance
-func NewService(logger *slog.Logger) Service {
+func NewService(logger *slog.Logger, configPath string, configFlags []string) Service {
 	return &linuxService{
 		logger: logger.With("type", "service", "variant", "linux"),
-		app:    app.NewApp(logger),
+		app:    app.NewApp(logger, configPath, configFlags),
 	}
 }
 
@@ -58,17 +58,15 @@ func (s *linuxService) Run() error {
 	heartbeat := time.NewTicker(30 * time.Second)
 	defer heartbeat.Stop()
 
+	// Observe the app layer's lifecycle, reporting readiness and status to systemd
+	transitions, unsubscribe := s.app.Subscribe()
+	defer unsubscribe()
+
 	// Start the service (backgrounded so that the service can still respond to systemd signals, the app layer is still designed for concurrency)
 	go func() {
 		if err := s.app.Resume(); err != nil {
 			s.logger.Error("failed to start (resume) app layer", "error", err)
-
-			// TODO: This has no true error handling, retry mechanism, or timeout mechanism. If this fails, then the service will be stuck in the 'StartPending' state.
 		}
-
-		// Notify systemd that we are ready (and running)
-		daemon.SdNotify(false, daemon.SdNotifyReady)
-		daemon.SdNotify(false, fmt.Sprintf("STATUS=running for %s\n", time.Since(startTime).String()))
 	}()
 
 	for {
@@ -77,7 +75,28 @@ func (s *linuxService) Run() error {
 		case <-watchdog.C:
 			daemon.SdNotify(false, daemon.SdNotifyWatchdog)
 		case <-heartbeat.C:
-			daemon.SdNotify(false, fmt.Sprintf("STATUS=running for %s\n", time.Since(startTime).String()))
+			daemon.SdNotify(false, fmt.Sprintf("STATUS=%s for %s\n", s.app.GetState(), time.Since(startTime).String()))
+		case t, ok := <-transitions:
+			if !ok {
+				return nil // app layer stopped
+			}
+
+			switch t.To {
+			case app.StateRunning:
+				// Notify systemd that we are ready (and running), this also completes a reload
+				daemon.SdNotify(false, daemon.SdNotifyReady)
+				daemon.SdNotify(false, fmt.Sprintf("STATUS=running for %s\n", time.Since(startTime).String()))
+			case app.StateDegraded:
+				daemon.SdNotify(false, daemon.SdNotifyReady)
+				daemon.SdNotify(false, fmt.Sprintf("STATUS=degraded: %v\n", t.Err))
+			case app.StateFailed:
+				// Exiting allows systemd to restart the service (Restart=on-failure) instead of remaining stuck in a pending state
+				daemon.SdNotify(false, fmt.Sprintf("STATUS=failed: %v\n", t.Err))
+				if err := s.app.Stop(); err != nil {
+					s.logger.Error("failed to stop app layer", "error", err)
+				}
+				return fmt.Errorf("app layer failed: %w", t.Err)
+			}
 		case sig := <-sigs:
 			s.logger.Info("signal received", "signal", sig)
 
@@ -86,8 +105,8 @@ func (s *linuxService) Run() error {
 				daemon.SdNotify(false, daemon.SdNotifyStopping)
 				s.logger.Info("stopping service")
 
-				if err := s.app.Pause(); err != nil {
-					s.logger.Error("failed to pause app layer", "error", err)
+				if err := s.app.Stop(); err != nil {
+					s.logger.Error("failed to stop app layer", "error", err)
 				}
 
 				return nil // exit the service
@@ -25,17 +25,27 @@ type windowsService struct {
 	restartDelay time.Duration
 	quitChan     chan struct{}
 	restartChan  chan struct{}
+	appState     app.AppState // last observed app layer state
+
+	resumeBackoff time.Duration // delay before the next attempt to resume a failed app layer, doubled on each attempt
+	nextResume    time.Time     // earliest time the failed app layer may be resumed again
 }
 
+// maxResumeBackoff limits the delay between attempts to resume a failed app layer
+const maxResumeBackoff = 10 * time.Minute
+
 // NewService creates a new Windows tray service instance
-func NewService(logger *slog.Logger) Service {
+func NewService(logger *slog.Logger, configPath string, configFlags []string) Service {
 	return &windowsService{
 		logger:       logger.With("type", "service", "variant", "windows"),
-		app:          app.NewApp(logger),
+		app:          app.NewApp(logger, configPath, configFlags),
 		maxRestarts:  3,
 		restartDelay: 5 * time.Second,
 		quitChan:     make(chan struct{}),
-		restartChan:  make(chan struct{}),
+		restartChan:  make(chan struct{}, 1),
+		appState:     app.StateStopped,
+
+		resumeBackoff: time.Minute,
 	}
 }
 
@@ -81,6 +91,10 @@ func (svc *windowsService) Run() error {
 
 // runServiceLoop runs the main service loop
 func (svc *windowsService) runServiceLoop(sigs chan os.Signal) error {
+	// Observe the app layer's lifecycle for health checks
+	transitions, unsubscribe := svc.app.Subscribe()
+	defer unsubscribe()
+
 	// Start the application in background
 	go func() {
 		if err := svc.app.Resume(); err != nil {
@@ -101,15 +115,31 @@ func (svc *windowsService) runServiceLoop(sigs chan os.Signal) error {
 		select {
 		case <-svc.quitChan:
 			svc.logger.Info("shutting down service")
-			if err := svc.app.Pause(); err != nil {
-				svc.logger.Error("failed to pause app layer", "error", err)
+			if err := svc.app.Stop(); err != nil {
+				svc.logger.Error("failed to stop app layer", "error", err)
 			}
 			return nil
 
 		case <-svc.restartChan:
-			svc.logger.Info("restarting service")
-			if err := svc.app.Reload(); err != nil {
-				svc.logger.Error("failed to reload app layer", "error", err)
+			if svc.appState != app.StateFailed {
+				continue
+			}
+
+			// Degraded servers reconnect on their own, so only a failed app layer is resumed, backing off between attempts
+			svc.logger.Info("resuming failed app layer", "backoff", svc.resumeBackoff)
+			if err := svc.app.Resume(); err != nil {
+				svc.logger.Error("failed to resume app layer", "error", err)
+			}
+			svc.nextResume = time.Now().Add(svc.resumeBackoff)
+			svc.resumeBackoff = min(svc.resumeBackoff*2, maxResumeBackoff)
+
+		case t, ok := <-transitions:
+			if !ok {
+				return nil // app layer stopped
+			}
+			svc.appState = t.To
+			if t.To == app.StateRunning || t.To == app.StateDegraded {
+				svc.resumeBackoff = time.Minute
 			}
 
 		case <-heartbeat.C:
@@ -117,9 +147,13 @@ func (svc *windowsService) runServiceLoop(sigs chan os.Signal) error {
 
 		case <-watchdog.C:
 			// Check if app is healthy
-			if !svc.isAppHealthy() {
+			if !svc.isAppHealthy() && time.Now().After(svc.nextResume) {
 				svc.logger.Warn("app health check failed, triggering restart")
-				svc.restartChan <- struct{}{}
+				select {
+				case svc.restartChan <- struct{}{}:
+				default:
+					// a restart is already pending
+				}
 			}
 
 		case sig := <-sigs:
@@ -180,10 +214,9 @@ func (svc *windowsService) setupPowerManagement() {
 
 // isAppHealthy checks if the application is running properly
 func (svc *windowsService) isAppHealthy() bool {
-	// TODO: Implement health checks
-	// - Check if Home Assistant connection is alive
+	// TODO: Implement further health checks
 	// - Check if systray is responsive
 	// - Check memory usage
-	// - Check for any error conditions
-	return true
+	// Degraded is healthy, as the servers that could not be reached are reconnected by the app layer
+	return svc.appState != app.StateFailed
 }